@@ -0,0 +1,28 @@
+// Confirmation dialogs (SweetAlert) of the elements with `hx-confirm`,
+// instead of the browser one. The text of the confirm button can be
+// set with `data-confirm-button`. Registered once on the document
+// (event delegation), since hx-boost swaps the body without
+// reloading the scripts, and without inline handlers, which the
+// Content-Security-Policy blocks. The form of the bulk actions only
+// asks before deleting (`data-confirm-delete`).
+document.addEventListener('htmx:confirm', (e) => {
+    const elt = e.detail.elt;
+    const question = e.detail.question ||
+        (elt.elements?.action?.value === 'delete' && elt.dataset.confirmDelete);
+    if (!question) return;
+
+    e.preventDefault();
+    Swal.fire({
+        title: 'Do you want to perform this action?',
+        text: question,
+        icon: 'warning',
+        background: '#1D232A',
+        color: '#A6ADBA',
+        showCancelButton: true,
+        confirmButtonColor: '#3085d6',
+        cancelButtonColor: '#d33',
+        confirmButtonText: elt.dataset.confirmButton ?? 'Yes',
+    }).then((result) => {
+        if (result.isConfirmed) e.detail.issueRequest(true);
+    });
+});
@@ -0,0 +1,105 @@
+// Passkeys (WebAuthn): the server sends and expects the binary
+// fields encoded in base64url, while the browser API works
+// with ArrayBuffers, so they are converted in both directions.
+
+const bufferFromBase64url = (value) => {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = base64 + '='.repeat((4 - (base64.length % 4)) % 4);
+    return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+};
+
+const base64urlFromBuffer = (buffer) =>
+    btoa(String.fromCharCode(...new Uint8Array(buffer)))
+        .replace(/\+/g, '-')
+        .replace(/\//g, '_')
+        .replace(/=+$/, '');
+
+const postJSON = async (url, body) => {
+    const res = await fetch(url, {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-TimeZone': Intl.DateTimeFormat().resolvedOptions().timeZone,
+            'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content,
+        },
+        body: body ? JSON.stringify(body) : null,
+    });
+    const data = await res.json();
+    if (!res.ok) throw new Error(data.error || 'Unexpected server error');
+    return data;
+};
+
+const passkeyLogin = async () => {
+    const options = await postJSON('/passkey/login/begin');
+    options.challenge = bufferFromBase64url(options.challenge);
+
+    const cred = await navigator.credentials.get({ publicKey: options });
+
+    const data = await postJSON('/passkey/login/finish', {
+        id: cred.id,
+        type: cred.type,
+        response: {
+            clientDataJSON: base64urlFromBuffer(cred.response.clientDataJSON),
+            authenticatorData: base64urlFromBuffer(cred.response.authenticatorData),
+            signature: base64urlFromBuffer(cred.response.signature),
+            userHandle: cred.response.userHandle ? base64urlFromBuffer(cred.response.userHandle) : '',
+        },
+    });
+    window.location.assign(data.redirect);
+};
+
+const passkeyRegister = async (name) => {
+    const options = await postJSON('/settings/passkeys/begin');
+    options.challenge = bufferFromBase64url(options.challenge);
+    options.user.id = bufferFromBase64url(options.user.id);
+    options.excludeCredentials.forEach((c) => (c.id = bufferFromBase64url(c.id)));
+
+    const cred = await navigator.credentials.create({ publicKey: options });
+
+    const data = await postJSON('/settings/passkeys/finish', {
+        name,
+        credential: {
+            id: cred.id,
+            type: cred.type,
+            response: {
+                clientDataJSON: base64urlFromBuffer(cred.response.clientDataJSON),
+                attestationObject: base64urlFromBuffer(cred.response.attestationObject),
+            },
+        },
+    });
+    window.location.assign(data.redirect);
+};
+
+const showPasskeyError = (err) => {
+    // The user closed the browser dialog: nothing to report
+    if (err.name === 'NotAllowedError' || err.name === 'AbortError') return;
+    Swal.fire({
+        title: 'Passkey error',
+        text: err.message,
+        icon: 'error',
+        background: '#1D232A',
+        color: '#A6ADBA',
+        confirmButtonColor: '#3085d6',
+    });
+};
+
+// Event delegation, since hx-boost swaps the body without reloading the scripts
+document.addEventListener('click', (e) => {
+    const login = e.target.closest('[data-passkey-login]');
+    const register = e.target.closest('[data-passkey-register]');
+    if (!login && !register) return;
+
+    e.preventDefault();
+    if (!window.PublicKeyCredential) {
+        showPasskeyError(new Error('Your browser does not support passkeys'));
+        return;
+    }
+
+    if (login) {
+        passkeyLogin().catch(showPasskeyError);
+    } else {
+        const name = document.getElementById('passkey-name')?.value ?? '';
+        passkeyRegister(name).catch(showPasskeyError);
+    }
+});
@@ -0,0 +1,10 @@
+// Timezone detected by the browser, sent by the forms that log the
+// user in or issue the JWT again in their hidden `tz` field. Filled
+// here, on every load or swap of content (see htmx.onLoad), since the
+// Content-Security-Policy blocks the `js:` values of hx-headers.
+htmx.onLoad((elt) => {
+    const timeZone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+    elt.querySelectorAll('input[name="tz"]').forEach((input) => {
+        input.value = timeZone;
+    });
+});
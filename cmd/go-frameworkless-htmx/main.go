@@ -1,49 +1,362 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"log"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	frameworklesshtmx "github.com/emarifer/go-frameworkless-htmx"
+	"github.com/emarifer/go-frameworkless-htmx/internal/config"
 	"github.com/emarifer/go-frameworkless-htmx/internal/db"
 	"github.com/emarifer/go-frameworkless-htmx/internal/handlers"
+	"github.com/emarifer/go-frameworkless-htmx/internal/mailer"
 	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/jwt"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/metrics"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/passwd"
 	"github.com/emarifer/go-frameworkless-htmx/internal/utils/prettylog"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/ratelimit"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/reqctx"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/static"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/tracing"
+)
+
+// Timeouts of the server, so that slow or idle clients
+// cannot hold the connections (and goroutines) forever.
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 15 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+	maxHeaderBytes    = 64 << 10
 )
 
 func main() {
-	logger := slog.New(prettylog.NewHandler(nil))
+	logMode, err := prettylog.ParseMode(config.LogFormat())
+	if err != nil {
+		log.Fatalf("🔥 failed to load the configuration: %s", err)
+	}
+	logger := slog.New(prettylog.NewHandler(nil, logMode))
+
+	// The context is canceled by SIGINT (Ctrl + C) or SIGTERM
+	// (e.g. sent on deploy), which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+
+	cfg, err := config.Load(logger)
+	if err != nil {
+		log.Fatalf("🔥 failed to load the configuration: %s", err)
+	}
+
+	// Once the configuration is loaded, the logs
+	// are also sent to the sinks it enables
+	logger, logSinks, err := newLogger(cfg, logMode)
+	if err != nil {
+		log.Fatalf("🔥 failed to open the log sinks: %s", err)
+	}
+
+	kr, err := jwt.LoadKeyRing(
+		cfg.JWTSigningKey, cfg.JWTVerifyKeys, cfg.JWTIssuer, cfg.JWTAudience,
+	)
+	if err != nil {
+		log.Fatalf("🔥 failed to load the JWT keys: %s", err)
+	}
+	jwt.Init(kr)
+
+	flushTraces, err := tracing.Setup(
+		ctx, cfg.TracesExporter, cfg.TracesFile, syslogTag, version(),
+	)
+	if err != nil {
+		log.Fatalf("🔥 failed to set up the tracing: %s", err)
+	}
 
 	router := http.NewServeMux()
 
-	// Setting the static file service (assets)
-	fs := http.FileServer(http.Dir("assets"))
-	router.Handle("/assets/", http.StripPrefix("/assets/", fs))
+	// The database is measured and traced
+	// from its opening (see db.GetDB)
+	reg := metrics.NewRegistry()
+	reg.OnScrape(metrics.CollectRuntime)
+	db.Instrument(reg)
+	if cfg.TracesExporter != tracing.ExporterNone {
+		db.Trace()
+	}
 
 	// Dependency injection
-	us := services.NewUserService(services.User{}, db.GetDB(logger))
-	ah := handlers.NewAuthHandle(us)
+	var m mailer.Mailer = mailer.NewLogMailer(logger)
+	if cfg.SMTPHost != "" {
+		m = mailer.NewSMTPMailer(
+			cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom,
+		)
+	}
+
+	hasher, err := passwd.NewHasher(cfg.PasswordHash, cfg.PasswordBcryptCost)
+	if err != nil {
+		log.Fatalf("🔥 failed to load the configuration: %s", err)
+	}
+
+	us := services.NewUserService(services.User{}, db.GetDB(logger), hasher)
+	// The calls of the handlers to the user
+	// and task services are traced
+	tus := handlers.TraceAuthService(us)
+	tts := services.NewThrottleService(services.Throttle{}, db.GetDB(logger))
+	ah := handlers.NewAuthHandle(tus, tts, m, cfg, logger)
+
+	ps := services.NewPasskeyService(services.Passkey{}, db.GetDB(logger))
+	ph := handlers.NewPasskeyHandle(ps, tus, cfg)
+
+	if err := us.PromoteAdmins(ctx, cfg.AdminEmails); err != nil {
+		log.Fatalf("🔥 failed to promote the administrators: %s", err)
+	}
+
+	as := services.NewAdminService(services.AuditEntry{}, db.GetDB(logger))
+	adh := handlers.NewAdminHandle(as, tus, cfg)
 
 	ts := services.NewTodoService(services.Todo{}, db.GetDB(logger))
-	th := handlers.NewTodoHandle(ts)
+	th := handlers.NewTodoHandle(handlers.TraceTaskService(ts))
+
+	sh := handlers.NewSecurityHandle(cfg, logger)
+	hh := handlers.NewHealthHandle(db.Ready)
+	mh := handlers.NewMetricsHandle(reg, as, cfg.MetricsToken, logger)
+
+	// The web interface is embedded in the binary,
+	// except in development mode (see config.Config)
+	var files fs.FS = frameworklesshtmx.Files
+	if cfg.DevMode {
+		files = os.DirFS(".")
+	}
+	assetFiles, err := fs.Sub(files, "assets")
+	if err != nil {
+		log.Fatalf("🔥 failed to load the static files: %s", err)
+	}
+	assets, err := static.New(assetFiles, "/assets/", cfg.DevMode)
+	if err != nil {
+		log.Fatalf("🔥 failed to load the static files: %s", err)
+	}
+	if missing := assets.Missing(); len(missing) > 0 {
+		log.Fatalf("🔥 the front-end libraries are not vendored (run `go generate`): %s",
+			strings.Join(missing, ", "))
+	}
+	site := handlers.Site{Views: files, Assets: assets, Dev: cfg.DevMode}
 
-	handlers.LoadRoutes(router, ah, th)
+	routes := handlers.LoadRoutes(router, ah, ph, adh, th, sh, hh, mh, site)
+
+	rls := services.NewRateLimitService(services.RateBucket{}, db.GetDB(logger))
+	var rateStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimitStore == "sqlite" {
+		rateStore = rls
+	}
+
+	// The accounts whose deletion grace period is over are purged
+	// at startup and then every hour, until the shutdown.
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			n, err := us.PurgeDeletedUsers(ctx, time.Now())
+			if err != nil {
+				logger.Error("🔴 Worker Error: could not purge the deleted accounts",
+					"error", err.Error(),
+				)
+			} else if n > 0 {
+				logger.Info("🗑️ Worker Info: deleted accounts purged", "count", n)
+			}
+			if err := rls.PurgeRateLimits(ctx, time.Now()); err != nil {
+				logger.Error("🔴 Worker Error: could not purge the rate limits",
+					"error", err.Error(),
+				)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	// Set of middlwares ordered from the most external to the most internal.
 	stack := handlers.CreateStack(
+		handlers.RequestIDMiddleware,
+		handlers.TracingMiddleware,
 		handlers.NewLogging(logger).LoggingMiddleware,
-		handlers.FlagMiddleware,
-		handlers.AuthMiddleware,
+		mh.MetricsMiddleware,
+		routes.RouteMiddleware,
+		sh.SecurityMiddleware,
+		handlers.NewBodyLimit(cfg.MaxBodyBytes).BodyLimitMiddleware,
+		handlers.NewAuth(routes, tus).AuthMiddleware,
+		handlers.NewRateLimiter(routes, rateStore, cfg.TrustProxy, logger).RateLimitMiddleware,
+		handlers.NewCSRF(routes).CSRFMiddleware,
 	)
 
 	server := http.Server{
-		Addr:    ":3000",
-		Handler: stack(router),
+		Addr:              ":3000",
+		Handler:           stack(router),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
 	}
 
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
 	logger.Info("🚀 Server Info: listening on :3000…")
+	hh.SetReady(true)
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("🔥 failed to start the server: %s", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the application right away
+	stop()
+
+	shutdown(
+		logger, cfg.ShutdownTimeout, &server, hh, &workers, ah, flushTraces, logSinks,
+	)
+}
+
+// syslogTag is the application name in the syslog
+// messages (and the service name in the traces).
+const syslogTag = "go-frameworkless-htmx"
+
+// version returns the version of the main module, as stamped by
+// the Go toolchain in the binary ("(devel)" if built from a checkout).
+func version() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		return bi.Main.Version
+	}
+
+	return "unknown"
+}
+
+// newLogger creates the logger with the sinks of the configuration
+// (see config.Config): the console and, optionally, a rotating file
+// and a syslog server. The sinks to close on shutdown are returned.
+func newLogger(
+	cfg *config.Config, consoleMode prettylog.Mode,
+) (*slog.Logger, []io.Closer, error) {
+	sinks := []slog.Handler{
+		prettylog.NewHandler(&slog.HandlerOptions{Level: cfg.LogLevel}, consoleMode),
+	}
+	closers := []io.Closer{}
+
+	if cfg.LogFile != "" {
+		mode, err := prettylog.ParseMode(cfg.LogFileFormat)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rf, err := prettylog.OpenRotatingFile(
+			cfg.LogFile, cfg.LogFileMaxSize, cfg.LogFileMaxAge, cfg.LogFileCompress,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sinks = append(sinks, prettylog.New(
+			&slog.HandlerOptions{Level: cfg.LogFileLevel},
+			prettylog.WithDestinationWriter(rf),
+			prettylog.WithMode(mode),
+		))
+		closers = append(closers, rf)
+	}
+
+	if cfg.LogSyslogAddr != "" {
+		sh, err := prettylog.DialSyslog(
+			cfg.LogSyslogAddr, syslogTag, &slog.HandlerOptions{Level: cfg.LogSyslogLevel},
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sinks = append(sinks, sh)
+		closers = append(closers, sh)
+	}
 
-	log.Fatal(server.ListenAndServe())
+	var h slog.Handler = prettylog.NewFanout(sinks...)
+	if len(sinks) == 1 {
+		h = sinks[0]
+	}
+
+	// The records logged with the context of a request
+	// carry its ID and the user ID (see reqctx.LogHandler)
+	return slog.New(reqctx.NewLogHandler(h)), closers, nil
+}
+
+// shutdown stops the application in order: the application stops
+// being ready, the server stops accepting connections and waits for
+// the in-flight requests, then the background workers and emails are
+// waited for, the database is closed, the pending spans are
+// exported and finally the log sinks are closed. Everything has to
+// be done before the timeout; what is left is abandoned.
+func shutdown(
+	logger *slog.Logger, timeout time.Duration, server *http.Server,
+	hh *handlers.HealthHandle, workers *sync.WaitGroup, ah *handlers.AuthHandle,
+	flushTraces func(context.Context) error, logSinks []io.Closer,
+) {
+	logger.Info("🛑 Server Info: shutting down, draining the requests…",
+		"timeout", timeout.String(),
+	)
+	hh.SetReady(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("🔴 Server Error: the requests could not be drained",
+			"error", err.Error(),
+		)
+	}
+
+	// The workers have been told to stop by the signal
+	workers.Wait()
+
+	if err := ah.WaitEmails(ctx); err != nil {
+		logger.Error("🔴 Mailer Error: some emails could not be sent",
+			"error", err.Error(),
+		)
+	}
+
+	if err := db.Close(); err != nil {
+		logger.Error("🔴 Database Error: could not close the database",
+			"error", err.Error(),
+		)
+	}
+
+	if err := flushTraces(ctx); err != nil {
+		logger.Error("🔴 Tracing Error: could not export the pending spans",
+			"error", err.Error(),
+		)
+	}
+
+	logger.Info("👋 Server Info: stopped")
+
+	// The last ones, so that nothing is left to log
+	for _, sink := range logSinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("🔴 could not close a log sink: %s", err)
+		}
+	}
 }
 
 /* REFERENCES:
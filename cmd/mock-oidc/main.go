@@ -0,0 +1,232 @@
+// mock-oidc is a minimal OpenID Connect provider for local
+// development: every user who submits the form is logged in
+// with the email given. DO NOT use it in production.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "mock-1"
+
+type grant struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	challenge     string
+	email         string
+	name          string
+	emailVerified bool
+	expiresAt     time.Time
+}
+
+type provider struct {
+	issuer string
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+var authorizeTmpl = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html><head><title>Mock OIDC</title></head>
+<body style="font-family: sans-serif; max-width: 24rem; margin: 4rem auto">
+<h1>Mock OIDC login</h1>
+<form method="post">
+{{ range $k, $v := .Query }}<input type="hidden" name="{{ $k }}" value="{{ index $v 0 }}">
+{{ end }}<p><label>Email <input type="email" name="email" required autofocus></label></p>
+<p><label>Name <input type="text" name="name"></label></p>
+<p><label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label></p>
+<p><button>Sign in</button> <button name="deny" value="1">Deny</button></p>
+</form>
+</body></html>`))
+
+func main() {
+	addr := flag.String("addr", ":3001", "listen address")
+	issuer := flag.String("issuer", "http://localhost:3001", "issuer URL")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := &provider{
+		issuer: strings.TrimSuffix(*issuer, "/"),
+		key:    key,
+		grants: map[string]grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	mux.HandleFunc("GET /authorize", p.authorizeForm)
+	mux.HandleFunc("POST /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+
+	log.Printf("mock OIDC provider listening on %s (issuer %s)", *addr, p.issuer)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	enc := base64.RawURLEncoding
+	pub := p.key.PublicKey
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   enc.EncodeToString(pub.N.Bytes()),
+			"e":   enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *provider) authorizeForm(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("redirect_uri") == "" ||
+		q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	authorizeTmpl.Execute(w, map[string]any{"Query": q})
+}
+
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	v := url.Values{}
+	v.Set("state", r.FormValue("state"))
+
+	if r.FormValue("deny") != "" {
+		v.Set("error", "access_denied")
+	} else {
+		code := randomString()
+		p.mu.Lock()
+		p.grants[code] = grant{
+			clientID:      r.FormValue("client_id"),
+			redirectURI:   r.FormValue("redirect_uri"),
+			nonce:         r.FormValue("nonce"),
+			challenge:     r.FormValue("code_challenge"),
+			email:         r.FormValue("email"),
+			name:          r.FormValue("name"),
+			emailVerified: r.FormValue("email_verified") == "true",
+			expiresAt:     time.Now().Add(time.Minute),
+		}
+		p.mu.Unlock()
+		v.Set("code", code)
+	}
+
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+	}
+	clientID, _ = url.QueryUnescape(clientID)
+
+	code := r.FormValue("code")
+	p.mu.Lock()
+	g, found := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	switch {
+	case r.FormValue("grant_type") != "authorization_code",
+		!found, time.Now().After(g.expiresAt),
+		g.clientID != clientID,
+		g.redirectURI != r.FormValue("redirect_uri"),
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "invalid_grant",
+		})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            fmt.Sprintf("%x", sha256.Sum256([]byte(g.email)))[:24],
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.email,
+		"email_verified": g.emailVerified,
+		"name":           g.name,
+	})
+	token.Header["kid"] = keyID
+
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "server_error",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
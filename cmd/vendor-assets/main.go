@@ -0,0 +1,66 @@
+// Command vendor-assets downloads the third-party libraries of the
+// web interface (static.Vendored) into assets/vendor, so that they
+// are embedded in the binary and served by the application itself.
+// It is run by `go generate` from the root of the repository.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/static"
+)
+
+func main() {
+	dir := filepath.Join("assets", static.VendorDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatalf("🔥 failed to create %s: %s", dir, err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	for name, url := range static.Vendored {
+		if err := download(client, url, filepath.Join(dir, name)); err != nil {
+			log.Fatalf("🔥 failed to download %s: %s", name, err)
+		}
+		log.Printf("📦 %s <- %s", name, url)
+	}
+}
+
+// download writes the body of the URL into the file, replacing it
+// only once the whole body has been received.
+func download(client *http.Client, url, path string) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, res.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
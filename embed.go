@@ -0,0 +1,12 @@
+// Package frameworklesshtmx embeds the web interface (the templates
+// of views/ and the static files of assets/ that they use, not the
+// images of the README) in the binary, so that it can run from any
+// directory.
+package frameworklesshtmx
+
+import "embed"
+
+//go:generate go run ./cmd/vendor-assets
+
+//go:embed views/*.tmpl assets/css assets/js assets/vendor assets/img/Go_gopher_favicon.svg
+var Files embed.FS
@@ -0,0 +1,332 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openssl rand -base64 32 (command)
+// Only used in development mode (APP_DEV_MODE), where
+// APP_ENCRYPTION_KEY may be left unset.
+const devEncryptionKey = "H8LrEfP9D9oEupVmvNGbKKK3LYvNL8FZEn39lEmDWjg="
+
+// Config groups the settings of the application. They are read
+// from environment variables, with defaults suitable for development.
+type Config struct {
+	// AppName is shown to the user, e.g. as
+	// the issuer in their authenticator application.
+	AppName string
+	// BaseURL is the public URL of the application (scheme, host
+	// and port), e.g. the origin expected by the WebAuthn ceremonies.
+	BaseURL *url.URL
+	// EncryptionKey (32 bytes) is used to encrypt secrets at rest.
+	EncryptionKey []byte
+
+	// JWTSigningKey is the PEM file of the private key (Ed25519 or
+	// P-256) that signs the session tokens. JWTVerifyKeys are the
+	// files of the previous keys, which are still accepted to verify
+	// the tokens they signed (key rotation). If JWTSigningKey is
+	// empty, a random key is generated at startup.
+	JWTSigningKey string
+	JWTVerifyKeys []string
+	// JWTIssuer and JWTAudience are set in the tokens and
+	// required when verifying them (APP_BASE_URL by default).
+	JWTIssuer   string
+	JWTAudience string
+
+	// OpenID Connect single sign-on, disabled if OIDCIssuer is empty.
+	// The redirect URI to register in the provider is
+	// `APP_BASE_URL/oidc/callback`.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// OIDCProviderName is shown in the "Sign in with…" button.
+	OIDCProviderName string
+
+	// SMTP server used to send emails. If SMTPHost
+	// is empty, the emails are only written to the log.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+
+	// TrustProxy makes the application take the client IP from
+	// the X-Forwarded-For header (set it only behind a reverse proxy).
+	TrustProxy bool
+
+	// Password policy of the new passwords: minimum length (in
+	// characters) and estimated strength (in bits), and the directory
+	// of the breached password list (the bundled one if empty).
+	PasswordMinLength   int
+	PasswordMinEntropy  float64
+	PasswordBreachedDir string
+	// PasswordHash is the algorithm of the new password hashes
+	// ("bcrypt" or "argon2id"). The older hashes are upgraded
+	// on the next login of their users.
+	PasswordHash       string
+	PasswordBcryptCost int
+
+	// RateLimitStore is where the state of the rate limiter is kept:
+	// "memory" (a single process) or "sqlite" (shared by the
+	// processes that use the same database).
+	RateLimitStore string
+
+	// ShutdownTimeout is how long the in-flight requests (and the
+	// background tasks) are waited for when the server is stopped.
+	ShutdownTimeout time.Duration
+	// MaxBodyBytes is the maximum size of the request bodies.
+	MaxBodyBytes int64
+
+	// Sinks of the logs, each with its own level: the console
+	// (LOG_LEVEL), a file rotated when it reaches LogFileMaxSize
+	// (disabled if LogFile is empty), whose backups are compressed
+	// and deleted after LogFileMaxAge, and a syslog server over UDP
+	// (disabled if LogSyslogAddr is empty).
+	LogLevel        slog.Level
+	LogFile         string
+	LogFileLevel    slog.Level
+	LogFileFormat   string
+	LogFileMaxSize  int64 // in bytes
+	LogFileMaxAge   time.Duration
+	LogFileCompress bool
+	LogSyslogAddr   string
+	LogSyslogLevel  slog.Level
+
+	// DevMode reads the templates and the static files from the
+	// working directory on every request (instead of the copies
+	// embedded in the binary), so that they can be edited live.
+	DevMode bool
+
+	// CSPReportOnly sends the Content-Security-Policy in report-only
+	// mode: the violations are reported (to /csp-report) but not
+	// blocked, to try out a change of the policy.
+	CSPReportOnly bool
+
+	// AdminEmails are promoted to administrators at startup
+	// (APP_ADMIN_EMAILS, separated by commas).
+	AdminEmails []string
+
+	// MetricsToken is the bearer token that the scrapers must send
+	// to read /metrics. If it is empty, the metrics are public,
+	// without the business figures (read from the database).
+	MetricsToken string
+
+	// TracesExporter is where the spans of the OpenTelemetry tracing
+	// are sent (OTEL_TRACES_EXPORTER): "none" (disabled), "otlp" (to
+	// a collector, see the OTEL_EXPORTER_OTLP_* variables) or
+	// "console", to TracesFile or, if empty, the standard output.
+	TracesExporter string
+	TracesFile     string
+}
+
+// LogFormat is the output format of the logs (LOG_FORMAT): "pretty"
+// for development, or "json" or "logfmt" to be collected in
+// production. It is read apart from Load, which needs the logger.
+func LogFormat() string {
+	return getEnv("LOG_FORMAT", "pretty")
+}
+
+// Load reads the configuration from the environment.
+func Load(logger *slog.Logger) (*Config, error) {
+	cfg := &Config{
+		AppName: getEnv("APP_NAME", "Go Todo List"),
+	}
+
+	baseURL, err := url.Parse(getEnv("APP_BASE_URL", "http://localhost:3000"))
+	if err != nil || baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, fmt.Errorf("APP_BASE_URL must be an absolute URL")
+	}
+	cfg.BaseURL = baseURL
+
+	cfg.DevMode, err = strconv.ParseBool(getEnv("APP_DEV_MODE", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("APP_DEV_MODE must be a boolean")
+	}
+
+	// The development key is public (committed): anyone could
+	// decrypt the TOTP secrets and the OIDC state with it
+	encKey := os.Getenv("APP_ENCRYPTION_KEY")
+	if encKey == "" {
+		if !cfg.DevMode {
+			return nil, fmt.Errorf("APP_ENCRYPTION_KEY is required (unless APP_DEV_MODE is set)")
+		}
+		logger.Warn("⚠️ Config Warning: APP_ENCRYPTION_KEY not set, using the development key")
+		encKey = devEncryptionKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("APP_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+	}
+	cfg.EncryptionKey = key
+
+	cfg.JWTSigningKey = os.Getenv("JWT_SIGNING_KEY")
+	if cfg.JWTSigningKey == "" {
+		logger.Warn("⚠️ Config Warning: JWT_SIGNING_KEY not set, using a random key (sessions will not survive a restart)")
+	}
+	cfg.JWTVerifyKeys = splitList(os.Getenv("JWT_VERIFY_KEYS"))
+	cfg.JWTIssuer = getEnv("JWT_ISSUER", baseURL.String())
+	cfg.JWTAudience = getEnv("JWT_AUDIENCE", baseURL.String())
+
+	cfg.OIDCIssuer = os.Getenv("OIDC_ISSUER")
+	cfg.OIDCClientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.OIDCProviderName = getEnv("OIDC_PROVIDER_NAME", "SSO")
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+
+	cfg.SMTPHost = os.Getenv("SMTP_HOST")
+	cfg.SMTPPort = getEnv("SMTP_PORT", "587")
+	cfg.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	cfg.MailFrom = getEnv("MAIL_FROM", "no-reply@"+baseURL.Hostname())
+	if cfg.SMTPHost == "" {
+		logger.Warn("⚠️ Config Warning: SMTP_HOST not set, emails will only be logged")
+	}
+
+	trustProxy, err := strconv.ParseBool(getEnv("APP_TRUST_PROXY", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("APP_TRUST_PROXY must be a boolean")
+	}
+	cfg.TrustProxy = trustProxy
+
+	cfg.PasswordMinLength, err = strconv.Atoi(getEnv("PASSWORD_MIN_LENGTH", "8"))
+	if err != nil || cfg.PasswordMinLength < 1 {
+		return nil, fmt.Errorf("PASSWORD_MIN_LENGTH must be a positive integer")
+	}
+
+	cfg.PasswordMinEntropy, err = strconv.ParseFloat(
+		getEnv("PASSWORD_MIN_ENTROPY", "40"), 64,
+	)
+	if err != nil || cfg.PasswordMinEntropy < 0 {
+		return nil, fmt.Errorf("PASSWORD_MIN_ENTROPY must be a positive number")
+	}
+
+	cfg.PasswordBreachedDir = os.Getenv("PASSWORD_BREACHED_LIST")
+	if cfg.PasswordBreachedDir != "" {
+		if info, err := os.Stat(cfg.PasswordBreachedDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("PASSWORD_BREACHED_LIST must be a directory")
+		}
+	}
+
+	cfg.PasswordHash = getEnv("PASSWORD_HASH", "bcrypt")
+	cfg.PasswordBcryptCost, err = strconv.Atoi(getEnv("PASSWORD_BCRYPT_COST", "12"))
+	if err != nil {
+		return nil, fmt.Errorf("PASSWORD_BCRYPT_COST must be an integer")
+	}
+
+	cfg.RateLimitStore = getEnv("RATE_LIMIT_STORE", "memory")
+	if cfg.RateLimitStore != "memory" && cfg.RateLimitStore != "sqlite" {
+		return nil, fmt.Errorf(`RATE_LIMIT_STORE must be "memory" or "sqlite"`)
+	}
+
+	cfg.ShutdownTimeout, err = time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil || cfg.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration (e.g. 30s)")
+	}
+
+	cfg.MaxBodyBytes, err = strconv.ParseInt(getEnv("MAX_BODY_BYTES", "1048576"), 10, 64)
+	if err != nil || cfg.MaxBodyBytes < 1 {
+		return nil, fmt.Errorf("MAX_BODY_BYTES must be a positive integer")
+	}
+
+	if err := cfg.loadLogSinks(); err != nil {
+		return nil, err
+	}
+
+	cfg.CSPReportOnly, err = strconv.ParseBool(getEnv("CSP_REPORT_ONLY", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("CSP_REPORT_ONLY must be a boolean")
+	}
+
+	cfg.AdminEmails = splitList(os.Getenv("APP_ADMIN_EMAILS"))
+
+	cfg.MetricsToken = os.Getenv("METRICS_TOKEN")
+	if cfg.MetricsToken == "" {
+		logger.Warn("⚠️ Config Warning: METRICS_TOKEN not set, /metrics is public (without the business figures)")
+	}
+
+	cfg.TracesExporter = getEnv("OTEL_TRACES_EXPORTER", "none")
+	switch cfg.TracesExporter {
+	case "none", "otlp", "console":
+	default:
+		return nil, fmt.Errorf(`OTEL_TRACES_EXPORTER must be "none", "otlp" or "console"`)
+	}
+	cfg.TracesFile = os.Getenv("OTEL_TRACES_FILE")
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadLogSinks() error {
+	levels := []struct {
+		key      string
+		fallback string
+		level    *slog.Level
+	}{
+		{"LOG_LEVEL", "info", &cfg.LogLevel},
+		{"LOG_FILE_LEVEL", "info", &cfg.LogFileLevel},
+		{"LOG_SYSLOG_LEVEL", "warn", &cfg.LogSyslogLevel},
+	}
+	for _, l := range levels {
+		if err := l.level.UnmarshalText([]byte(getEnv(l.key, l.fallback))); err != nil {
+			return fmt.Errorf("%s must be a level (debug, info, warn or error)", l.key)
+		}
+	}
+
+	cfg.LogFile = os.Getenv("LOG_FILE")
+	cfg.LogFileFormat = getEnv("LOG_FILE_FORMAT", "json")
+	if cfg.LogFileFormat != "json" && cfg.LogFileFormat != "logfmt" {
+		return fmt.Errorf(`LOG_FILE_FORMAT must be "json" or "logfmt"`)
+	}
+
+	maxSize, err := strconv.ParseInt(getEnv("LOG_FILE_MAX_SIZE_MB", "10"), 10, 64)
+	if err != nil || maxSize < 1 {
+		return fmt.Errorf("LOG_FILE_MAX_SIZE_MB must be a positive integer")
+	}
+	cfg.LogFileMaxSize = maxSize << 20
+
+	cfg.LogFileMaxAge, err = time.ParseDuration(getEnv("LOG_FILE_MAX_AGE", "720h"))
+	if err != nil || cfg.LogFileMaxAge < 0 {
+		return fmt.Errorf("LOG_FILE_MAX_AGE must be a duration (e.g. 720h, 0 keeps the files)")
+	}
+
+	cfg.LogFileCompress, err = strconv.ParseBool(getEnv("LOG_FILE_COMPRESS", "true"))
+	if err != nil {
+		return fmt.Errorf("LOG_FILE_COMPRESS must be a boolean")
+	}
+
+	cfg.LogSyslogAddr = os.Getenv("LOG_SYSLOG_ADDR")
+
+	return nil
+}
+
+// getEnv returns the value of the environment variable
+// or the fallback value if it is not set.
+func getEnv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return fallback
+}
+
+// splitList splits a list of values separated by commas,
+// ignoring the empty ones.
+func splitList(s string) []string {
+	values := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
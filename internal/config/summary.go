@@ -0,0 +1,77 @@
+package config
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// redacted replaces the value of the secrets in the summary.
+const redacted = "•••••• (set)"
+
+// Setting is a setting of the configuration as shown
+// to the administrators, under its environment variable.
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// Summary returns the settings of the configuration for the
+// diagnostics page, with the secrets (the keys, the passwords
+// and the tokens) redacted: it only tells whether they are set.
+func (cfg *Config) Summary() []Setting {
+	secret := func(v string) string {
+		if v == "" {
+			return "(not set)"
+		}
+
+		return redacted
+	}
+	encKey := redacted
+	if base64.StdEncoding.EncodeToString(cfg.EncryptionKey) == devEncryptionKey {
+		encKey = "(development key)"
+	}
+
+	return []Setting{
+		{"APP_NAME", cfg.AppName},
+		{"APP_BASE_URL", cfg.BaseURL.String()},
+		{"APP_ENCRYPTION_KEY", encKey},
+		{"APP_TRUST_PROXY", strconv.FormatBool(cfg.TrustProxy)},
+		{"APP_DEV_MODE", strconv.FormatBool(cfg.DevMode)},
+		{"APP_ADMIN_EMAILS", strings.Join(cfg.AdminEmails, ", ")},
+		{"JWT_SIGNING_KEY", cfg.JWTSigningKey},
+		{"JWT_VERIFY_KEYS", strings.Join(cfg.JWTVerifyKeys, ", ")},
+		{"JWT_ISSUER", cfg.JWTIssuer},
+		{"JWT_AUDIENCE", cfg.JWTAudience},
+		{"OIDC_ISSUER", cfg.OIDCIssuer},
+		{"OIDC_CLIENT_ID", cfg.OIDCClientID},
+		{"OIDC_CLIENT_SECRET", secret(cfg.OIDCClientSecret)},
+		{"OIDC_PROVIDER_NAME", cfg.OIDCProviderName},
+		{"SMTP_HOST", cfg.SMTPHost},
+		{"SMTP_PORT", cfg.SMTPPort},
+		{"SMTP_USERNAME", cfg.SMTPUsername},
+		{"SMTP_PASSWORD", secret(cfg.SMTPPassword)},
+		{"MAIL_FROM", cfg.MailFrom},
+		{"PASSWORD_MIN_LENGTH", strconv.Itoa(cfg.PasswordMinLength)},
+		{"PASSWORD_MIN_ENTROPY", strconv.FormatFloat(cfg.PasswordMinEntropy, 'g', -1, 64)},
+		{"PASSWORD_BREACHED_LIST", cfg.PasswordBreachedDir},
+		{"PASSWORD_HASH", cfg.PasswordHash},
+		{"PASSWORD_BCRYPT_COST", strconv.Itoa(cfg.PasswordBcryptCost)},
+		{"RATE_LIMIT_STORE", cfg.RateLimitStore},
+		{"SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout.String()},
+		{"MAX_BODY_BYTES", strconv.FormatInt(cfg.MaxBodyBytes, 10)},
+		{"LOG_LEVEL", cfg.LogLevel.String()},
+		{"LOG_FILE", cfg.LogFile},
+		{"LOG_FILE_LEVEL", cfg.LogFileLevel.String()},
+		{"LOG_FILE_FORMAT", cfg.LogFileFormat},
+		{"LOG_FILE_MAX_SIZE_MB", strconv.FormatInt(cfg.LogFileMaxSize>>20, 10)},
+		{"LOG_FILE_MAX_AGE", cfg.LogFileMaxAge.String()},
+		{"LOG_FILE_COMPRESS", strconv.FormatBool(cfg.LogFileCompress)},
+		{"LOG_SYSLOG_ADDR", cfg.LogSyslogAddr},
+		{"LOG_SYSLOG_LEVEL", cfg.LogSyslogLevel.String()},
+		{"CSP_REPORT_ONLY", strconv.FormatBool(cfg.CSPReportOnly)},
+		{"METRICS_TOKEN", secret(cfg.MetricsToken)},
+		{"OTEL_TRACES_EXPORTER", cfg.TracesExporter},
+		{"OTEL_TRACES_FILE", cfg.TracesFile},
+	}
+}
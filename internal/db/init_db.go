@@ -1,21 +1,25 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-var db *sql.DB
+var (
+	db *sql.DB
+	// migrated is set once the migrations have been applied.
+	migrated bool
+)
 
 func getConnection(logger *slog.Logger) (*sql.DB, error) {
 	var err error
 
-	// Init SQLite3 database
-	db, err = sql.Open("sqlite3", "./app_data.db")
+	// Init SQLite3 database (see observe.go)
+	db, err = sql.Open(driverName, "./app_data.db")
 	if err != nil {
 		return nil, fmt.Errorf("🔥 failed to connect to the database: %s", err)
 	}
@@ -53,9 +57,272 @@ func createMigrations(db *sql.DB) error {
 		return err
 	}
 
+	// Two-factor authentication (TOTP)
+	if err = addColumn(db, "users", "totp_secret", "TEXT NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(
+		db, "users", "totp_enabled", "BOOLEAN DEFAULT(FALSE)",
+	); err != nil {
+		return err
+	}
+	if err = addColumn(
+		db, "users", "totp_last_step", "INTEGER DEFAULT(0)",
+	); err != nil {
+		return err
+	}
+
+	stmt = `CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash VARCHAR(64) NOT NULL,
+		used_at DATETIME NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// WebAuthn (passkeys)
+	stmt = `CREATE TABLE IF NOT EXISTS passkeys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		credential_id TEXT NOT NULL UNIQUE,
+		public_key BLOB NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT(0),
+		name VARCHAR(64) NOT NULL,
+		created_at DATETIME default CURRENT_TIMESTAMP,
+		last_used_at DATETIME NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	stmt = `CREATE TABLE IF NOT EXISTS webauthn_challenges (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NULL,
+		ceremony VARCHAR(16) NOT NULL,
+		challenge TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// OpenID Connect identities linked to local users
+	stmt = `CREATE TABLE IF NOT EXISTS user_identities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		issuer VARCHAR(255) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		created_at DATETIME default CURRENT_TIMESTAMP,
+		UNIQUE(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// Account settings
+	if err = addColumn(
+		db, "users", "timezone", "VARCHAR(64) NOT NULL DEFAULT('')",
+	); err != nil {
+		return err
+	}
+
+	stmt = `CREATE TABLE IF NOT EXISTS email_changes (
+		token_hash VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		new_email VARCHAR(255) NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// Login history and scheduled deletion of the accounts
+	stmt = `CREATE TABLE IF NOT EXISTS login_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		method VARCHAR(16) NOT NULL,
+		ip VARCHAR(64) NOT NULL,
+		user_agent VARCHAR(255) NOT NULL,
+		success BOOLEAN NOT NULL,
+		created_at DATETIME default CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	if err = addColumn(
+		db, "users", "delete_after", "INTEGER NOT NULL DEFAULT(0)",
+	); err != nil {
+		return err
+	}
+
+	// Roles and account state managed by the administrators
+	if err = addColumn(
+		db, "users", "role", "VARCHAR(16) NOT NULL DEFAULT('user')",
+	); err != nil {
+		return err
+	}
+	if err = addColumn(
+		db, "users", "disabled", "BOOLEAN NOT NULL DEFAULT(FALSE)",
+	); err != nil {
+		return err
+	}
+	if err = addColumn(
+		db, "users", "must_reset_password", "BOOLEAN NOT NULL DEFAULT(FALSE)",
+	); err != nil {
+		return err
+	}
+
+	// The audit trail outlives the users (no foreign keys), without
+	// the emails of the deleted ones (see UserService.deleteUser)
+	stmt = `CREATE TABLE IF NOT EXISTS admin_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		admin_id INTEGER NOT NULL,
+		admin_email VARCHAR(255) NOT NULL,
+		action VARCHAR(32) NOT NULL,
+		target_id INTEGER NOT NULL,
+		target_email VARCHAR(255) NOT NULL,
+		details VARCHAR(255) NOT NULL DEFAULT(''),
+		ip VARCHAR(64) NOT NULL,
+		created_at DATETIME default CURRENT_TIMESTAMP
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// Failed logins, by account (email) and by IP.
+	// The times are stored as Unix timestamps.
+	stmt = `CREATE TABLE IF NOT EXISTS login_throttle (
+		key VARCHAR(300) PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT(0),
+		last_failure INTEGER NOT NULL DEFAULT(0),
+		locked_until INTEGER NOT NULL DEFAULT(0)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	stmt = `CREATE TABLE IF NOT EXISTS unlock_tokens (
+		token_hash VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// Lists and tags of the tasks. A task is in one list at most (none
+	// by default), and the lists are created as the tasks are moved
+	// to them. The tags of a task go away with it (see the trigger).
+	stmt = `CREATE TABLE IF NOT EXISTS lists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_by INTEGER NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		UNIQUE(created_by, name),
+		FOREIGN KEY(created_by) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	if err = addColumn(
+		db, "todos", "list_id", "INTEGER NULL REFERENCES lists(id)",
+	); err != nil {
+		return err
+	}
+
+	stmt = `CREATE TABLE IF NOT EXISTS todo_tags (
+		todo_id INTEGER NOT NULL,
+		tag VARCHAR(32) NOT NULL,
+		PRIMARY KEY(todo_id, tag),
+		FOREIGN KEY(todo_id) REFERENCES todos(id)
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	stmt = `CREATE TRIGGER IF NOT EXISTS todo_tags_delete
+		AFTER DELETE ON todos
+		BEGIN
+			DELETE FROM todo_tags WHERE todo_id = OLD.id;
+		END;`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// State of the rate limiter when it is shared by several
+	// processes: the theoretical arrival time of each key,
+	// in nanoseconds since the Unix epoch.
+	stmt = `CREATE TABLE IF NOT EXISTS rate_limits (
+		key VARCHAR(300) PRIMARY KEY,
+		tat INTEGER NOT NULL
+	);`
+
+	_, err = db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// addColumn adds a column to an existing table if it is not
+// already there, since SQLite does not support
+// `ALTER TABLE ... ADD COLUMN IF NOT EXISTS`.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`,
+		table, column,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition),
+	)
+
+	return err
+}
+
 func GetDB(l *slog.Logger) *sql.DB {
 	var err error
 
@@ -69,9 +336,30 @@ func GetDB(l *slog.Logger) *sql.DB {
 				"🔥 could not create migrations in database: %s", err.Error(),
 			)
 		}
+		migrated = true
 
 		return db
 	}
 
 	return db
 }
+
+// Ready checks, for the readiness probe, that the database has
+// been opened with its migrations applied and still answers.
+func Ready(ctx context.Context) error {
+	if db == nil || !migrated {
+		return errors.New("the migrations have not been applied")
+	}
+
+	return db.PingContext(ctx)
+}
+
+// Close closes the database (on shutdown), once
+// the requests and the workers that use it are done.
+func Close() error {
+	if db == nil {
+		return nil
+	}
+
+	return db.Close()
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/metrics"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/tracing"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// driverName is the SQLite3 driver wrapped to observe the statements.
+const driverName = "sqlite3-observed"
+
+func init() {
+	sql.Register(driverName, &observedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// QueryObserver is called after each SQL statement executed by the
+// services, with the context of the call (that of the request, if
+// any) and the time at which it started, e.g. to measure it.
+type QueryObserver func(ctx context.Context, query string, start time.Time, err error)
+
+var observers []QueryObserver
+
+// Observe adds an observer of the statements. It
+// must be called before the database is opened (GetDB).
+func Observe(o QueryObserver) {
+	observers = append(observers, o)
+}
+
+func observe(ctx context.Context, query string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		// Not executed: database/sql tries another way
+		return
+	}
+
+	for _, o := range observers {
+		o(ctx, query, start, err)
+	}
+}
+
+// Instrument adds to the registry the duration of the statements
+// and their errors (by operation) and the statistics of the
+// connection pool. It must be called before GetDB.
+func Instrument(reg *metrics.Registry) {
+	duration := reg.NewHistogram("db_query_duration_seconds",
+		"Duration of the SQL statements, by operation.",
+		metrics.DefBuckets, "operation")
+	errs := reg.NewCounter("db_query_errors_total",
+		"SQL statements that failed, by operation.", "operation")
+
+	Observe(func(ctx context.Context, query string, start time.Time, err error) {
+		op := Operation(query)
+		duration.Observe(time.Since(start).Seconds(), op)
+		if err != nil {
+			errs.Inc(op)
+		}
+	})
+
+	reg.OnScrape(func(ctx context.Context, w *metrics.Writer) {
+		if db != nil {
+			metrics.SQLStats(db)(ctx, w)
+		}
+	})
+}
+
+// Trace records each statement as a span, child of that of its
+// context (e.g. of the service call of a request). The statements
+// without a span to hang from (e.g. of the migrations or the
+// workers) are left out, so as not to flood the traces with one
+// trace per statement. It must be called before GetDB.
+func Trace() {
+	Observe(func(ctx context.Context, query string, start time.Time, err error) {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+
+		op := Operation(query)
+		_, span := tracing.Tracer().Start(ctx, "sqlite "+op,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithTimestamp(start),
+			trace.WithAttributes(
+				semconv.DBSystemSqlite,
+				semconv.DBOperationName(op),
+				semconv.DBQueryText(query),
+			),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	})
+}
+
+// Operation returns the kind of the statement (its first keyword in
+// lowercase, e.g. "select"), to group the statements without the
+// cardinality of the queries themselves.
+func Operation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+
+	switch op := strings.ToLower(fields[0]); op {
+	case "select", "insert", "update", "delete", "create", "alter", "pragma":
+		return op
+	}
+
+	return "other"
+}
+
+// The wrappers of the driver, the connection and the prepared
+// statement time the executions and queries (the iteration of
+// the rows is left out) and delegate everything to SQLite3.
+
+type observedDriver struct {
+	*sqlite3.SQLiteDriver
+}
+
+func (d *observedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &observedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type observedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *observedConn) ExecContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	observe(ctx, query, start, err)
+
+	return res, err
+}
+
+func (c *observedConn) QueryContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	observe(ctx, query, start, err)
+
+	return rows, err
+}
+
+func (c *observedConn) Prepare(query string) (driver.Stmt, error) {
+
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *observedConn) PrepareContext(
+	ctx context.Context, query string,
+) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &observedStmt{stmt.(*sqlite3.SQLiteStmt), query}, nil
+}
+
+type observedStmt struct {
+	*sqlite3.SQLiteStmt
+	query string
+}
+
+func (s *observedStmt) ExecContext(
+	ctx context.Context, args []driver.NamedValue,
+) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.SQLiteStmt.ExecContext(ctx, args)
+	observe(ctx, s.query, start, err)
+
+	return res, err
+}
+
+func (s *observedStmt) QueryContext(
+	ctx context.Context, args []driver.NamedValue,
+) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.SQLiteStmt.QueryContext(ctx, args)
+	observe(ctx, s.query, start, err)
+
+	return rows, err
+}
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/upper"
+)
+
+// Validity of the links sent to verify a new email.
+const emailChangeLifetime = 24 * time.Hour
+
+// Time during which a deleted account can still be
+// recovered (by logging in) before it is purged.
+const deletionGracePeriod = 7 * 24 * time.Hour
+
+// userTimezone returns the timezone in which the dates are shown
+// to the user: the preferred one if they have chosen it,
+// otherwise the one detected by the browser.
+func userTimezone(user services.User, detected string) string {
+	if user.Timezone != "" {
+		return user.Timezone
+	}
+
+	if _, err := time.LoadLocation(detected); err != nil {
+		return ""
+	}
+
+	return detected
+}
+
+// detectedTimezone returns the timezone detected by the browser, sent
+// in the `tz` field of the forms (see assets/js/timezone.js).
+func detectedTimezone(r *http.Request) string {
+	return r.PostFormValue("tz")
+}
+
+func (ah *AuthHandle) accountHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	errMsg, succMsg := GetMessages(w, r)
+
+	user, err := ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Account Settings",
+		"fromProtected": true,
+		"tab":           "account",
+		"username":      upper.Cap(user.Username),
+		"user":          user,
+		"hasPassword":   user.Password != "",
+		"minLength":     ah.passwordPolicy.MinLength,
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "settings_account.tmpl", data)
+}
+
+func (ah *AuthHandle) usernamePostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	username := strings.TrimSpace(r.FormValue("username"))
+
+	if n := utf8.RuneCountInString(username); n < 4 || n > 64 {
+		fm := []byte("The username must be between 4 and 64 characters")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err == nil {
+		err = ah.userService.UpdateUsername(r.Context(), user.ID, username)
+	}
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	// The username travels in the JWT, which is issued again
+	user.Username = username
+	tzone := userTimezone(user, detectedTimezone(r))
+	if err := setAuthCookie(w, user, tzone); err != nil {
+		message := fmt.Sprintf("error 500: could not get the JWT: %s", err)
+		return serverError(w, message)
+	}
+
+	fm := []byte("Username successfully updated!!")
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+
+	return nil
+}
+
+// emailPostHandle starts a change of email: it does not take effect
+// until the user opens the link sent to the new address. The current
+// address is notified, in case someone else has access to the account.
+// It requires the password, except for the users without one (single
+// sign-on only), who have nothing else to confirm it with.
+func (ah *AuthHandle) emailPostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	newEmail := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+
+	if addr, err := mail.ParseAddress(newEmail); err != nil ||
+		addr.Address != newEmail {
+		fm := []byte("Please enter a valid email")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	user, ok, err := ah.confirmPassword(r)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if !ok && user.Password != "" {
+		fm := []byte("Incorrect password")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	if newEmail == strings.ToLower(user.Email) {
+		fm := []byte("That is already your email")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	_, err = ah.userService.CheckEmail(r.Context(), newEmail)
+	if err == nil {
+		fm := []byte("the email is already in use")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not generate token: %s", err)
+		return serverError(w, message)
+	}
+
+	err = ah.userService.CreateEmailChange(
+		r.Context(), user.ID, newEmail, hashToken(token), time.Now().Add(emailChangeLifetime),
+	)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	link := ah.cfg.BaseURL.JoinPath("/email/verify")
+	link.RawQuery = "token=" + token
+
+	ah.sendEmail(r.Context(), newEmail, "Confirm your new email", fmt.Sprintf(`Hello %s,
+
+Please confirm that you want to use this address for your
+%s account by opening this link (valid for 24 hours):
+
+%s
+
+If you did not request it, you can ignore this email.
+`, user.Username, ah.cfg.AppName, link))
+
+	ah.sendEmail(r.Context(), user.Email, "Your email is about to change", fmt.Sprintf(`Hello %s,
+
+A change of the email of your %s account to %s has been
+requested. It will take effect once the new address is confirmed.
+
+If it was not you, change your password right away.
+`, user.Username, ah.cfg.AppName, newEmail))
+
+	fm := []byte(fmt.Sprintf(
+		"We have sent a confirmation link to %s", newEmail,
+	))
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+
+	return nil
+}
+
+// verifyEmailHandle applies the change of email with the token
+// sent to the new address. It does not require a session, since
+// the link may be opened in another browser.
+func (ah *AuthHandle) verifyEmailHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	redirectTo := "/login"
+	if requestFromProtected(r.Context()) {
+		redirectTo = "/settings/account"
+	}
+
+	user, err := ah.userService.ConfirmEmailChange(
+		r.Context(), hashToken(r.URL.Query().Get("token")),
+	)
+	if err != nil {
+		fm := []byte("The confirmation link is invalid or has expired")
+		switch {
+		case errors.Is(err, sql.ErrNoRows),
+			errors.Is(err, services.ErrEmailChangeExpired):
+		case strings.Contains(err.Error(), "UNIQUE constraint failed"):
+			fm = []byte("the email is already in use")
+		default:
+			message := "error 500: database temporarily out of service"
+			return serverError(w, message)
+		}
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return nil
+	}
+
+	fm := []byte(fmt.Sprintf("Your email is now %s", user.Email))
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+
+	return nil
+}
+
+// passwordPostHandle changes the password, which requires the
+// current one. Users provisioned by single sign-on have none,
+// so they can set it directly.
+func (ah *AuthHandle) passwordPostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	newPassword := strings.Trim(r.FormValue("new_password"), " ")
+	confirmation := strings.Trim(r.FormValue("confirm_password"), " ")
+
+	user, ok, err := ah.confirmPassword(r)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if !ok && user.Password != "" {
+		fm := []byte("Incorrect password")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	msg, err := ah.checkPassword(newPassword, user.Email, user.Username)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not check the password: %s", err)
+		return serverError(w, message)
+	}
+	if msg == "" && newPassword != confirmation {
+		msg = "The passwords do not match"
+	}
+	if msg != "" {
+		SetFlash(w, "error", []byte(msg))
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := ah.userService.UpdatePassword(r.Context(), user.ID, newPassword); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	// A password reset forced by an administrator is now done:
+	// the JWT, which carries the flag, is issued again
+	if user.MustResetPassword {
+		user.MustResetPassword = false
+		tzone := userTimezone(user, detectedTimezone(r))
+		if err := setAuthCookie(w, user, tzone); err != nil {
+			message := fmt.Sprintf("error 500: could not get the JWT: %s", err)
+			return serverError(w, message)
+		}
+	}
+
+	ah.sendEmail(r.Context(), user.Email, "Your password has been changed", fmt.Sprintf(`Hello %s,
+
+The password of your %s account has just been changed.
+
+If it was not you, contact us right away.
+`, user.Username, ah.cfg.AppName))
+
+	fm := []byte("Password successfully updated!!")
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+
+	return nil
+}
+
+// timezonePostHandle stores the preferred timezone, used
+// to show the dates instead of the one of the browser.
+func (ah *AuthHandle) timezonePostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	tz := strings.TrimSpace(r.FormValue("timezone"))
+
+	// time.LoadLocation also accepts "" and "Local", which
+	// depend on the server and are not valid choices
+	if _, err := time.LoadLocation(tz); tz != "" &&
+		(err != nil || tz == "Local") {
+		fm := []byte(fmt.Sprintf("Unknown timezone %q", tz))
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err == nil {
+		err = ah.userService.SetTimezone(r.Context(), user.ID, tz)
+	}
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	// The timezone travels in the JWT, which is issued again
+	user.Timezone = tz
+	tzone := userTimezone(user, detectedTimezone(r))
+	if err := setAuthCookie(w, user, tzone); err != nil {
+		message := fmt.Sprintf("error 500: could not get the JWT: %s", err)
+		return serverError(w, message)
+	}
+
+	fm := []byte("Timezone successfully updated!!")
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+
+	return nil
+}
+
+// exportHandle downloads all the personal data
+// of the user as a JSON file ("download my data").
+func (ah *AuthHandle) exportHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	export, err := ah.userService.ExportUserData(r.Context(), requestUserData(r.Context()).ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	filename := fmt.Sprintf("todo-list-data-%s.json", time.Now().Format("2006-01-02"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(export)
+}
+
+// deleteAccountHandle schedules the deletion of the account, which
+// requires the password (or the email, for users without one). The
+// user is logged out and can cancel it by logging in again during
+// the grace period; after that, everything is purged.
+func (ah *AuthHandle) deleteAccountHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	user, ok, err := ah.confirmPassword(r)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if user.Password == "" {
+		ok = strings.EqualFold(strings.TrimSpace(r.FormValue("email")), user.Email)
+	}
+	if !ok {
+		fm := []byte("Incorrect password")
+		if user.Password == "" {
+			fm = []byte("The email does not match")
+		}
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+		return nil
+	}
+
+	deleteAfter := time.Now().Add(deletionGracePeriod)
+	if err := ah.userService.ScheduleDeletion(r.Context(), user.ID, deleteAfter); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	when := services.ConvertDateTime(requestUserData(r.Context()).Tzone, deleteAfter)
+
+	ah.sendEmail(r.Context(), user.Email, "Your account will be deleted", fmt.Sprintf(`Hello %s,
+
+As requested, your %s account and all its data will be
+permanently deleted on %s.
+
+If you change your mind, just log in before then.
+`, user.Username, ah.cfg.AppName, when))
+
+	clearCookie(w)
+
+	fm := []byte(fmt.Sprintf(
+		"Your account will be deleted on %s. Log in before then to cancel it", when,
+	))
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// sendEmail sends the email in the background, logging the error
+// (with the request that sent it) if it could not be sent.
+func (ah *AuthHandle) sendEmail(ctx context.Context, to, subject, body string) {
+	ah.emails.Add(1)
+	go func() {
+		defer ah.emails.Done()
+		if err := ah.mailer.Send(to, subject, body); err != nil {
+			ah.logger.ErrorContext(ctx, "🔴 Mailer Error: could not send the email",
+				"to", to,
+				"subject", subject,
+				"error", err.Error(),
+			)
+		}
+	}()
+}
+
+// WaitEmails waits (on shutdown) until the emails being sent in
+// the background have been sent, or until the context is done.
+func (ah *AuthHandle) WaitEmails(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		ah.emails.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
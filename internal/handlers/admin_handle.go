@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/config"
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/upper"
+)
+
+// usersPerPage is the size of the pages of the user search.
+const usersPerPage = 20
+
+type AdminService interface {
+	SearchUsers(ctx context.Context, query string, limit, offset int) ([]services.User, int, error)
+	SetDisabled(ctx context.Context, e services.AuditEntry, disabled bool) error
+	ForcePasswordReset(ctx context.Context, e services.AuditEntry) error
+	SetRole(ctx context.Context, e services.AuditEntry, role string) error
+	GetAuditLog(ctx context.Context, limit, offset int) ([]services.AuditEntry, error)
+	GetStats(ctx context.Context) (services.Stats, error)
+}
+
+func NewAdminHandle(
+	as AdminService, us AuthService, cfg *config.Config,
+) *AdminHandle {
+
+	return &AdminHandle{
+		adminService: as,
+		userService:  us,
+		cfg:          cfg,
+	}
+}
+
+// AdminHandle serves the `/admin` area, restricted to the
+// administrators by the `admin` access level of its routes
+// (see RouteTable), which AuthMiddleware enforces.
+type AdminHandle struct {
+	adminService AdminService
+	userService  AuthService
+	cfg          *config.Config
+}
+
+func (adh *AdminHandle) dashboardHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	errMsg, succMsg := GetMessages(w, r)
+
+	stats, err := adh.adminService.GetStats(r.Context())
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Admin",
+		"fromProtected": true,
+		"tab":           "dashboard",
+		"username":      upper.Cap(requestUserData(r.Context()).Username),
+		"stats":         stats,
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "admin_dashboard.tmpl", data)
+}
+
+// usersHandle lists the users, optionally filtered by
+// the search query `q` (email or username), by pages.
+func (adh *AdminHandle) usersHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	errMsg, succMsg := GetMessages(w, r)
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, total, err := adh.adminService.SearchUsers(
+		r.Context(), query, usersPerPage, (page-1)*usersPerPage,
+	)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Admin Users",
+		"fromProtected": true,
+		"tab":           "users",
+		"username":      upper.Cap(requestUserData(r.Context()).Username),
+		"selfID":        requestUserData(r.Context()).ID,
+		"users":         users,
+		"total":         total,
+		"query":         query,
+		"page":          page,
+		"prevPage":      page - 1,
+		"nextPage":      page + 1,
+		"hasNext":       page*usersPerPage < total,
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "admin_users.tmpl", data)
+}
+
+func (adh *AdminHandle) auditHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	errMsg, succMsg := GetMessages(w, r)
+
+	entries, err := adh.adminService.GetAuditLog(r.Context(), 100, 0)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Admin Audit",
+		"fromProtected": true,
+		"tab":           "audit",
+		"username":      upper.Cap(requestUserData(r.Context()).Username),
+		"entries":       entries,
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "admin_audit.tmpl", data)
+}
+
+// debugHandle shows the diagnostics of the running process: how it
+// was built, its runtime and its configuration (without the secrets),
+// with the links to the profiles (pprof) and the variables (expvar).
+func (adh *AdminHandle) debugHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	build := []config.Setting{
+		{Name: "Go version", Value: runtime.Version()},
+		{Name: "Platform", Value: runtime.GOOS + "/" + runtime.GOARCH},
+		{Name: "CPUs", Value: strconv.Itoa(runtime.NumCPU())},
+		{Name: "GOMAXPROCS", Value: strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{Name: "Goroutines", Value: strconv.Itoa(runtime.NumGoroutine())},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		build = append(build,
+			config.Setting{Name: "Module", Value: bi.Main.Path},
+			config.Setting{Name: "Version", Value: bi.Main.Version},
+		)
+		// The revision of the checkout it was built from (vcs.revision,
+		// vcs.time and vcs.modified) and the build flags
+		for _, s := range bi.Settings {
+			if strings.HasPrefix(s.Key, "vcs.") || strings.HasPrefix(s.Key, "-") {
+				build = append(build, config.Setting{Name: s.Key, Value: s.Value})
+			}
+		}
+	}
+
+	data := map[string]any{
+		"title":         "| Admin Debug",
+		"fromProtected": true,
+		"tab":           "debug",
+		"username":      upper.Cap(requestUserData(r.Context()).Username),
+		"baseURL":       adh.cfg.BaseURL.String(),
+		"build":         build,
+		"settings":      adh.cfg.Summary(),
+	}
+	return render(w, r, "admin_debug.tmpl", data)
+}
+
+// profileHandler serves a profile that is recorded for the `seconds`
+// of the query (pprof.Profile and pprof.Trace, which last for
+// defaultSeconds otherwise), extending the write deadline of the
+// response by that time so that the WriteTimeout of the server does
+// not cut it off. pprof is not given the server then, as some
+// versions reject the durations longer than its WriteTimeout.
+func profileHandler(profile http.HandlerFunc, defaultSeconds float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sec, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+		if err != nil || sec <= 0 {
+			sec = defaultSeconds
+		}
+
+		srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+		if ok && srv.WriteTimeout > 0 {
+			deadline := time.Now().Add(
+				srv.WriteTimeout + time.Duration(sec*float64(time.Second)),
+			)
+			if err := http.NewResponseController(w).SetWriteDeadline(deadline); err == nil {
+				ctx := context.WithValue(r.Context(), http.ServerContextKey, nil)
+				r = r.WithContext(ctx)
+			}
+		}
+
+		profile(w, r)
+	})
+}
+
+func (adh *AdminHandle) disableUserHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	return adh.userAction(w, r, func(e services.AuditEntry) error {
+		return adh.adminService.SetDisabled(r.Context(), e, true)
+	}, "The account of %s has been disabled")
+}
+
+func (adh *AdminHandle) enableUserHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	return adh.userAction(w, r, func(e services.AuditEntry) error {
+		return adh.adminService.SetDisabled(r.Context(), e, false)
+	}, "The account of %s has been enabled")
+}
+
+func (adh *AdminHandle) resetPasswordHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	return adh.userAction(w, r, func(e services.AuditEntry) error {
+		return adh.adminService.ForcePasswordReset(r.Context(), e)
+	}, "%s will have to change their password at the next login")
+}
+
+func (adh *AdminHandle) roleHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	role := r.FormValue("role")
+	if role != services.RoleUser && role != services.RoleAdmin {
+		return badRequest(w, fmt.Sprintf("unknown role %q", role))
+	}
+
+	return adh.userAction(w, r, func(e services.AuditEntry) error {
+		return adh.adminService.SetRole(r.Context(), e, role)
+	}, "The role of %s is now "+role)
+}
+
+// userAction applies an action of the administrator to the user
+// of the `{id}` path segment and redirects back to the list.
+// The administrators cannot act on themselves, so that they
+// cannot lock themselves out by mistake.
+func (adh *AdminHandle) userAction(
+	w http.ResponseWriter, r *http.Request,
+	action func(e services.AuditEntry) error, success string,
+) error {
+	admin := requestUserData(r.Context())
+
+	backTo := "/admin/users"
+	if q := r.FormValue("q"); q != "" {
+		backTo += "?" + url.Values{"q": {q}}.Encode()
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return badRequest(w, "invalid user id")
+	}
+
+	if id == admin.ID {
+		fm := []byte("You cannot change your own account from here")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, backTo, http.StatusSeeOther)
+		return nil
+	}
+
+	adminUser, err := adh.userService.GetUserById(r.Context(), admin.ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	target, err := adh.userService.GetUserById(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundHandle(w, r)
+	}
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	err = action(services.AuditEntry{
+		AdminID:     adminUser.ID,
+		AdminEmail:  adminUser.Email,
+		TargetID:    target.ID,
+		TargetEmail: target.Email,
+		IP:          clientIP(r, adh.cfg.TrustProxy),
+	})
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not apply the action: %s", err)
+		return serverError(w, message)
+	}
+
+	SetFlash(w, "success", []byte(fmt.Sprintf(success, target.Email)))
+
+	http.Redirect(w, r, backTo, http.StatusSeeOther)
+
+	return nil
+}
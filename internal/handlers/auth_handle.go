@@ -1,27 +1,91 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/emarifer/go-frameworkless-htmx/internal/config"
+	"github.com/emarifer/go-frameworkless-htmx/internal/mailer"
 	"github.com/emarifer/go-frameworkless-htmx/internal/services"
 	"github.com/emarifer/go-frameworkless-htmx/internal/utils/jwt"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/oidc"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/passwd"
 )
 
 type AuthService interface {
-	CreateUser(u services.User) error
-	CheckEmail(email string) (services.User, error)
+	CreateUser(ctx context.Context, u services.User) error
+	CheckEmail(ctx context.Context, email string) (services.User, error)
+	VerifyPassword(ctx context.Context, u services.User, password string) (bool, error)
+	GetUserById(ctx context.Context, id int) (services.User, error)
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (services.User, error)
+	LinkIdentity(ctx context.Context, id int, i services.Identity) error
+	CreateSSOUser(ctx context.Context, u services.User, i services.Identity) (services.User, error)
+	SetTOTPSecret(ctx context.Context, id int, secret string) error
+	EnableTOTP(ctx context.Context, id int, step int64, codeHashes []string) error
+	DisableTOTP(ctx context.Context, id int) error
+	SetTOTPLastStep(ctx context.Context, id int, step int64) error
+	ReplaceRecoveryCodes(ctx context.Context, id int, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, id int, codeHash string) error
+	CountRecoveryCodes(ctx context.Context, id int) (int, error)
+	UpdateUsername(ctx context.Context, id int, username string) error
+	UpdatePassword(ctx context.Context, id int, password string) error
+	SetTimezone(ctx context.Context, id int, tz string) error
+	CreateEmailChange(ctx context.Context, id int, newEmail, tokenHash string, expiresAt time.Time) error
+	ConfirmEmailChange(ctx context.Context, tokenHash string) (services.User, error)
+	AddLoginEvent(ctx context.Context, e services.LoginEvent) error
+	ExportUserData(ctx context.Context, id int) (services.UserExport, error)
+	ScheduleDeletion(ctx context.Context, id int, deleteAfter time.Time) error
+	CancelDeletion(ctx context.Context, id int) (bool, error)
 }
 
-func NewAuthHandle(us AuthService) *AuthHandle {
-	return &AuthHandle{userService: us}
+func NewAuthHandle(
+	us AuthService,
+	ts ThrottleService,
+	m mailer.Mailer,
+	cfg *config.Config,
+	l *slog.Logger,
+) *AuthHandle {
+	ah := &AuthHandle{
+		userService:     us,
+		throttleService: ts,
+		mailer:          m,
+		cfg:             cfg,
+		logger:          l,
+		passwordPolicy: &passwd.Policy{
+			MinLength:  cfg.PasswordMinLength,
+			MinEntropy: cfg.PasswordMinEntropy,
+			Breached:   passwd.NewBreachedList(cfg.PasswordBreachedDir),
+		},
+	}
+
+	if cfg.OIDCIssuer != "" {
+		ah.oidc = oidc.NewClient(
+			cfg.OIDCIssuer,
+			cfg.OIDCClientID,
+			cfg.OIDCClientSecret,
+			cfg.BaseURL.JoinPath("/oidc/callback").String(),
+		)
+	}
+
+	return ah
 }
 
 type AuthHandle struct {
-	userService AuthService
+	userService     AuthService
+	throttleService ThrottleService
+	mailer          mailer.Mailer
+	cfg             *config.Config
+	logger          *slog.Logger
+	oidc            *oidc.Client // nil if single sign-on is disabled
+	passwordPolicy  *passwd.Policy
+	emails          sync.WaitGroup // emails being sent in the background
 }
 
 func (ah *AuthHandle) homeHandle(w http.ResponseWriter, r *http.Request) error {
@@ -33,8 +97,7 @@ func (ah *AuthHandle) homeHandle(w http.ResponseWriter, r *http.Request) error {
 		"errMsg":        errMsg,
 		"succMsg":       succMsg,
 	}
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	return tmpl.ExecuteTemplate(w, "home.tmpl", data)
+	return render(w, r, "home.tmpl", data)
 }
 
 func (ah *AuthHandle) registerHandle(
@@ -47,15 +110,17 @@ func (ah *AuthHandle) registerHandle(
 		"fromProtected": requestFromProtected(r.Context()),
 		"errMsg":        errMsg,
 		"succMsg":       succMsg,
+		"ssoName":       ah.ssoName(),
+		"minLength":     ah.passwordPolicy.MinLength,
 	}
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	return tmpl.ExecuteTemplate(w, "register.tmpl", data)
+	return render(w, r, "register.tmpl", data)
 }
 
 func (ah *AuthHandle) registerPostHandle(
 	w http.ResponseWriter, r *http.Request,
 ) error {
-	email := strings.Trim(r.FormValue("email"), " ")
+	// Emails are stored in lowercase (see CheckEmail)
+	email := strings.ToLower(strings.Trim(r.FormValue("email"), " "))
 	password := strings.Trim(r.FormValue("password"), " ")
 	username := strings.Trim(r.FormValue("username"), " ")
 
@@ -64,19 +129,38 @@ func (ah *AuthHandle) registerPostHandle(
 		fm := []byte("Fields cannot be empty")
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/register", http.StatusSeeOther)
 
 		return nil
 	}
 
+	if msg, err := ah.checkPassword(password, email, username); msg != "" {
+		SetFlash(w, "error", []byte(msg))
+
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		message := fmt.Sprintf("error 500: could not check the password: %s", err)
+		return serverError(w, message)
+	}
+
 	user := services.User{
 		Email:    email,
 		Password: password,
 		Username: username,
 	}
 
-	if err := ah.userService.CreateUser(user); err != nil {
+	// The UNIQUE constraint does not catch an older
+	// account whose email differs only in case
+	if _, err := ah.userService.CheckEmail(r.Context(), email); err == nil {
+		fm := []byte("the email is already in use")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := ah.userService.CreateUser(r.Context(), user); err != nil {
 		if strings.Contains(err.Error(), "no such table") ||
 			strings.Contains(err.Error(), "database is locked") {
 			// "no such table" is the error that SQLite3 produces
@@ -84,9 +168,7 @@ func (ah *AuthHandle) registerPostHandle(
 			// used it as an example of the errors that can be caught.
 			// Here you can add the errors that you are interested
 			// in throwing as `500` codes.
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
 			w.WriteHeader(http.StatusInternalServerError)
 			return apiError{
 				status:  http.StatusInternalServerError,
@@ -97,7 +179,6 @@ func (ah *AuthHandle) registerPostHandle(
 			fm := []byte("the email is already in use")
 			SetFlash(w, "error", fm)
 
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 			http.Redirect(w, r, "/register", http.StatusSeeOther)
 			return nil
 		}
@@ -107,7 +188,6 @@ func (ah *AuthHandle) registerPostHandle(
 	fm := []byte("You have successfully registered!!")
 	SetFlash(w, "success", fm)
 
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 
 	return nil
@@ -123,9 +203,9 @@ func (ah *AuthHandle) loginHandle(
 		"fromProtected": requestFromProtected(r.Context()),
 		"errMsg":        errMsg,
 		"succMsg":       succMsg,
+		"ssoName":       ah.ssoName(),
 	}
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	return tmpl.ExecuteTemplate(w, "login.tmpl", data)
+	return render(w, r, "login.tmpl", data)
 }
 
 func (ah *AuthHandle) loginPostHandle(
@@ -133,69 +213,210 @@ func (ah *AuthHandle) loginPostHandle(
 ) error {
 	email := strings.Trim(r.FormValue("email"), " ")
 	password := strings.Trim(r.FormValue("password"), " ")
-	tzone := r.Header.Get("X-Timezone")
+	tzone := detectedTimezone(r)
 
 	// Simple server-side validation...
 	if email == "" || password == "" {
 		fm := []byte("Fields cannot be empty")
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 
 		return nil
 	}
 
+	// Attempts are slowed down (and eventually locked) after
+	// failed logins, by account and by IP
+	wait, err := ah.loginRetryAfter(r, email)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if wait > 0 {
+		fm := []byte(fmt.Sprintf(
+			"Too many failed attempts, please try again in %s",
+			humanizeDuration(wait),
+		))
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
 	// Authentication goes here
-	user, err := ah.userService.CheckEmail(email)
+	var found *services.User
+	user, err := ah.userService.CheckEmail(r.Context(), email)
+	switch {
+	case err == nil:
+		found = &user
+	case !errors.Is(err, sql.ErrNoRows):
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	// The password is always verified (against a dummy hash if the
+	// account does not exist or only uses single sign-on), so
+	// that the response time does not reveal the existing emails.
+	ok, err := ah.userService.VerifyPassword(r.Context(), user, password)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table") ||
-			strings.Contains(err.Error(), "database is locked") {
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if !ok || found == nil {
+		locked, err := ah.loginFailed(r, email, found, "password")
+		if err != nil {
 			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
-			w.WriteHeader(http.StatusInternalServerError)
-			return apiError{
-				status:  http.StatusInternalServerError,
-				message: message,
-			}
+			return serverError(w, message)
 		}
-		if strings.Contains(err.Error(), "no rows in result set") {
-			// In production you have to give the user a generic message
-			fm := []byte("there is no user with that email")
-			SetFlash(w, "error", fm)
 
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return nil
+		// A generic message, which does not reveal
+		// whether there is a user with that email
+		fm := []byte("Invalid email or password")
+		if locked {
+			fm = []byte(fmt.Sprintf(
+				"Too many failed attempts, please try again in %s",
+				humanizeDuration(accountPolicy.lockFor),
+			))
 		}
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
 	}
 
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(user.Password),
-		[]byte(password),
-	)
-	if err != nil {
-		// In production you have to give the user a generic message
-		fm := []byte("Incorrect password")
+	if err := ah.loginSucceeded(r, email); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	return ah.completeLogin(w, r, user, tzone, "password")
+}
+
+// completeLogin finishes the login of a user authenticated
+// with a first factor (password or identity provider): if they
+// have enabled two-factor authentication, the JWT is only issued
+// after the second step; otherwise it is issued right away.
+func (ah *AuthHandle) completeLogin(
+	w http.ResponseWriter, r *http.Request,
+	user services.User, tzone, method string,
+) error {
+	tzone = userTimezone(user, tzone)
+
+	if user.Disabled {
+		fm := []byte("This account has been disabled")
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return nil
 	}
 
-	// Create JWT
-	signedToken, err := jwt.CreateNewAuthToken(user.ID, user.Username, tzone)
-	if err != nil {
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-		message := fmt.Sprintf("error 500: could not get the JWT: %s", err)
-		w.Header().Add(HEADER_KEY_ERRMSG, message)
-		w.WriteHeader(http.StatusInternalServerError)
-		return apiError{
-			status:  http.StatusInternalServerError,
-			message: message,
+	if user.TOTPEnabled {
+		mfaToken, err := jwt.CreateNewMFAToken(user.ID, tzone)
+		if err != nil {
+			message := fmt.Sprintf("error 500: could not get the JWT: %s", err)
+			return serverError(w, message)
+		}
+
+		cookie := http.Cookie{
+			Name:     "mfa",
+			Value:    mfaToken,
+			Expires:  time.Now().Add(5 * time.Minute),
+			Path:     "/login",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
 		}
+		http.SetCookie(w, &cookie)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	restored, err := startSession(w, r, ah.userService, ah.cfg.TrustProxy,
+		user, tzone, method)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not start the session: %s", err)
+		return serverError(w, message)
+	}
+
+	SetFlash(w, "success", loginMessage(restored))
+
+	http.Redirect(w, r, "/todo", http.StatusSeeOther)
+
+	return nil
+}
+
+// startSession logs the user in (auth cookie) after all the
+// factors have been verified: the login is recorded in their
+// history and the scheduled deletion of the account, if any, is
+// cancelled. It returns true in that case.
+func startSession(
+	w http.ResponseWriter, r *http.Request, us AuthService, trustProxy bool,
+	user services.User, tzone, method string,
+) (bool, error) {
+	if err := setAuthCookie(w, user, tzone); err != nil {
+		return false, err
+	}
+
+	if err := recordLogin(r, us, trustProxy, user.ID, method, true); err != nil {
+		return false, err
+	}
+
+	return us.CancelDeletion(r.Context(), user.ID)
+}
+
+// recordLogin adds the attempt to the login history of the user.
+func recordLogin(
+	r *http.Request, us AuthService, trustProxy bool,
+	userID int, method string, success bool,
+) error {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	return us.AddLoginEvent(r.Context(), services.LoginEvent{
+		UserID:    userID,
+		Method:    method,
+		IP:        clientIP(r, trustProxy),
+		UserAgent: userAgent,
+		Success:   success,
+	})
+}
+
+func loginMessage(restored bool) []byte {
+	if restored {
+		return []byte("Welcome back! The deletion of your account has been cancelled")
+	}
+
+	return []byte("You have successfully logged in!!")
+}
+
+// checkPassword applies the password policy to a new password.
+// It returns the message for the user if it is rejected, or
+// an error if it could not be checked.
+func (ah *AuthHandle) checkPassword(
+	password, email, username string,
+) (string, error) {
+	err := ah.passwordPolicy.Check(password, email, username)
+
+	var v passwd.Violation
+	if errors.As(err, &v) {
+		return v.Error(), nil
+	}
+
+	return "", err
+}
+
+// setAuthCookie creates the JWT of the authenticated user
+// and sets it in the cookie read by the middlewares.
+func setAuthCookie(
+	w http.ResponseWriter, user services.User, tzone string,
+) error {
+	signedToken, err := jwt.CreateNewAuthToken(
+		user.ID, user.Username, tzone, user.Role, user.MustResetPassword,
+	)
+	if err != nil {
+		return err
 	}
 
 	// Create and set the cookie
@@ -205,15 +426,10 @@ func (ah *AuthHandle) loginPostHandle(
 		Expires:  time.Now().Add(1 * time.Hour),
 		Path:     "/",
 		HttpOnly: true, // meant only for the server
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, &cookie)
 
-	fm := []byte("You have successfully logged in!!")
-	SetFlash(w, "success", fm)
-
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	http.Redirect(w, r, "/todo", http.StatusSeeOther)
-
 	return nil
 }
 
@@ -225,7 +441,6 @@ func (ah *AuthHandle) logoutHandle(
 	fm := []byte("You have successfully logged out!!")
 	SetFlash(w, "success", fm)
 
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 	return nil
 }
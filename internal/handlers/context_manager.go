@@ -1,6 +1,10 @@
 package handlers
 
-import "context"
+import (
+	"context"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/reqctx"
+)
 
 type ctxKey int
 
@@ -8,12 +12,16 @@ const (
 	_ ctxKey = iota
 	ctxKeyRequestUserData
 	ctxKeyRequestFromProtected
+	ctxKeyRequestCSRFToken
+	ctxKeyRequestCSPNonce
 )
 
 type UserData struct {
-	ID       int
-	Username string
-	Tzone    string
+	ID        int
+	Username  string
+	Tzone     string
+	Role      string
+	MustReset bool
 }
 
 // withRequestUserData creates a new context that has UserData injected.
@@ -57,3 +65,51 @@ func requestFromProtected(ctx context.Context) bool {
 
 	return false
 }
+
+// withRequestCSRFToken creates a new context that
+// has the CSRF token of the client injected.
+func withRequestCSRFToken(ctx context.Context, token string) context.Context {
+
+	return context.WithValue(ctx, ctxKeyRequestCSRFToken, token)
+}
+
+// requestCSRFToken tries to retrieve the CSRF token of the given
+// context. If it does not exist, an empty string is returned.
+func requestCSRFToken(ctx context.Context) string {
+	if token, ok := ctx.Value(ctxKeyRequestCSRFToken).(string); ok {
+
+		return token
+	}
+
+	return ""
+}
+
+// withRequestCSPNonce creates a new context that has
+// the Content-Security-Policy nonce of the response injected.
+func withRequestCSPNonce(ctx context.Context, nonce string) context.Context {
+
+	return context.WithValue(ctx, ctxKeyRequestCSPNonce, nonce)
+}
+
+// requestCSPNonce tries to retrieve the CSP nonce of the given
+// context. If it does not exist, an empty string is returned.
+func requestCSPNonce(ctx context.Context) string {
+	if nonce, ok := ctx.Value(ctxKeyRequestCSPNonce).(string); ok {
+
+		return nonce
+	}
+
+	return ""
+}
+
+// requestMeta retrieves the metadata of the request of the given
+// context, injected by RequestIDMiddleware. If it does not exist,
+// a new one is returned, so that it can always be annotated.
+func requestMeta(ctx context.Context) *reqctx.Request {
+	if req := reqctx.From(ctx); req != nil {
+
+		return req
+	}
+
+	return &reqctx.Request{}
+}
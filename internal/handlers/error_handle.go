@@ -6,8 +6,12 @@ import (
 
 func notFoundHandle(w http.ResponseWriter, r *http.Request) error {
 	message := "error 404: not found"
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	w.Header().Add(HEADER_KEY_ERRMSG, message)
 	w.WriteHeader(http.StatusNotFound)
 	return apiError{status: http.StatusNotFound, message: message}
 }
+
+func csrfErrorHandle(w http.ResponseWriter, r *http.Request) error {
+	message := "error 400: invalid or missing CSRF token"
+	w.WriteHeader(http.StatusBadRequest)
+	return apiError{status: http.StatusBadRequest, message: message}
+}
@@ -9,7 +9,7 @@ import (
 // SetFlash sets a cookie with the flash message (base64 encoded)
 // which is made available for the next request.
 func SetFlash(w http.ResponseWriter, name string, value []byte) {
-	c := &http.Cookie{Name: name, Value: encode(value)}
+	c := &http.Cookie{Name: name, Value: encode(value), Path: "/"}
 
 	http.SetCookie(w, c)
 }
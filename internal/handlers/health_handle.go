@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readyTimeout bounds the checks of the readiness probe, so that a
+// stuck database makes the application unready rather than the probe
+// hang until the orchestrator gives up.
+const readyTimeout = 2 * time.Second
+
+func NewHealthHandle(checkDB func(context.Context) error) *HealthHandle {
+
+	return &HealthHandle{checkDB: checkDB}
+}
+
+// HealthHandle reports the state of the application to the
+// load balancer or orchestrator. It is alive (`/healthz`) as long as
+// the process serves requests, and ready (`/readyz`) once the server
+// is listening, while the database answers with its migrations
+// applied. It stops being ready when the shutdown begins, so
+// that no new traffic is sent while the requests are drained.
+type HealthHandle struct {
+	ready   atomic.Bool
+	checkDB func(context.Context) error
+}
+
+func (hh *HealthHandle) SetReady(ready bool) {
+	hh.ready.Store(ready)
+}
+
+func (hh *HealthHandle) healthHandle(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, err := w.Write([]byte("ok\n"))
+	return err
+}
+
+func (hh *HealthHandle) readyHandle(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !hh.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err := w.Write([]byte("draining\n"))
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	// The cause is logged, but not disclosed to the
+	// client, since the probe is public
+	if err := hh.checkDB(ctx); err != nil {
+		annotateError(r, "error 503: database not ready: "+err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err := w.Write([]byte("database unavailable\n"))
+		return err
+	}
+
+	_, err := w.Write([]byte("ok\n"))
+	return err
+}
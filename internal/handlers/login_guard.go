@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+)
+
+type ThrottleService interface {
+	GetThrottle(ctx context.Context, key string) (services.Throttle, error)
+	AddFailure(ctx context.Context, key string, window time.Duration) (services.Throttle, error)
+	LockThrottle(ctx context.Context, key string, until time.Time) error
+	ResetThrottle(ctx context.Context, key string) error
+	CreateUnlockToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	ConsumeUnlockToken(ctx context.Context, tokenHash string) (int, error)
+}
+
+// throttlePolicy defines how failed logins are slowed down: after
+// `free` failures, each new attempt must wait twice as long as the
+// previous one (up to `maxDelay`); after `lockAfter` failures the
+// key is locked for `lockFor`. The failures are forgotten when
+// there has been none for `window`.
+type throttlePolicy struct {
+	free      int
+	maxDelay  time.Duration
+	lockAfter int
+	lockFor   time.Duration
+	window    time.Duration
+}
+
+var (
+	// accountPolicy protects each account (whether it exists or not,
+	// so that both cases are indistinguishable).
+	accountPolicy = throttlePolicy{
+		free:      3,
+		maxDelay:  5 * time.Minute,
+		lockAfter: 10,
+		lockFor:   30 * time.Minute,
+		window:    24 * time.Hour,
+	}
+	// ipPolicy is more permissive, since an IP may be
+	// shared by many users (NAT, corporate proxies…).
+	ipPolicy = throttlePolicy{
+		free:      20,
+		maxDelay:  5 * time.Minute,
+		lockAfter: 100,
+		lockFor:   time.Hour,
+		window:    time.Hour,
+	}
+)
+
+// Validity of the links sent to unlock an account.
+const unlockTokenLifetime = 24 * time.Hour
+
+// retryAfter returns how long the next attempt must wait.
+func (p throttlePolicy) retryAfter(t services.Throttle, now time.Time) time.Duration {
+	if wait := t.LockedUntil.Sub(now); wait > 0 {
+		return wait
+	}
+
+	if t.Failures <= p.free || now.Sub(t.LastFailure) > p.window {
+		return 0
+	}
+
+	delay := p.maxDelay
+	if n := t.Failures - p.free - 1; n < 20 {
+		delay = min(time.Second<<n, p.maxDelay)
+	}
+
+	return t.LastFailure.Add(delay).Sub(now)
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP returns the IP address of the client. X-Forwarded-For
+// is only trusted (its last entry, added by our proxy) if the
+// application is configured to run behind a reverse proxy.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			ips := strings.Split(xff, ",")
+			return strings.TrimSpace(ips[len(ips)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// loginRetryAfter returns how long the client must wait before
+// trying to log in to the account again (0 if it can do it now).
+func (ah *AuthHandle) loginRetryAfter(
+	r *http.Request, email string,
+) (time.Duration, error) {
+	now := time.Now()
+
+	account, err := ah.throttleService.GetThrottle(r.Context(), accountKey(email))
+	if err != nil {
+		return 0, err
+	}
+
+	ip, err := ah.throttleService.GetThrottle(
+		r.Context(), ipKey(clientIP(r, ah.cfg.TrustProxy)),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(
+		accountPolicy.retryAfter(account, now),
+		ipPolicy.retryAfter(ip, now),
+	), nil
+}
+
+// loginFailed registers a failed login for the account and the IP,
+// locking them when the policy says so. `user` is nil if the
+// account does not exist, otherwise the attempt is added to their
+// login history. It returns true if the account got locked.
+func (ah *AuthHandle) loginFailed(
+	r *http.Request, email string, user *services.User, method string,
+) (bool, error) {
+	ip := clientIP(r, ah.cfg.TrustProxy)
+
+	if user != nil {
+		err := recordLogin(r, ah.userService, ah.cfg.TrustProxy, user.ID, method, false)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	t, err := ah.throttleService.AddFailure(r.Context(), ipKey(ip), ipPolicy.window)
+	if err != nil {
+		return false, err
+	}
+	if t.Failures >= ipPolicy.lockAfter {
+		until := time.Now().Add(ipPolicy.lockFor)
+		if err := ah.throttleService.LockThrottle(r.Context(), t.Key, until); err != nil {
+			return false, err
+		}
+		ah.logger.WarnContext(r.Context(), "🔒 Security Warning: IP locked out",
+			"ip", ip,
+			"failures", t.Failures,
+			"until", until.Format(time.RFC3339),
+		)
+	}
+
+	t, err = ah.throttleService.AddFailure(r.Context(), accountKey(email), accountPolicy.window)
+	if err != nil {
+		return false, err
+	}
+	if t.Failures < accountPolicy.lockAfter {
+		return false, nil
+	}
+
+	// t holds the lock set before this failure (zero if none)
+	now := time.Now()
+	newLockout := !t.LockedUntil.After(now)
+
+	until := now.Add(accountPolicy.lockFor)
+	if err := ah.throttleService.LockThrottle(r.Context(), t.Key, until); err != nil {
+		return false, err
+	}
+	ah.logger.WarnContext(r.Context(), "🔒 Security Warning: account locked out",
+		"email", email,
+		"exists", user != nil,
+		"ip", ip,
+		"failures", t.Failures,
+		"until", until.Format(time.RFC3339),
+	)
+
+	// The owner receives a single unlock link for each lockout, when
+	// the failure starts it (the previous one, if any, had expired)
+	if user != nil && newLockout {
+		if err := ah.sendUnlockEmail(r, *user); err != nil {
+			ah.logger.ErrorContext(r.Context(), "🔴 Mailer Error: could not send the unlock email",
+				"email", email,
+				"error", err.Error(),
+			)
+		}
+	}
+
+	return true, nil
+}
+
+// loginSucceeded forgets the failed logins of the account.
+// Those of the IP are kept, otherwise an attacker could
+// reset them by logging in to their own account.
+func (ah *AuthHandle) loginSucceeded(r *http.Request, email string) error {
+	return ah.throttleService.ResetThrottle(r.Context(), accountKey(email))
+}
+
+func (ah *AuthHandle) sendUnlockEmail(r *http.Request, user services.User) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	err = ah.throttleService.CreateUnlockToken(
+		r.Context(), user.ID, hashToken(token), time.Now().Add(unlockTokenLifetime),
+	)
+	if err != nil {
+		return err
+	}
+
+	link := ah.cfg.BaseURL.JoinPath("/login/unlock")
+	link.RawQuery = "token=" + token
+
+	body := fmt.Sprintf(`Hello %s,
+
+Your %s account has been temporarily locked after too many failed
+login attempts. If it was you, you can unlock it right away by
+opening this link (valid for 24 hours):
+
+%s
+
+If it was not you, someone may be trying to guess your password:
+consider changing it and enabling two-factor authentication.
+`, user.Username, ah.cfg.AppName, link)
+
+	// Sent in the background, so that
+	// the response time does not reveal it
+	ah.sendEmail(r.Context(), user.Email, "Your account has been locked", body)
+
+	return nil
+}
+
+// unlockHandle unlocks the account with the token sent by email.
+func (ah *AuthHandle) unlockHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	userID, err := ah.throttleService.ConsumeUnlockToken(
+		r.Context(), hashToken(r.URL.Query().Get("token")),
+	)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) &&
+			!errors.Is(err, services.ErrUnlockTokenExpired) {
+			message := "error 500: database temporarily out of service"
+			return serverError(w, message)
+		}
+
+		fm := []byte("The unlock link is invalid or has expired")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := ah.userService.GetUserById(r.Context(), userID)
+	if err == nil {
+		err = ah.throttleService.ResetThrottle(r.Context(), accountKey(user.Email))
+	}
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	ah.logger.InfoContext(r.Context(), "🔓 Security Info: account unlocked by email",
+		"email", user.Email,
+		"ip", clientIP(r, ah.cfg.TrustProxy),
+	)
+
+	fm := []byte("Your account has been unlocked, you can log in now")
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+
+	return nil
+}
+
+// newToken returns a random token (base64url)
+// for the links sent by email.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash stored in the database
+// instead of the token sent to the user.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// humanizeDuration formats the wait shown to the user.
+func humanizeDuration(d time.Duration) string {
+	if d < time.Minute {
+		secs := int((d + time.Second - 1) / time.Second)
+		if secs == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", secs)
+	}
+
+	mins := int((d + time.Minute - 1) / time.Minute)
+	if mins == 1 {
+		return "1 minute"
+	}
+
+	return fmt.Sprintf("%d minutes", mins)
+}
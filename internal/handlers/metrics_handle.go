@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/metrics"
+)
+
+func NewMetricsHandle(
+	reg *metrics.Registry, as AdminService, token string, l *slog.Logger,
+) *MetricsHandle {
+	mh := &MetricsHandle{
+		reg:   reg,
+		token: token,
+		requests: reg.NewCounter("http_requests_total",
+			"HTTP requests served, by route and status.", "route", "status"),
+		duration: reg.NewHistogram("http_request_duration_seconds",
+			"Duration of the HTTP requests, by route and status.",
+			metrics.DefBuckets, "route", "status"),
+	}
+
+	reg.OnScrape(func(_ context.Context, w *metrics.Writer) {
+		w.Gauge("http_requests_in_flight", "HTTP requests being served.",
+			float64(mh.inFlight.Load()))
+	})
+
+	// The business figures are those of the administration panel.
+	// They are only exposed to the scrapers that send the token,
+	// since every scrape queries the database for them.
+	if token == "" {
+		return mh
+	}
+	reg.OnScrape(func(ctx context.Context, w *metrics.Writer) {
+		s, err := as.GetStats(ctx)
+		if err != nil {
+			l.ErrorContext(ctx, "🔴 Metrics Error: could not get the statistics",
+				"error", err.Error(),
+			)
+			return
+		}
+
+		w.Gauge("app_users", "User accounts.", float64(s.Users))
+		w.Gauge("app_users_active", "Users who logged in during the last 30 days.",
+			float64(s.ActiveUsers))
+		w.Gauge("app_todos", "Tasks, by status.",
+			float64(s.Todos-s.CompletedTodos), "status", "pending")
+		w.Gauge("app_todos", "Tasks, by status.",
+			float64(s.CompletedTodos), "status", "completed")
+		w.Gauge("app_logins", "Logins during the last 24 hours, by result.",
+			float64(s.Logins), "result", "success")
+		w.Gauge("app_logins", "Logins during the last 24 hours, by result.",
+			float64(s.FailedLogins), "result", "failure")
+	})
+
+	return mh
+}
+
+// MetricsHandle serves the metrics of the application in the
+// Prometheus text format (`/metrics`) and measures the requests
+// with MetricsMiddleware. If a token is configured, the
+// scrapers must send it as a bearer token; otherwise the
+// business figures (read from the database) are left out.
+type MetricsHandle struct {
+	reg      *metrics.Registry
+	token    string
+	requests *metrics.Counter
+	duration *metrics.Histogram
+	inFlight atomic.Int64
+}
+
+// MetricsMiddleware counts and times the requests by the pattern
+// of their route (see RouteMiddleware), rather than by their path,
+// so that the number of series does not depend on the URLs
+// requested (e.g. the IDs or the scans of the bots).
+func (mh *MetricsHandle) MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mh.inFlight.Add(1)
+		defer mh.inFlight.Add(-1)
+
+		wrapped := &wrappedWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK, // default status
+		}
+
+		next.ServeHTTP(wrapped, r)
+
+		route := requestMeta(r.Context()).Pattern
+		if route == "" {
+			// Answered by the ServeMux itself (e.g. 405)
+			route = "unmatched"
+		}
+		status := strconv.Itoa(wrapped.statusCode)
+
+		mh.requests.Inc(route, status)
+		mh.duration.Observe(time.Since(start).Seconds(), route, status)
+	})
+}
+
+func (mh *MetricsHandle) metricsHandle(w http.ResponseWriter, r *http.Request) error {
+	if mh.token != "" {
+		sent := r.Header.Get("Authorization")
+		want := "Bearer " + mh.token
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(want)) != 1 {
+			annotateError(r, "error 401: invalid or missing metrics token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return nil
+		}
+	}
+
+	mh.reg.ServeHTTP(w, r)
+
+	return nil
+}
@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
 
 	jwtoken "github.com/emarifer/go-frameworkless-htmx/internal/utils/jwt"
-
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/reqctx"
 )
 
 // Middleware is a definition of what a middleware is,
@@ -33,134 +37,240 @@ func CreateStack(xs ...Middleware) Middleware {
 	}
 }
 
-// AuthMiddleware is a handler that verifies if the token
-// exists (in a cookie) and if it is invalid (due to the
-// signature not being verified or having expired).
-// If the jsonwebtoken is valid, it extracts the user data
-// and injects it with the context of the request
-// that will be passed to the next handler in the chain.
-func AuthMiddleware(next http.Handler) http.Handler {
+// requestIDHeader is the header with the ID of the request, both
+// received (e.g. from a proxy) and sent back to the client.
+const requestIDHeader = "X-Request-ID"
+
+// RequestIDMiddleware is the outermost middleware: it identifies the
+// request with the ID received from the client, if it is valid, or a
+// new one, and injects it into the context of the request (see
+// reqctx.Request) so that the logs of the request can be correlated.
+// The ID is sent back in the response, and shown on the error pages
+// so that the users can give it to the support.
+func RequestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Excludes everything other than this from the middleware action.
-		// It also refers to the routes corresponding to the assets.
-		p := r.URL.Path
-		if p != "/todo" && p != "/create" && p != "/edit" && p != "/logout" {
-			next.ServeHTTP(w, r)
-			return
+		id := r.Header.Get(requestIDHeader)
+		if !reqctx.ValidID(id) {
+			id = reqctx.NewID()
 		}
+		w.Header().Set(requestIDHeader, id)
 
-		// Get the JWT(cookie) by name
-		cookie, err := r.Cookie("jwt")
-		if err != nil {
-			fm := []byte("You are not authorized")
-			SetFlash(w, "error", fm)
+		ctx := reqctx.With(r.Context(), &reqctx.Request{ID: id})
 
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// auth is a structure to support the `AuthMiddleware` middleware
+// and be able to pass it (as a method receiver) the route table and
+// the user service without altering the middleware signature.
+type auth struct {
+	routes *RouteTable
+	us     AuthService
+}
+
+func NewAuth(routes *RouteTable, us AuthService) *auth {
+	return &auth{routes, us}
+}
 
+// AuthMiddleware authenticates the request and enforces the access
+// requirement declared by its route (see RouteTable). The token (in
+// a cookie) is verified once and the user is read again from the
+// database (see currentUser): if it is valid, the user data and the
+// fromProtected flag (true) are injected into the context of the
+// request that will be passed to the next handler in the chain.
+// The fromProtected flag is intended for conditional rendering
+// in the templates (e.g. the navbar).
+func (a *auth) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.currentUser(r)
+		if err != nil {
+			adapterHandle(func(w http.ResponseWriter, r *http.Request) error {
+				return serverError(w, "error 500: database temporarily out of service")
+			}).ServeHTTP(w, r)
 			return
 		}
 
-		claims := &jwtoken.AuthClaims{}
+		ctx := withRequestFromProtected(r.Context(), user != nil)
+		if user != nil {
+			ctx = withRequestUserData(ctx, *user)
+			requestMeta(ctx).UserID = user.ID
+		}
+		r = r.WithContext(ctx)
+
+		acc := a.routes.accessOf(r)
+		switch {
+		case acc.public:
+
+		case acc.guest:
+			// An authenticated user has nothing to do here
+			if user != nil {
+				http.Redirect(w, r, "/todo", http.StatusSeeOther)
+				return
+			}
+
+		// The routes that are not pages (e.g. the
+		// diagnostics) do not exist for them (404)
+		case acc.noRedirect && (user == nil || user.MustReset):
+			adapterHandle(notFoundHandle).ServeHTTP(w, r)
+			return
 
-		// Parse the cookie & check for errors
-		token, err := jwt.ParseWithClaims(
-			cookie.Value,
-			claims,
-			func(t *jwt.Token) (interface{}, error) {
-				return []byte(jwtoken.SecretKey), nil
-			},
-		)
-		if err != nil {
+		case user == nil:
 			fm := []byte("You are not authorized")
 			SetFlash(w, "error", fm)
 
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
-
 			return
-		}
 
-		// Parse the custom claims & check jwt is valid
-		_, ok := token.Claims.(*jwtoken.AuthClaims)
-		if !ok || !token.Valid {
-			fm := []byte("You are not authorized")
+		// A user whose password reset has been forced by an
+		// administrator can only change it (or log out).
+		case user.MustReset && !acc.resetAllowed:
+			fm := []byte("You must change your password before continuing")
 			SetFlash(w, "error", fm)
 
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+			return
 
+		// The route does not exist for anyone else (404)
+		case acc.role != "" && user.Role != acc.role:
+			adapterHandle(notFoundHandle).ServeHTTP(w, r)
 			return
 		}
 
-		// We inject the user data from the token into the context.
-		u := UserData{
-			ID:       claims.Id,
-			Username: claims.Username,
-			Tzone:    claims.Tzone,
-		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		ctx := withRequestUserData(r.Context(), u)
+// currentUser returns the data of the user authenticated by the
+// token, or nil. The user is read from the database rather than
+// trusted from the token, so that a disabled account, a revoked
+// role or a forced password reset take effect right away instead
+// of when the token expires, and the token of a deleted account
+// (or one whose deletion is pending) is no longer accepted. An
+// error means that the user could not be read (e.g. the database
+// is out of service).
+func (a *auth) currentUser(r *http.Request) (*UserData, error) {
+	cookie, err := r.Cookie("jwt")
+	if err != nil {
+		return nil, nil
+	}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	// Verify the token (signature, algorithm, issuer,
+	// audience and expiration) and get its claims
+	claims, err := jwtoken.ParseAuthToken(cookie.Value)
+	if err != nil {
+		return nil, nil
+	}
+
+	u, err := a.us.GetUserById(r.Context(), claims.Id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (u.Disabled || u.DeletionPending)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserData{
+		ID:        u.ID,
+		Username:  u.Username,
+		Tzone:     userTimezone(u, claims.Tzone),
+		Role:      u.Role,
+		MustReset: u.MustResetPassword,
+	}, nil
 }
 
-// FlagMiddleware is middleware for unprotected routes
-// that manages a boolean flag (fromProtected) for
-// conditional rendering on the pages corresponding to said routes.
-// Checks if the user is authenticated: if it is, inject
-// the fromProtected flag into the context to true, false otherwise.
-// Basically, this flag is intended to prevent
-// an authenticated user from logging in/registering again.
-func FlagMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the JWT(cookie) by name
-		cookie, err := r.Cookie("jwt")
-		if err != nil {
-			// If the user is not authenticated,
-			// we inject the value of `fromProtected` as false into the context.
-			ctx := withRequestFromProtected(r.Context(), false)
+// csrf is a structure to support the `CSRFMiddleware` middleware
+// and be able to pass it (as a method receiver) the route
+// table without altering the middleware signature.
+type csrf struct {
+	routes *RouteTable
+}
 
-			next.ServeHTTP(w, r.WithContext(ctx))
+func NewCSRF(routes *RouteTable) *csrf {
+	return &csrf{routes}
+}
 
-			return
+// CSRFMiddleware protects the state-changing requests against
+// cross-site request forgery (double-submit token): the client
+// receives a random token in a cookie, which the pages include
+// in their forms (`csrf_token` field) and in the htmx requests
+// (`X-CSRF-Token` header). Since another site can neither read
+// the cookie nor the page, it cannot send the same token back.
+// The token is injected into the context to render the templates.
+// The routes exempted in the route table are not checked.
+func (c *csrf) CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookieName); err == nil &&
+			len(cookie.Value) == csrfTokenLen {
+			token = cookie.Value
 		}
 
-		// Parse the cookie & check for errors
-		token, err := jwt.ParseWithClaims(
-			cookie.Value,
-			&jwtoken.AuthClaims{},
-			func(t *jwt.Token) (interface{}, error) {
-				return []byte(jwtoken.SecretKey), nil
-			},
-		)
-		if err != nil {
-			// If the user is not authenticated,
-			// we inject the value of `fromProtected` as false into the context.
-			ctx := withRequestFromProtected(r.Context(), false)
+		if token == "" {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				panic(fmt.Sprintf("something went wrong: %s\n", err))
+			}
+			token = base64.RawURLEncoding.EncodeToString(b)
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
 
-			next.ServeHTTP(w, r.WithContext(ctx))
+		ctx := withRequestCSRFToken(r.Context(), token)
 
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		// Parse the custom claims & check jwt is valid
-		_, ok := token.Claims.(*jwtoken.AuthClaims)
-		if !ok || !token.Valid {
-			// If the user is not authenticated,
-			// we inject the value of `fromProtected` as false into the context.
-			ctx := withRequestFromProtected(r.Context(), false)
-
+		if c.routes.csrfExempt(r) {
 			next.ServeHTTP(w, r.WithContext(ctx))
-
 			return
 		}
 
-		// We inject the value of `fromProtected` as true into the context.
-		ctx := withRequestFromProtected(r.Context(), true)
+		sent := r.Header.Get(csrfHeaderName)
+		if sent == "" {
+			sent = r.PostFormValue(csrfFieldName)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			adapterHandle(csrfErrorHandle).ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// bodyLimit is a structure to support the `BodyLimitMiddleware`
+// middleware and be able to pass it (as a method receiver)
+// the maximum size without altering the middleware signature.
+type bodyLimit struct {
+	maxBytes int64
+}
+
+func NewBodyLimit(maxBytes int64) *bodyLimit {
+	return &bodyLimit{maxBytes}
+}
+
+// BodyLimitMiddleware limits the size of the request bodies, so that
+// a client cannot exhaust the memory of the server (e.g. with a huge
+// form): reading beyond the limit fails, and the form is then empty.
+func (bl *bodyLimit) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, bl.maxBytes)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // logging is a structure to support the `LoggingMiddleware` middleware
 // and be able to pass it (as a method receiver)
 // the `*slog.Logger` pointer without altering
@@ -186,9 +296,17 @@ func (w *wrappedWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 }
 
+// Unwrap gives http.ResponseController access to the
+// underlying writer (e.g. to extend the write deadline).
+func (w *wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // LoggingMiddleware is the middleware that wraps the others
-// and collects all the info/error sent by the handlers
-// and traverses the middleware stack to log it.
+// and logs the request once it has been served, with the
+// info/error that the handlers and the inner middlewares
+// recorded in its metadata (see reqctx.Request). The quiet
+// routes (see RouteTable) are only logged if they fail.
 func (lg *logging) LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -200,13 +318,9 @@ func (lg *logging) LoggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		handler := ""
-		errMsg := ""
-		if h, ok := wrapped.Header()[HEADER_KEY_HANDLER]; ok {
-			handler = h[0]
-		}
-		if e, ok := wrapped.Header()[HEADER_KEY_ERRMSG]; ok {
-			errMsg = e[0]
+		req := requestMeta(r.Context())
+		if req.Quiet && req.Err == "" {
+			return
 		}
 
 		dataLog := []any{
@@ -216,21 +330,22 @@ func (lg *logging) LoggingMiddleware(next http.Handler) http.Handler {
 			),
 			"method", r.Method,
 			"path", r.URL.Path,
+			"route", req.Pattern,
 			"status", wrapped.statusCode, // ResponseWriter with statusCode
 			"user_agent", r.Header.Get("User-Agent"),
 		}
-		if errMsg != "" {
-			dataLog = append(dataLog, "error", errMsg, "handler", handler)
-			lg.l.Error("🔴 Handler Error", dataLog...)
+		if req.Err != "" {
+			dataLog = append(dataLog, "error", req.Err, "handler", req.Handler)
+			lg.l.ErrorContext(r.Context(), "🔴 Handler Error", dataLog...)
 			return
 		}
 
-		if handler == "" {
-			lg.l.Info("📂 Assets Info", dataLog...)
+		if req.Handler == "" {
+			lg.l.InfoContext(r.Context(), "📂 Assets Info", dataLog...)
 			return
 		}
 
-		dataLog = append(dataLog, "handler", handler)
-		lg.l.Info("🔵 Handler Info", dataLog...)
+		dataLog = append(dataLog, "handler", req.Handler)
+		lg.l.InfoContext(r.Context(), "🔵 Handler Info", dataLog...)
 	})
 }
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/encrypt"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/oidc"
+)
+
+// oidcState is kept (encrypted) in a cookie between the
+// redirection to the identity provider and the callback.
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Tzone    string `json:"tzone"`
+}
+
+// ssoName returns the name of the identity provider shown
+// in the templates, or an empty string if SSO is disabled.
+func (ah *AuthHandle) ssoName() string {
+	if ah.oidc == nil {
+		return ""
+	}
+
+	return ah.cfg.OIDCProviderName
+}
+
+// oidcLoginHandle redirects the user to the identity provider
+// (authorization code flow with PKCE).
+func (ah *AuthHandle) oidcLoginHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	if ah.oidc == nil {
+		return notFoundHandle(w, r)
+	}
+
+	st := oidcState{Tzone: r.FormValue("tz")}
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		random, err := oidc.NewRandom()
+		if err != nil {
+			message := fmt.Sprintf("error 500: could not start the SSO: %s", err)
+			return serverError(w, message)
+		}
+		*v = random
+	}
+
+	authURL, err := ah.oidc.AuthCodeURL(r.Context(), st.State, st.Nonce, st.Verifier)
+	if err != nil {
+		annotateError(r, err.Error())
+		fm := []byte("Single sign-on is temporarily unavailable")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	b, _ := json.Marshal(st)
+	sealed, err := encrypt.Seal(ah.cfg.EncryptionKey, string(b))
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not start the SSO: %s", err)
+		return serverError(w, message)
+	}
+
+	// SameSite=Lax, since the callback is a cross-site navigation
+	cookie := http.Cookie{
+		Name:     "oidc",
+		Value:    sealed,
+		Expires:  time.Now().Add(10 * time.Minute),
+		Path:     "/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+
+	return nil
+}
+
+// oidcCallbackHandle receives the authorization code, validates
+// the ID token and logs the user in: the identity is looked up
+// among the linked ones, otherwise it is linked to the user with
+// the same (verified) email or a new user is provisioned.
+func (ah *AuthHandle) oidcCallbackHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	if ah.oidc == nil {
+		return notFoundHandle(w, r)
+	}
+
+	st, err := readOIDCState(w, r, ah.cfg.EncryptionKey)
+	if err != nil || subtle.ConstantTimeCompare(
+		[]byte(st.State), []byte(r.URL.Query().Get("state")),
+	) != 1 {
+		fm := []byte("Your session has expired, please log in again")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		annotateError(r, "identity provider error: "+e)
+		fm := []byte("Single sign-on was cancelled or denied")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	claims, err := ah.oidc.Exchange(
+		r.Context(), r.URL.Query().Get("code"), st.Verifier, st.Nonce,
+	)
+	if err != nil {
+		annotateError(r, err.Error())
+		fm := []byte("Single sign-on failed, please try again")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	identity := services.Identity{
+		Issuer:  ah.oidc.Issuer,
+		Subject: claims.Subject,
+		Email:   strings.ToLower(claims.Email),
+	}
+
+	user, err := ah.userService.GetUserByIdentity(r.Context(), identity.Issuer, identity.Subject)
+	if err == nil {
+		return ah.completeLogin(w, r, user, st.Tzone, "sso")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	// Accounts are only linked or provisioned by a verified email
+	if identity.Email == "" || !claims.EmailVerified {
+		fm := []byte("Your identity provider did not provide a verified email")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err = ah.userService.CheckEmail(r.Context(), identity.Email)
+	switch {
+	case err == nil:
+		err = ah.userService.LinkIdentity(r.Context(), user.ID, identity)
+	case errors.Is(err, sql.ErrNoRows):
+		user, err = ah.userService.CreateSSOUser(r.Context(), services.User{
+			Email:    identity.Email,
+			Username: ssoUsername(claims),
+		}, identity)
+	}
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	return ah.completeLogin(w, r, user, st.Tzone, "sso")
+}
+
+// readOIDCState decrypts the state cookie and deletes
+// it, so that the callback cannot be replayed.
+func readOIDCState(
+	w http.ResponseWriter, r *http.Request, key []byte,
+) (oidcState, error) {
+	var st oidcState
+
+	cookie, err := r.Cookie("oidc")
+	if err != nil {
+		return st, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "oidc",
+		Path:    "/oidc",
+		MaxAge:  -1,
+		Expires: time.Unix(1, 0),
+	})
+
+	plain, err := encrypt.Open(key, cookie.Value)
+	if err != nil {
+		return st, err
+	}
+
+	err = json.Unmarshal([]byte(plain), &st)
+
+	return st, err
+}
+
+// ssoUsername chooses the username of a provisioned
+// user from the claims of the ID token.
+func ssoUsername(c *oidc.Claims) string {
+	name := strings.TrimSpace(c.PreferredUsername)
+	if name == "" {
+		name = strings.TrimSpace(c.Name)
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(c.Email, "@")
+	}
+	if r := []rune(name); len(r) > 64 {
+		name = string(r[:64])
+	}
+
+	return name
+}
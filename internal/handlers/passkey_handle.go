@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/config"
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/webauthn"
+)
+
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+)
+
+type PasskeyService interface {
+	CreateChallenge(ctx context.Context, c services.Challenge) error
+	ConsumeChallenge(ctx context.Context, id, ceremony string) (services.Challenge, error)
+	CreatePasskey(ctx context.Context, p services.Passkey) error
+	GetPasskeyByCredentialId(ctx context.Context, credentialID string) (services.Passkey, error)
+	GetAllPasskeys(ctx context.Context, userID int) ([]services.Passkey, error)
+	UpdateSignCount(ctx context.Context, id int, signCount uint32) error
+	DeletePasskey(ctx context.Context, p services.Passkey) error
+}
+
+func NewPasskeyHandle(
+	ps PasskeyService, us AuthService, cfg *config.Config,
+) *PasskeyHandle {
+	return &PasskeyHandle{
+		passkeyService: ps,
+		userService:    us,
+		rp: webauthn.RelyingParty{
+			ID:     cfg.BaseURL.Hostname(),
+			Name:   cfg.AppName,
+			Origin: cfg.BaseURL.Scheme + "://" + cfg.BaseURL.Host,
+		},
+		trustProxy: cfg.TrustProxy,
+	}
+}
+
+type PasskeyHandle struct {
+	passkeyService PasskeyService
+	userService    AuthService
+	rp             webauthn.RelyingParty
+	trustProxy     bool
+}
+
+// passkeyLoginBeginHandle starts an authentication ceremony.
+// No email is asked for: the browser offers the
+// discoverable credentials registered for this site.
+func (ph *PasskeyHandle) passkeyLoginBeginHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	challenge, err := ph.startCeremony(w, r, 0, ceremonyLogin)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not start the ceremony: %s", err)
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	return writeJSON(w, http.StatusOK, ph.rp.NewRequestOptions(challenge))
+}
+
+func (ph *PasskeyHandle) passkeyLoginFinishHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	challenge, err := ph.finishCeremony(w, r, ceremonyLogin, 0)
+	if err != nil {
+		message := "the passkey request has expired, please try again"
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	var res webauthn.AssertionResponse
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		message := "malformed passkey response"
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	passkey, err := ph.passkeyService.GetPasskeyByCredentialId(r.Context(), res.ID)
+	if err != nil {
+		message := "this passkey is not registered"
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	if res.Response.UserHandle != "" &&
+		res.Response.UserHandle != webauthn.EncodeID(userHandle(passkey.UserID)) {
+		message := "this passkey does not belong to the user"
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	credID, err := webauthn.DecodeID(passkey.CredentialID)
+	if err != nil {
+		message := fmt.Sprintf("error 500: invalid stored credential: %s", err)
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	signCount, err := ph.rp.VerifyAssertion(res, challenge, webauthn.Credential{
+		ID:        credID,
+		PublicKey: passkey.PublicKey,
+		SignCount: passkey.SignCount,
+	})
+	if err != nil {
+		message := fmt.Sprintf("passkey verification failed: %s", err)
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	if err := ph.passkeyService.UpdateSignCount(r.Context(), passkey.ID, signCount); err != nil {
+		message := "error 500: database temporarily out of service"
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	user, err := ph.userService.GetUserById(r.Context(), passkey.UserID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	if user.Disabled {
+		message := "This account has been disabled"
+		return jsonError(w, r, http.StatusForbidden, message)
+	}
+
+	// A passkey already combines possession of the device and
+	// (usually) user verification, so no second factor is requested.
+	tzone := userTimezone(user, r.Header.Get("X-Timezone"))
+	restored, err := startSession(w, r, ph.userService, ph.trustProxy,
+		user, tzone, "passkey")
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not start the session: %s", err)
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	SetFlash(w, "success", loginMessage(restored))
+
+	return writeJSON(w, http.StatusOK, map[string]string{"redirect": "/todo"})
+}
+
+// passkeysHandle renders the list of passkeys of
+// the user, loaded by the security settings page.
+func (ph *PasskeyHandle) passkeysHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	userData := requestUserData(r.Context())
+
+	passkeys, err := ph.passkeyService.GetAllPasskeys(r.Context(), userData.ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	type row struct {
+		ID         int
+		Name       string
+		CreatedAt  string
+		LastUsedAt string
+	}
+
+	rows := make([]row, 0, len(passkeys))
+	for _, p := range passkeys {
+		lastUsed := "Never"
+		if p.LastUsedAt.Valid {
+			lastUsed = services.ConvertDateTime(userData.Tzone, p.LastUsedAt.Time)
+		}
+		rows = append(rows, row{
+			ID:         p.ID,
+			Name:       p.Name,
+			CreatedAt:  services.ConvertDateTime(userData.Tzone, p.CreatedAt),
+			LastUsedAt: lastUsed,
+		})
+	}
+
+	data := map[string]any{
+		"passkeys": rows,
+	}
+	return render(w, r, "passkeys", data)
+}
+
+func (ph *PasskeyHandle) passkeyRegisterBeginHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	userData := requestUserData(r.Context())
+
+	user, err := ph.userService.GetUserById(r.Context(), userData.ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	passkeys, err := ph.passkeyService.GetAllPasskeys(r.Context(), user.ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	// Prevents registering the same authenticator twice
+	exclude := make([][]byte, 0, len(passkeys))
+	for _, p := range passkeys {
+		if id, err := webauthn.DecodeID(p.CredentialID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	challenge, err := ph.startCeremony(w, r, user.ID, ceremonyRegister)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not start the ceremony: %s", err)
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	options := ph.rp.NewCreationOptions(
+		challenge, userHandle(user.ID), user.Email, user.Username, exclude,
+	)
+
+	return writeJSON(w, http.StatusOK, options)
+}
+
+func (ph *PasskeyHandle) passkeyRegisterFinishHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	userID := requestUserData(r.Context()).ID
+
+	challenge, err := ph.finishCeremony(w, r, ceremonyRegister, userID)
+	if err != nil {
+		message := "the passkey request has expired, please try again"
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	var body struct {
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		message := "malformed passkey response"
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	cred, err := ph.rp.VerifyRegistration(body.Credential, challenge)
+	if err != nil {
+		message := fmt.Sprintf("passkey verification failed: %s", err)
+		return jsonError(w, r, http.StatusBadRequest, message)
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if r := []rune(name); len(r) > 64 {
+		name = string(r[:64])
+	}
+
+	err = ph.passkeyService.CreatePasskey(r.Context(), services.Passkey{
+		UserID:       userID,
+		CredentialID: webauthn.EncodeID(cred.ID),
+		PublicKey:    cred.PublicKey,
+		SignCount:    cred.SignCount,
+		Name:         name,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			message := "this passkey is already registered"
+			return jsonError(w, r, http.StatusBadRequest, message)
+		}
+		message := "error 500: database temporarily out of service"
+		return jsonError(w, r, http.StatusInternalServerError, message)
+	}
+
+	fm := []byte("Passkey successfully added!!")
+	SetFlash(w, "success", fm)
+
+	return writeJSON(
+		w, http.StatusOK, map[string]string{"redirect": "/settings/security"},
+	)
+}
+
+func (ph *PasskeyHandle) passkeyDeleteHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		message := fmt.Sprintf("Go could not convert to integer: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return apiError{
+			status:  http.StatusBadRequest,
+			message: message,
+		}
+	}
+
+	p := services.Passkey{
+		ID:     id,
+		UserID: requestUserData(r.Context()).ID,
+	}
+
+	if err := ph.passkeyService.DeletePasskey(r.Context(), p); err != nil {
+		msg := fmt.Sprintf("something went wrong:%s", err)
+		fm := []byte(msg)
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+
+		return nil
+	}
+
+	fm := []byte("Passkey successfully deleted!!")
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+
+	return nil
+}
+
+// startCeremony stores a new challenge and sets the cookie
+// that identifies the ceremony for the `finish` request.
+func (ph *PasskeyHandle) startCeremony(
+	w http.ResponseWriter, r *http.Request, userID int, ceremony string,
+) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	sid := make([]byte, 16)
+	if _, err := rand.Read(sid); err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(webauthn.Timeout * time.Millisecond)
+
+	err = ph.passkeyService.CreateChallenge(r.Context(), services.Challenge{
+		ID:        webauthn.EncodeID(sid),
+		UserID:    userID,
+		Ceremony:  ceremony,
+		Challenge: webauthn.EncodeID(challenge),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := http.Cookie{
+		Name:     "webauthn",
+		Value:    webauthn.EncodeID(sid),
+		Expires:  expiresAt,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, &cookie)
+
+	return challenge, nil
+}
+
+// finishCeremony consumes the challenge identified by the cookie,
+// checking that the ceremony was started by the same user
+// (zero for the authentication ceremonies).
+func (ph *PasskeyHandle) finishCeremony(
+	w http.ResponseWriter, r *http.Request, ceremony string, userID int,
+) ([]byte, error) {
+	cookie, err := r.Cookie("webauthn")
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "webauthn",
+		Path:    "/",
+		MaxAge:  -1,
+		Expires: time.Unix(1, 0),
+	})
+
+	c, err := ph.passkeyService.ConsumeChallenge(r.Context(), cookie.Value, ceremony)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.UserID != userID {
+		return nil, fmt.Errorf("ceremony started by another user")
+	}
+
+	return webauthn.DecodeID(c.Challenge)
+}
+
+// userHandle is the opaque identifier of the user that the
+// authenticator stores along with a discoverable credential.
+func userHandle(id int) []byte {
+	return []byte(strconv.Itoa(id))
+}
+
+// writeJSON sends v encoded as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+// jsonError answers the `fetch` requests of the WebAuthn
+// ceremonies, for which an error page makes no sense.
+func jsonError(
+	w http.ResponseWriter, r *http.Request, status int, message string,
+) error {
+	annotateError(r, message)
+
+	return writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/ratelimit"
+)
+
+// ratePolicy is the rate limit of a group of routes (declared in
+// LoadRoutes). Each group has its own buckets, by user ID for the
+// authenticated requests and by IP for the others (or always by IP).
+type ratePolicy struct {
+	name  string
+	limit ratelimit.Limit
+	byIP  bool
+}
+
+var (
+	// authRate protects the endpoints that check credentials
+	// or tokens, on top of the login throttling (login_guard.go).
+	authRate = ratePolicy{
+		name:  "auth",
+		limit: ratelimit.Limit{Rate: 10, Per: time.Minute, Burst: 5},
+		byIP:  true,
+	}
+	// writeRate is the default of the state-changing requests.
+	writeRate = ratePolicy{
+		name:  "write",
+		limit: ratelimit.Limit{Rate: 60, Per: time.Minute, Burst: 20},
+	}
+	// readRate is the default of the GET requests.
+	readRate = ratePolicy{
+		name:  "read",
+		limit: ratelimit.Limit{Rate: 300, Per: time.Minute, Burst: 60},
+	}
+	// reportRate keeps the browsers (or anyone) from
+	// flooding the log with violation reports.
+	reportRate = ratePolicy{
+		name:  "report",
+		limit: ratelimit.Limit{Rate: 30, Per: time.Minute, Burst: 10},
+		byIP:  true,
+	}
+	// scrapeRate leaves room for several scrapers of /metrics
+	// (every 15s or so), which may be public (see MetricsHandle).
+	scrapeRate = ratePolicy{
+		name:  "scrape",
+		limit: ratelimit.Limit{Rate: 30, Per: time.Minute, Burst: 10},
+		byIP:  true,
+	}
+	// unlimited is meant for the static files.
+	unlimited = ratePolicy{}
+)
+
+// rateLimiter is a structure to support the `RateLimitMiddleware`
+// middleware and be able to pass it (as a method receiver)
+// its dependencies without altering the middleware signature.
+type rateLimiter struct {
+	routes     *RouteTable
+	store      ratelimit.Store
+	trustProxy bool
+	l          *slog.Logger
+}
+
+func NewRateLimiter(
+	routes *RouteTable, store ratelimit.Store, trustProxy bool, l *slog.Logger,
+) *rateLimiter {
+	return &rateLimiter{routes, store, trustProxy, l}
+}
+
+// RateLimitMiddleware limits the requests of each client with the
+// policy of the route. It runs after AuthMiddleware, so that the
+// authenticated users are identified by their ID. If the store
+// fails, the request is let through (the error is logged).
+func (rl *rateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := rl.routes.rateOf(r)
+		if p.name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := p.name + ":ip:" + clientIP(r, rl.trustProxy)
+		if u := requestUserData(r.Context()); u.ID != 0 && !p.byIP {
+			key = p.name + ":user:" + strconv.Itoa(u.ID)
+		}
+
+		retryAfter, err := rl.store.Allow(r.Context(), key, p.limit, time.Now())
+		if err != nil {
+			rl.l.ErrorContext(r.Context(), "🔴 Rate Limit Error: could not check the limit",
+				"key", key,
+				"error", err.Error(),
+			)
+		}
+		if err != nil || retryAfter <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tooManyRequests(w, r, retryAfter)
+	})
+}
+
+// tooManyRequests answers a rate-limited request (429). The htmx
+// requests (not boosted) get only the message (a fragment), which
+// the response targets swap like the other errors; the rest, the
+// boosted navigations included, get the whole page.
+func tooManyRequests(
+	w http.ResponseWriter, r *http.Request, retryAfter time.Duration,
+) {
+	message := "error 429: too many requests"
+	// The request is answered by RateLimitMiddleware, not by its route
+	req := requestMeta(r.Context())
+	req.Handler, req.Err = handlerName(tooManyRequests), message
+	w.Header().Set(
+		"Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))),
+	)
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	data := map[string]any{
+		"title":         "| Error 429",
+		"isError":       true,
+		"fromProtected": requestFromProtected(r.Context()),
+		"retryAfter":    humanizeDuration(retryAfter),
+	}
+
+	name := "error_429.tmpl"
+	if isFragmentRequest(r) {
+		name = "error-429"
+	}
+
+	if err := render(w, r, name, data); err != nil {
+		panic(fmt.Sprintf("something went wrong: %s\n", err))
+	}
+}
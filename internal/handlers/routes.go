@@ -3,24 +3,61 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
+	"net/http/pprof"
+	"reflect"
 	"runtime"
 	"strings"
 	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/reqctx"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/static"
 )
 
+// Names under which the CSRF token travels (see CSRFMiddleware).
 const (
-	HEADER_KEY_HANDLER = "X-Handler"
-	HEADER_KEY_ERRMSG  = "X-Errmsg"
+	csrfCookieName = "csrf"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfTokenLen   = 43 // 32 bytes in base64url without padding
 )
 
 var tmpl *template.Template
 
+// Site is the web interface served by the application: the
+// templates (views/*.tmpl of Views) and the static files.
+// In development mode the templates are parsed again on
+// every render, to see the changes without restarting.
+type Site struct {
+	Views  fs.FS
+	Assets *static.Assets
+	Dev    bool
+}
+
+var site Site
+
+// parseTemplates parses the templates with the functions
+// that give the URLs of the static files:
+// `{{ asset "css/main.css" }}` and `{{ vendor "htmx.min.js" }}`.
+func parseTemplates(s Site) (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{
+		"asset":  s.Assets.URL,
+		"vendor": s.Assets.VendorURL,
+	}).ParseFS(s.Views, "views/*.tmpl")
+}
+
 type apiError struct {
 	status  int
 	message string
+	// loggedOut is set when the session has been closed along
+	// with the error (see storeUnavailable), so that the error
+	// page is not rendered as a protected one.
+	loggedOut bool
 }
 
 func (e apiError) Error() string {
@@ -34,58 +71,47 @@ type adapterHandle func(http.ResponseWriter, *http.Request) error
 // adapterHandle implements the http.Handler interface.
 // Because handlers return errors, the ServeHTTP implementation
 // handles errors based on their type. Therefore, this function
-// also performs centralized error handling.
+// also performs centralized error handling. The handler and its
+// error are recorded in the metadata of the request (see
+// reqctx.Request) for the logs.
 func (a adapterHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := requestMeta(r.Context())
+	req.Handler = handlerName(a)
+
 	err := a(w, r)
 	if err == nil {
 		return
 	}
 
+	if req.Err == "" {
+		req.Err = err.Error()
+	}
+
 	var e apiError
 	if errors.As(err, &e) {
-		caller := ""
-		if h, ok := w.Header()[HEADER_KEY_HANDLER]; ok {
-			caller = h[0]
-		}
-
 		data := map[string]any{
 			"isError":       true,
-			"fromProtected": requestFromProtected(r.Context()),
-		}
-
-		// We handle the case that occurs when a logged in user cannot
-		// connect to the database table `todos` through these handlers
-		// when an error occurs with code 500: the user is
-		// automatically logged out and therefore the `fromProtected` flag
-		// is set to FALSE. In your application
-		// you can handle this situation as you see fit.
-		if (strings.Contains(caller, "todoListHandle") ||
-			strings.Contains(caller, "createTodoPostHandle") ||
-			strings.Contains(caller, "editTodoHandle") ||
-			strings.Contains(caller, "editTodoPostHandle") ||
-			strings.Contains(caller, "deleteTodoHandle")) &&
-			e.status == 500 {
-			data["fromProtected"] = false
+			"fromProtected": requestFromProtected(r.Context()) && !e.loggedOut,
 		}
 
 		switch e.status {
 		case 400:
 			data["title"] = "| Error 400"
-			err := tmpl.ExecuteTemplate(w, "error_400.tmpl", data)
+			err := render(w, r, "error_400.tmpl", data)
 			if err != nil {
 				panic(fmt.Sprintf("something went wrong: %s\n", err))
 			}
 			return
 		case 404:
 			data["title"] = "| Error 404"
-			err := tmpl.ExecuteTemplate(w, "error_404.tmpl", data)
+			err := render(w, r, "error_404.tmpl", data)
 			if err != nil {
 				panic(fmt.Sprintf("something went wrong: %s\n", err))
 			}
 			return
 		case 500:
 			data["title"] = "| Error 500"
-			err := tmpl.ExecuteTemplate(w, "error_500.tmpl", data)
+			err := render(w, r, "error_500.tmpl", data)
 			if err != nil {
 				panic(fmt.Sprintf("something went wrong: %s\n", err))
 			}
@@ -108,14 +134,82 @@ func (a adapterHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// asCaller is a convenience function that gets the caller
-// from which this function is called.
-// The index `1` returns the name of the handler we are looking for.
-func asCaller() string {
-	pc, _, _, _ := runtime.Caller(1) // index = 1
-	hs := strings.Split(runtime.FuncForPC(pc).Name(), "/")
+// handlerName returns the name of the handler function
+// (e.g. `handlers.(*TodoHandle).todoListHandle`) for the logs.
+func handlerName(h any) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	hs := strings.Split(name, "/")
+
+	// The method values are wrappers with the suffix `-fm`
+	return strings.TrimSuffix(hs[len(hs)-1], "-fm")
+}
+
+// annotateError records the error of the request for the logs,
+// when the handler answers by itself instead of returning it
+// (e.g. redirecting with a flash message).
+func annotateError(r *http.Request, message string) {
+	requestMeta(r.Context()).Err = message
+}
+
+// serverError is a convenience function that sets the status
+// of an internal error and returns the corresponding
+// apiError for centralized handling.
+func serverError(w http.ResponseWriter, message string) error {
+	w.WriteHeader(http.StatusInternalServerError)
+	return apiError{
+		status:  http.StatusInternalServerError,
+		message: message,
+	}
+}
+
+// badRequest is the counterpart of serverError
+// for the requests that are malformed (400).
+func badRequest(w http.ResponseWriter, message string) error {
+	w.WriteHeader(http.StatusBadRequest)
+	return apiError{
+		status:  http.StatusBadRequest,
+		message: message,
+	}
+}
+
+// render executes the template adding the data
+// common to all pages (such as the CSRF token).
+func render(
+	w http.ResponseWriter, r *http.Request, name string, data map[string]any,
+) error {
+	data["csrfToken"] = requestCSRFToken(r.Context())
+	data["cspNonce"] = requestCSPNonce(r.Context())
+	data["isAdmin"] = requestUserData(r.Context()).Role == services.RoleAdmin
+	data["requestID"] = reqctx.ID(r.Context())
 
-	return hs[len(hs)-1]
+	t := tmpl
+	if site.Dev {
+		var err error
+		if t, err = parseTemplates(site); err != nil {
+			return err
+		}
+	}
+
+	// The fragments (e.g. a row of a table) are not
+	// recognized as HTML by the sniffing of net/http
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+
+	_, span := startSpan(r.Context(), "template "+name)
+	err := t.ExecuteTemplate(w, name, data)
+	endSpan(span, err)
+
+	return err
+}
+
+// isFragmentRequest reports whether the request was made by htmx
+// to swap a fragment of the page, rather than by a boosted link or
+// form (`hx-boost`), which expects the whole page like the browser.
+func isFragmentRequest(r *http.Request) bool {
+
+	return r.Header.Get("HX-Request") == "true" &&
+		r.Header.Get("HX-Boosted") != "true"
 }
 
 // clearCookie is a convenience function that deletes
@@ -130,30 +224,259 @@ func clearCookie(w http.ResponseWriter) {
 	http.SetCookie(w, dc)
 }
 
+// access is the requirement that a route declares in LoadRoutes,
+// enforced by AuthMiddleware. The zero value requires an
+// authenticated user, so that the routes are protected by default.
+type access struct {
+	public bool   // anyone can access it
+	guest  bool   // only users who are not logged in
+	role   string // only authenticated users with this role
+	// resetAllowed lets in the users who have to
+	// change their password (see services.User).
+	resetAllowed bool
+	// noRedirect answers 404 to the requests that do not meet the
+	// requirement, instead of redirecting them to a page (e.g. the
+	// login), for the routes used by tools rather than browsers.
+	noRedirect bool
+}
+
+var (
+	public        = access{public: true}
+	guest         = access{guest: true}
+	authenticated = access{}
+	resetting     = access{resetAllowed: true}
+	admin         = access{role: services.RoleAdmin}
+	diagnostics   = access{role: services.RoleAdmin, noRedirect: true}
+)
+
+// RouteTable keeps the access requirement, the rate limit, the
+// CSRF exemption and whether it is logged of each route
+// (by pattern) registered in the ServeMux.
+type RouteTable struct {
+	mux    *http.ServeMux
+	access map[string]access
+	limits map[string]ratePolicy
+	noCSRF map[string]bool
+	quiet  map[string]bool
+}
+
+func (rt *RouteTable) handle(pattern string, acc access, h http.Handler) {
+	rt.mux.Handle(pattern, h)
+	rt.access[pattern] = acc
+}
+
+// limit sets the rate limit of the routes, instead of the
+// default one (readRate for GET requests, writeRate otherwise).
+func (rt *RouteTable) limit(p ratePolicy, patterns ...string) {
+	for _, pattern := range patterns {
+		rt.limits[pattern] = p
+	}
+}
+
+// rateOf returns the rate limit of the route that
+// will serve the request, as matched by the ServeMux.
+func (rt *RouteTable) rateOf(r *http.Request) ratePolicy {
+	_, pattern := rt.mux.Handler(r)
+	if p, ok := rt.limits[pattern]; ok {
+		return p
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return readRate
+	}
+
+	return writeRate
+}
+
+// exemptCSRF exempts the routes from the CSRF check, only
+// for the endpoints that receive requests from the browser
+// itself rather than from the pages (e.g. /csp-report).
+func (rt *RouteTable) exemptCSRF(patterns ...string) {
+	for _, pattern := range patterns {
+		rt.noCSRF[pattern] = true
+	}
+}
+
+// csrfExempt reports whether the route that
+// will serve the request is exempt from the CSRF check.
+func (rt *RouteTable) csrfExempt(r *http.Request) bool {
+	_, pattern := rt.mux.Handler(r)
+
+	return rt.noCSRF[pattern]
+}
+
+// unlogged leaves the routes out of the access log (see
+// LoggingMiddleware), for those requested over and over by
+// machines (e.g. the probes of the orchestrator).
+func (rt *RouteTable) unlogged(patterns ...string) {
+	for _, pattern := range patterns {
+		rt.quiet[pattern] = true
+	}
+}
+
+// accessOf returns the requirement of the route that
+// will serve the request, as matched by the ServeMux.
+func (rt *RouteTable) accessOf(r *http.Request) access {
+	_, pattern := rt.mux.Handler(r)
+	if pattern == "" {
+		// No route: the ServeMux answers
+		// (redirection, 404 or 405) by itself
+		return public
+	}
+
+	if acc, ok := rt.access[pattern]; ok {
+		return acc
+	}
+
+	// Registered without a requirement
+	return authenticated
+}
+
+// RouteMiddleware records in the metadata of the request (see
+// reqctx.Request) the pattern of the route that will serve it, as
+// matched by the ServeMux, for the logs and the metrics, and
+// whether it is logged. It goes
+// before the middlewares that may answer the request by themselves
+// (e.g. AuthMiddleware), so that it is known for those as well.
+func (rt *RouteTable) RouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := rt.mux.Handler(r)
+		req := requestMeta(r.Context())
+		req.Pattern = pattern
+		req.Quiet = rt.quiet[pattern]
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // LoadRoutes starts the `tmpl` variable,
 // necessary to execute the various templates that
 // the handlers will execute, while registering
-// the routes of the various endpoints.
-func LoadRoutes(r *http.ServeMux, ah *AuthHandle, th *TodoHandle) {
+// the routes of the various endpoints with their access
+// requirement and rate limit. The returned table is used by
+// RouteMiddleware, AuthMiddleware, RateLimitMiddleware and
+// CSRFMiddleware.
+func LoadRoutes(
+	r *http.ServeMux,
+	ah *AuthHandle, ph *PasskeyHandle, adh *AdminHandle, th *TodoHandle,
+	sh *SecurityHandle, hh *HealthHandle, mh *MetricsHandle, s Site,
+) *RouteTable {
+	site = s
 	if tmpl == nil {
-		tmpl = template.Must(tmpl.ParseGlob("views/*.tmpl"))
+		tmpl = template.Must(parseTemplates(s))
+	}
+
+	rt := &RouteTable{
+		mux:    r,
+		access: map[string]access{},
+		limits: map[string]ratePolicy{},
+		noCSRF: map[string]bool{},
+		quiet:  map[string]bool{},
 	}
 
+	// Setting the static file service (assets)
+	rt.handle("GET /assets/", public, http.StripPrefix("/assets/", s.Assets))
+
 	// "/{$}" only matches the slash
-	r.Handle("GET /{$}", adapterHandle(ah.homeHandle))
-	r.Handle("GET /register", adapterHandle(ah.registerHandle))
-	r.Handle("POST /register", adapterHandle(ah.registerPostHandle))
-	r.Handle("GET /login", adapterHandle(ah.loginHandle))
-	r.Handle("POST /login", adapterHandle(ah.loginPostHandle))
-	r.Handle("POST /logout", adapterHandle(ah.logoutHandle))
-
-	r.Handle("GET /todo", adapterHandle(th.todoListHandle))
-	r.Handle("GET /create", adapterHandle(th.createTodoHandle))
-	r.Handle("POST /create", adapterHandle(th.createTodoPostHandle))
-	r.Handle("GET /edit", adapterHandle(th.editTodoHandle))
-	r.Handle("POST /edit", adapterHandle(th.editTodoPostHandle))
-	r.Handle("DELETE /delete", adapterHandle(th.deleteTodoHandle))
+	rt.handle("GET /{$}", public, adapterHandle(ah.homeHandle))
+	rt.handle("GET /register", guest, adapterHandle(ah.registerHandle))
+	rt.handle("POST /register", guest, adapterHandle(ah.registerPostHandle))
+	rt.handle("GET /login", guest, adapterHandle(ah.loginHandle))
+	rt.handle("POST /login", guest, adapterHandle(ah.loginPostHandle))
+	rt.handle("POST /logout", resetting, adapterHandle(ah.logoutHandle))
+	rt.handle("GET /login/2fa", guest, adapterHandle(ah.loginTwoFactorHandle))
+	rt.handle("POST /login/2fa", guest, adapterHandle(ah.loginTwoFactorPostHandle))
+	rt.handle("GET /login/unlock", public, adapterHandle(ah.unlockHandle))
+
+	rt.handle("GET /settings/account", resetting, adapterHandle(ah.accountHandle))
+	rt.handle("POST /settings/account/username", authenticated, adapterHandle(ah.usernamePostHandle))
+	rt.handle("POST /settings/account/email", authenticated, adapterHandle(ah.emailPostHandle))
+	rt.handle("POST /settings/account/password", resetting, adapterHandle(ah.passwordPostHandle))
+	rt.handle("POST /settings/account/timezone", authenticated, adapterHandle(ah.timezonePostHandle))
+	rt.handle("GET /settings/account/export", authenticated, adapterHandle(ah.exportHandle))
+	rt.handle("POST /settings/account/delete", authenticated, adapterHandle(ah.deleteAccountHandle))
+	rt.handle("GET /email/verify", public, adapterHandle(ah.verifyEmailHandle))
+	rt.handle("GET /settings/security", authenticated, adapterHandle(ah.securityHandle))
+	rt.handle("GET /settings/2fa/setup", authenticated, adapterHandle(ah.totpSetupHandle))
+	rt.handle("POST /settings/2fa/setup", authenticated, adapterHandle(ah.totpSetupPostHandle))
+	rt.handle("POST /settings/2fa/disable", authenticated, adapterHandle(ah.totpDisableHandle))
+	rt.handle("POST /settings/2fa/recovery", authenticated, adapterHandle(ah.recoveryCodesHandle))
+
+	rt.handle("GET /oidc/login", guest, adapterHandle(ah.oidcLoginHandle))
+	rt.handle("GET /oidc/callback", guest, adapterHandle(ah.oidcCallbackHandle))
+
+	rt.handle("POST /passkey/login/begin", guest, adapterHandle(ph.passkeyLoginBeginHandle))
+	rt.handle("POST /passkey/login/finish", guest, adapterHandle(ph.passkeyLoginFinishHandle))
+	rt.handle("GET /settings/passkeys", authenticated, adapterHandle(ph.passkeysHandle))
+	rt.handle("POST /settings/passkeys/begin", authenticated, adapterHandle(ph.passkeyRegisterBeginHandle))
+	rt.handle("POST /settings/passkeys/finish", authenticated, adapterHandle(ph.passkeyRegisterFinishHandle))
+	rt.handle("DELETE /settings/passkeys", authenticated, adapterHandle(ph.passkeyDeleteHandle))
+
+	rt.handle("GET /admin", admin, adapterHandle(adh.dashboardHandle))
+	rt.handle("GET /admin/users", admin, adapterHandle(adh.usersHandle))
+	rt.handle("POST /admin/users/{id}/disable", admin, adapterHandle(adh.disableUserHandle))
+	rt.handle("POST /admin/users/{id}/enable", admin, adapterHandle(adh.enableUserHandle))
+	rt.handle("POST /admin/users/{id}/reset-password", admin, adapterHandle(adh.resetPasswordHandle))
+	rt.handle("POST /admin/users/{id}/role", admin, adapterHandle(adh.roleHandle))
+	rt.handle("GET /admin/audit", admin, adapterHandle(adh.auditHandle))
+
+	rt.handle("GET /todo", authenticated, adapterHandle(th.todoListHandle))
+	rt.handle("GET /create", authenticated, adapterHandle(th.createTodoHandle))
+	rt.handle("POST /create", authenticated, adapterHandle(th.createTodoPostHandle))
+	rt.handle("GET /edit", authenticated, adapterHandle(th.editTodoHandle))
+	rt.handle("POST /edit", authenticated, adapterHandle(th.editTodoPostHandle))
+	rt.handle("DELETE /delete", authenticated, adapterHandle(th.deleteTodoHandle))
+	rt.handle("GET /todo/{id}/row", authenticated, adapterHandle(th.todoRowHandle))
+	rt.handle("GET /todo/{id}/title", authenticated, adapterHandle(th.editTitleHandle))
+	rt.handle("POST /todo/{id}/title", authenticated, adapterHandle(th.editTitlePostHandle))
+	rt.handle("POST /todo/{id}/toggle", authenticated, adapterHandle(th.toggleTodoPostHandle))
+	rt.handle("POST /todo/batch", authenticated, adapterHandle(th.batchTodoPostHandle))
+
+	rt.handle("POST /csp-report", public, adapterHandle(sh.cspReportHandle))
+	rt.handle("GET /healthz", public, adapterHandle(hh.healthHandle))
+	rt.handle("GET /readyz", public, adapterHandle(hh.readyHandle))
+	rt.handle("GET /metrics", public, adapterHandle(mh.metricsHandle))
+
+	// Diagnostics of the running process, for the administrators
+	rt.handle("GET /debug", diagnostics, adapterHandle(adh.debugHandle))
+	rt.handle("GET /debug/vars", diagnostics, expvar.Handler())
+	rt.handle("GET /debug/pprof/", diagnostics, http.HandlerFunc(pprof.Index))
+	rt.handle("GET /debug/pprof/cmdline", diagnostics, http.HandlerFunc(pprof.Cmdline))
+	rt.handle("GET /debug/pprof/profile", diagnostics, profileHandler(pprof.Profile, 30))
+	rt.handle("GET /debug/pprof/symbol", diagnostics, http.HandlerFunc(pprof.Symbol))
+	rt.handle("GET /debug/pprof/trace", diagnostics, profileHandler(pprof.Trace, 1))
 
 	// "/" matches anything
-	r.Handle("/", adapterHandle(notFoundHandle))
+	rt.handle("/", public, adapterHandle(notFoundHandle))
+
+	rt.limit(unlimited, "GET /assets/", "GET /healthz", "GET /readyz")
+	rt.limit(scrapeRate, "GET /metrics")
+	rt.limit(authRate,
+		"POST /register",
+		"POST /login",
+		"POST /login/2fa",
+		"GET /login/unlock",
+		"GET /email/verify",
+		"GET /oidc/login",
+		"GET /oidc/callback",
+		"POST /passkey/login/begin",
+		"POST /passkey/login/finish",
+	)
+	rt.limit(reportRate, "POST /csp-report")
+
+	rt.exemptCSRF("POST /csp-report")
+
+	rt.unlogged(
+		"GET /healthz",
+		"GET /readyz",
+		"GET /debug",
+		"GET /debug/vars",
+		"GET /debug/pprof/",
+		"GET /debug/pprof/cmdline",
+		"GET /debug/pprof/profile",
+		"GET /debug/pprof/symbol",
+		"GET /debug/pprof/trace",
+	)
+
+	return rt
 }
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/config"
+)
+
+// maxCSPReportSize is the largest violation report accepted (in bytes).
+const maxCSPReportSize = 64 << 10
+
+func NewSecurityHandle(cfg *config.Config, l *slog.Logger) *SecurityHandle {
+
+	return &SecurityHandle{
+		cfg: cfg,
+		l:   l,
+	}
+}
+
+// SecurityHandle sets the security headers of the responses
+// (SecurityMiddleware) and collects the reports of the
+// Content-Security-Policy violations (`/csp-report`).
+type SecurityHandle struct {
+	cfg *config.Config
+	l   *slog.Logger
+}
+
+// SecurityMiddleware sets the security headers of every response,
+// including a strict Content-Security-Policy: the scripts only run
+// if their tag carries the nonce of the request, which is injected
+// into the context to render the templates (`cspNonce`), so that an
+// injected script (or inline event handler) is blocked. The styles
+// allow 'unsafe-inline' because Tailwind (Play CDN), htmx and
+// SweetAlert insert them at runtime. In report-only mode
+// (CSP_REPORT_ONLY) the violations are reported but not blocked.
+func (sh *SecurityHandle) SecurityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(fmt.Sprintf("something went wrong: %s\n", err))
+		}
+		nonce := base64.RawURLEncoding.EncodeToString(b)
+
+		cspHeader := "Content-Security-Policy"
+		if sh.cfg.CSPReportOnly {
+			cspHeader = "Content-Security-Policy-Report-Only"
+		}
+
+		h := w.Header()
+		h.Set(cspHeader, sh.policy(nonce))
+		h.Set("Reporting-Endpoints", fmt.Sprintf(
+			`csp-endpoint="%s"`, sh.cfg.BaseURL.JoinPath("/csp-report"),
+		))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		h.Set("Permissions-Policy", strings.Join([]string{
+			"camera=()",
+			"microphone=()",
+			"geolocation=()",
+			"payment=()",
+			"usb=()",
+			"publickey-credentials-get=(self)",
+			"publickey-credentials-create=(self)",
+		}, ", "))
+		// The browsers only honor HSTS over HTTPS
+		if sh.cfg.BaseURL.Scheme == "https" {
+			h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		next.ServeHTTP(w, r.WithContext(withRequestCSPNonce(r.Context(), nonce)))
+	})
+}
+
+// policy is the Content-Security-Policy of a response with the given nonce.
+func (sh *SecurityHandle) policy(nonce string) string {
+	return strings.Join([]string{
+		"default-src 'self'",
+		// The libraries are vendored (see static.Vendored)
+		fmt.Sprintf("script-src 'nonce-%s' 'strict-dynamic' 'self'", nonce),
+		"style-src 'self' 'unsafe-inline'",
+		"img-src 'self' data:",
+		"font-src 'self' data:",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"report-uri /csp-report",
+		"report-to csp-endpoint",
+	}, "; ")
+}
+
+// cspReport is a violation report, in either of the formats sent
+// by the browsers: `report-uri` (application/csp-report, a single
+// report) or the Reporting API (application/reports+json, a list).
+type cspReport struct {
+	Legacy struct {
+		DocumentURI        string `json:"document-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI         string `json:"blocked-uri"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		Disposition        string `json:"disposition"`
+	} `json:"csp-report"`
+
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		BlockedURL         string `json:"blockedURL"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+		Disposition        string `json:"disposition"`
+	} `json:"body"`
+}
+
+// cspReportHandle logs the violations reported by the browsers.
+// The endpoint is public and exempt from the CSRF check (the
+// browsers send no token), so it only logs what it receives.
+func (sh *SecurityHandle) cspReportHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportSize))
+	if err != nil {
+		return badRequest(w, "error 400: the report is too large")
+	}
+
+	reports := []cspReport{}
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &reports)
+	} else {
+		var report cspReport
+		err = json.Unmarshal(body, &report)
+		reports = append(reports, report)
+	}
+	if err != nil {
+		return badRequest(w, "error 400: malformed report")
+	}
+
+	for _, rep := range reports {
+		dataLog := []any{}
+		switch {
+		case rep.Legacy.DocumentURI != "":
+			directive := rep.Legacy.EffectiveDirective
+			if directive == "" {
+				directive = rep.Legacy.ViolatedDirective
+			}
+			dataLog = append(dataLog,
+				"document", rep.Legacy.DocumentURI,
+				"directive", directive,
+				"blocked", rep.Legacy.BlockedURI,
+				"source", rep.Legacy.SourceFile,
+				"line", rep.Legacy.LineNumber,
+				"disposition", rep.Legacy.Disposition,
+			)
+		case rep.Type == "csp-violation":
+			dataLog = append(dataLog,
+				"document", rep.Body.DocumentURL,
+				"directive", rep.Body.EffectiveDirective,
+				"blocked", rep.Body.BlockedURL,
+				"source", rep.Body.SourceFile,
+				"line", rep.Body.LineNumber,
+				"disposition", rep.Body.Disposition,
+			)
+		default:
+			continue
+		}
+
+		dataLog = append(dataLog,
+			"ip", clientIP(r, sh.cfg.TrustProxy),
+			"user_agent", r.Header.Get("User-Agent"),
+		)
+		sh.l.WarnContext(r.Context(), "🟠 CSP Violation", dataLog...)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
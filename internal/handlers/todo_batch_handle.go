@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+)
+
+// Limits of the bulk actions on the tasks.
+const (
+	maxBatchSize = 500
+	maxListLen   = 64
+	maxTagLen    = 32
+)
+
+// undoActions are the actions that undo the bulk actions, when
+// applied to the tasks they changed (see services.BatchAction).
+var undoActions = map[string]string{
+	services.BatchComplete: services.BatchReopen,
+	services.BatchReopen:   services.BatchComplete,
+	services.BatchTag:      services.BatchUntag,
+	services.BatchUntag:    services.BatchTag,
+}
+
+// undo is the request that reverts a change, offered
+// as a button in the flash message (see flash).
+type undo struct {
+	URL    string
+	Target string // element swapped with the response
+	Values url.Values
+}
+
+// batchTodoPostHandle applies a bulk action to the selected tasks
+// (the `id` fields) in a single transaction. The htmx requests get
+// the rows of the list back, with the summary of the changes and,
+// if the action can be undone, a button to apply the opposite one to
+// the tasks that were changed. The filter of the list (`list` and
+// `tag` in the query string) is kept.
+func (th *TodoHandle) batchTodoPostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	// The query string is the filter of the list, not the
+	// parameters of the action (the form): see PostFormValue
+	filter := todoFilter(r.URL.Query())
+	listURL := "/todo" + filter.query()
+
+	if err := r.ParseForm(); err != nil {
+		return badRequest(w, "invalid form")
+	}
+	// Checked before parsing them, as the form can carry
+	// far more ids than a batch (the repeated ones included)
+	values := r.PostForm["id"]
+	if len(values) > maxBatchSize {
+		return badRequest(w, "too many tasks selected")
+	}
+	ids := make([]int, 0, len(values))
+	seen := make(map[int]bool, len(values))
+	for _, v := range values {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return badRequest(w, "invalid task id")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	a := services.BatchAction{
+		Kind: r.PostFormValue("action"),
+		List: strings.TrimSpace(r.PostFormValue("list")),
+		Tag:  strings.ToLower(strings.TrimSpace(r.PostFormValue("tag"))),
+	}
+	if msg := validateBatch(a, len(ids)); msg != "" {
+		return th.batchFailed(w, r, listURL, msg)
+	}
+
+	userID := requestUserData(r.Context()).ID
+	res, err := th.todoService.Batch(r.Context(), userID, ids, a)
+	if err != nil {
+		if err := storeUnavailable(w, err); err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("something went wrong:%s", err)
+		return th.batchFailed(w, r, listURL, msg)
+	}
+
+	message := batchSummary(a, len(res.Changed), len(ids))
+
+	if !isFragmentRequest(r) {
+		SetFlash(w, "success", []byte(message))
+		http.Redirect(w, r, listURL, http.StatusSeeOther)
+
+		return nil
+	}
+
+	// The batch is done: if the rows cannot be read, the
+	// page is left as it is rather than emptied
+	todos, err := th.todoService.GetAllTodos(r.Context(), userID)
+	if err != nil {
+		if err := storeUnavailable(w, err); err != nil {
+			return err
+		}
+
+		return todoFragmentError(w, r, fmt.Sprintf(
+			"%s, but the list could not be refreshed: please reload the page", message,
+		))
+	}
+
+	trigger, err := json.Marshal(map[string]any{
+		"todosChanged": map[string]any{"ids": res.Changed},
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Trigger", string(trigger))
+
+	data := map[string]any{
+		"todos":   filter.apply(todos),
+		"succMsg": message,
+	}
+	if inverse, ok := undoActions[a.Kind]; ok && len(res.Changed) > 0 {
+		values := url.Values{"action": {inverse}, "tag": {a.Tag}}
+		for _, id := range res.Changed {
+			values.Add("id", strconv.Itoa(id))
+		}
+		data["undo"] = undo{
+			URL:    "/todo/batch" + filter.query(),
+			Target: "#todos",
+			Values: values,
+		}
+	}
+	return render(w, r, "todo-rows-fragment", data)
+}
+
+func (th *TodoHandle) batchFailed(
+	w http.ResponseWriter, r *http.Request, listURL, message string,
+) error {
+	if isFragmentRequest(r) {
+		return todoFragmentError(w, r, message)
+	}
+
+	SetFlash(w, "error", []byte(message))
+	http.Redirect(w, r, listURL, http.StatusSeeOther)
+
+	return nil
+}
+
+// validateBatch returns the message for the user if the
+// bulk action cannot be applied, or an empty string.
+func validateBatch(a services.BatchAction, selected int) string {
+	if selected == 0 {
+		return "No tasks selected!!"
+	}
+
+	switch a.Kind {
+	case services.BatchComplete, services.BatchReopen, services.BatchDelete:
+	case services.BatchMove:
+		if len([]rune(a.List)) > maxListLen {
+			return fmt.Sprintf("The name of the list is too long (%d characters at most)", maxListLen)
+		}
+	case services.BatchTag, services.BatchUntag:
+		if !validTag(a.Tag) {
+			return fmt.Sprintf(
+				"Tags have up to %d letters, digits, hyphens or underscores", maxTagLen,
+			)
+		}
+	default:
+		return "Unknown action!!"
+	}
+
+	return ""
+}
+
+// validTag reports whether the tag can be used: not empty, not too
+// long and only letters, digits, hyphens or underscores (the tags
+// are shown as `#tag` and travel in the URLs of the filters).
+func validTag(tag string) bool {
+	if tag == "" || len([]rune(tag)) > maxTagLen {
+		return false
+	}
+
+	for _, c := range tag {
+		switch {
+		case unicode.IsLetter(c), unicode.IsDigit(c), c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// batchSummary describes the result of a bulk action,
+// e.g. "2 tasks completed (1 unchanged)".
+func batchSummary(a services.BatchAction, changed, selected int) string {
+	tasks := "tasks"
+	if changed == 1 {
+		tasks = "task"
+	}
+
+	var done string
+	switch a.Kind {
+	case services.BatchComplete:
+		done = "completed"
+	case services.BatchReopen:
+		done = "reopened"
+	case services.BatchDelete:
+		done = "deleted"
+	case services.BatchMove:
+		done = fmt.Sprintf("moved to %q", a.List)
+		if a.List == "" {
+			done = "taken out of their list"
+		}
+	case services.BatchTag:
+		done = fmt.Sprintf("tagged #%s", a.Tag)
+	case services.BatchUntag:
+		done = fmt.Sprintf("untagged #%s", a.Tag)
+	}
+
+	msg := fmt.Sprintf("%d %s %s", changed, tasks, done)
+	if unchanged := selected - changed; unchanged > 0 {
+		msg += fmt.Sprintf(" (%d unchanged)", unchanged)
+	}
+
+	return msg
+}
+
+// todoFilter is the filter of the task list, by list
+// and tag (`/todo?list=Work&tag=urgent`).
+type todoFilter url.Values
+
+func (f todoFilter) list() string {
+	return url.Values(f).Get("list")
+}
+
+// tag is lowercase, as the tags are stored (see batchTodoPostHandle).
+func (f todoFilter) tag() string {
+	return strings.ToLower(url.Values(f).Get("tag"))
+}
+
+func (f todoFilter) query() string {
+	q := url.Values{}
+	if list := f.list(); list != "" {
+		q.Set("list", list)
+	}
+	if tag := f.tag(); tag != "" {
+		q.Set("tag", tag)
+	}
+	if len(q) == 0 {
+		return ""
+	}
+
+	return "?" + q.Encode()
+}
+
+func (f todoFilter) apply(todos []services.Todo) []services.Todo {
+	list, tag := f.list(), f.tag()
+	if list == "" && tag == "" {
+		return todos
+	}
+
+	filtered := []services.Todo{}
+	for _, t := range todos {
+		if list != "" && t.List != list {
+			continue
+		}
+		if tag != "" && !slices.Contains(t.Tags, tag) {
+			continue
+		}
+		filtered = append(filtered, t)
+	}
+
+	return filtered
+}
+
+// listNames returns the names of the lists of the
+// tasks, in order, to suggest them when moving.
+func listNames(todos []services.Todo) []string {
+	names := []string{}
+	for _, t := range todos {
+		if t.List != "" && !slices.Contains(names, t.List) {
+			names = append(names, t.List)
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
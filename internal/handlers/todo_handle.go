@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -11,11 +13,13 @@ import (
 )
 
 type TaskService interface {
-	CreateTodo(t services.Todo) (services.Todo, error)
-	GetAllTodos(createdBy int) ([]services.Todo, error)
-	GetTodoById(t services.Todo) (services.Todo, error)
-	UpdateTodo(t services.Todo) (services.Todo, error)
-	DeleteTodo(t services.Todo) error
+	CreateTodo(ctx context.Context, t services.Todo) (services.Todo, error)
+	GetAllTodos(ctx context.Context, createdBy int) ([]services.Todo, error)
+	GetTodoById(ctx context.Context, t services.Todo) (services.Todo, error)
+	UpdateTodo(ctx context.Context, t services.Todo) (services.Todo, error)
+	PatchTodo(ctx context.Context, t services.Todo, p services.TodoPatch) (services.Todo, error)
+	DeleteTodo(ctx context.Context, t services.Todo) error
+	Batch(ctx context.Context, createdBy int, ids []int, a services.BatchAction) (services.BatchResult, error)
 }
 
 func NewTodoHandle(ts TaskService) *TodoHandle {
@@ -31,29 +35,10 @@ func (th *TodoHandle) todoListHandle(
 ) error {
 	errMsg, succMsg := GetMessages(w, r)
 
-	todos, err := th.todoService.GetAllTodos(requestUserData(r.Context()).ID)
+	todos, err := th.todoService.GetAllTodos(r.Context(), requestUserData(r.Context()).ID)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table") ||
-			strings.Contains(err.Error(), "database is locked") {
-			// "no such table" is the error that SQLite3 produces
-			// when some table does not exist, and we have only
-			// used it as an example of the errors that can be caught.
-			// Here you can add the errors that you are interested
-			// in throwing as `500` codes.
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
-			// The user is automatically logged out,
-			// since it makes no sense that, if he cannot
-			// access the `todos` table, he can access the protected routes.
-			// In your application you can handle
-			// this situation as best suits you.
-			clearCookie(w)
-			w.WriteHeader(http.StatusInternalServerError)
-			return apiError{
-				status:  http.StatusInternalServerError,
-				message: message,
-			}
+		if err := storeUnavailable(w, err); err != nil {
+			return err
 		}
 	}
 
@@ -62,16 +47,22 @@ func (th *TodoHandle) todoListHandle(
 		upper.Cap(requestUserData(r.Context()).Username),
 	)
 
+	// The list can be filtered by list and tag (see todoFilter)
+	filter := todoFilter(r.URL.Query())
+
 	data := map[string]any{
 		"title":         title,
 		"fromProtected": true,
 		"username":      upper.Cap(requestUserData(r.Context()).Username),
-		"todos":         todos,
+		"todos":         filter.apply(todos),
+		"lists":         listNames(todos),
+		"filterList":    filter.list(),
+		"filterTag":     filter.tag(),
+		"batchURL":      "/todo/batch" + filter.query(),
 		"errMsg":        errMsg,
 		"succMsg":       succMsg,
 	}
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	return tmpl.ExecuteTemplate(w, "todo_list.tmpl", data)
+	return render(w, r, "todo_list.tmpl", data)
 }
 
 func (th *TodoHandle) createTodoHandle(
@@ -83,8 +74,7 @@ func (th *TodoHandle) createTodoHandle(
 		"fromProtected": true,
 		"username":      upper.Cap(requestUserData(r.Context()).Username),
 	}
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-	return tmpl.ExecuteTemplate(w, "todo_create.tmpl", data)
+	return render(w, r, "todo_create.tmpl", data)
 }
 
 func (th *TodoHandle) createTodoPostHandle(
@@ -98,35 +88,39 @@ func (th *TodoHandle) createTodoPostHandle(
 
 	// Empty description is allowed but not the title...
 	if newTodo.Title == "" {
+		if isFragmentRequest(r) {
+			return todoFragmentError(w, r, "Task title empty!!")
+		}
+
 		fm := []byte("Task title empty!!")
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 		return nil
 	}
 
-	_, err := th.todoService.CreateTodo(newTodo)
+	todo, err := th.todoService.CreateTodo(r.Context(), newTodo)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table") ||
-			strings.Contains(err.Error(), "database is locked") {
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
-			clearCookie(w)
-			w.WriteHeader(http.StatusInternalServerError)
-			return apiError{
-				status:  http.StatusInternalServerError,
-				message: message,
-			}
+		if err := storeUnavailable(w, err); err != nil {
+			return err
 		}
 	}
 
+	// The new row is prepended to the list
+	if isFragmentRequest(r) {
+		if err != nil {
+			msg := fmt.Sprintf("something went wrong:%s", err)
+			return todoFragmentError(w, r, msg)
+		}
+
+		return todoFragment(w, r, &todo, "todoCreated", todo.ID,
+			"Task successfully created!!")
+	}
+
 	fm := []byte("Task successfully created!!")
 	SetFlash(w, "success", fm)
 
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 	http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 	return nil
@@ -138,9 +132,7 @@ func (th *TodoHandle) editTodoHandle(
 	idStr := r.URL.Query().Get("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		message := fmt.Sprintf("Go could not convert to integer: %s", err)
-		w.Header().Add(HEADER_KEY_ERRMSG, message)
 		w.WriteHeader(http.StatusBadRequest)
 		return apiError{
 			status:  http.StatusBadRequest,
@@ -157,25 +149,15 @@ func (th *TodoHandle) editTodoHandle(
 		CreatedBy: userID,
 	}
 
-	todo, err := th.todoService.GetTodoById(t)
+	todo, err := th.todoService.GetTodoById(r.Context(), t)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table") ||
-			strings.Contains(err.Error(), "database is locked") {
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
-			clearCookie(w)
-			w.WriteHeader(http.StatusInternalServerError)
-			return apiError{
-				status:  http.StatusInternalServerError,
-				message: message,
-			}
+		if err := storeUnavailable(w, err); err != nil {
+			return err
 		}
 		msg := fmt.Sprintf("something went wrong:%s", err)
 		fm := []byte(msg)
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 		return nil
@@ -191,7 +173,7 @@ func (th *TodoHandle) editTodoHandle(
 		"taskStatus":    todo.Status,
 		"createdAt":     services.ConvertDateTime(tzone, todo.CreatedAt),
 	}
-	return tmpl.ExecuteTemplate(w, "todo_update.tmpl", data)
+	return render(w, r, "todo_update.tmpl", data)
 }
 
 func (th *TodoHandle) editTodoPostHandle(
@@ -200,9 +182,7 @@ func (th *TodoHandle) editTodoPostHandle(
 	idStr := r.URL.Query().Get("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		message := fmt.Sprintf("Go could not convert to integer: %s", err)
-		w.Header().Add(HEADER_KEY_ERRMSG, message)
 		w.WriteHeader(http.StatusBadRequest)
 		return apiError{
 			status:  http.StatusBadRequest,
@@ -225,34 +205,33 @@ func (th *TodoHandle) editTodoPostHandle(
 		CreatedBy:   requestUserData(r.Context()).ID,
 	}
 
-	_, err = th.todoService.UpdateTodo(t)
+	todo, err := th.todoService.UpdateTodo(r.Context(), t)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table") ||
-			strings.Contains(err.Error(), "database is locked") {
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
-			clearCookie(w)
-			w.WriteHeader(http.StatusInternalServerError)
-			return apiError{
-				status:  http.StatusInternalServerError,
-				message: message,
-			}
+		if err := storeUnavailable(w, err); err != nil {
+			return err
 		}
 		msg := fmt.Sprintf("something went wrong:%s", err)
+		if isFragmentRequest(r) {
+			return todoFragmentError(w, r, msg)
+		}
+
 		fm := []byte(msg)
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 		return nil
 	}
 
+	// The row is replaced with the updated one
+	if isFragmentRequest(r) {
+		return todoFragment(w, r, &todo, "todoUpdated", todo.ID,
+			"Task successfully updated!!")
+	}
+
 	fm := []byte("Task successfully updated!!")
 	SetFlash(w, "success", fm)
 
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 	http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 	return nil
@@ -264,9 +243,7 @@ func (th *TodoHandle) deleteTodoHandle(
 	idStr := r.URL.Query().Get("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		message := fmt.Sprintf("Go could not convert to integer: %s", err)
-		w.Header().Add(HEADER_KEY_ERRMSG, message)
 		w.WriteHeader(http.StatusBadRequest)
 		return apiError{
 			status:  http.StatusBadRequest,
@@ -279,36 +256,231 @@ func (th *TodoHandle) deleteTodoHandle(
 		CreatedBy: requestUserData(r.Context()).ID,
 	}
 
-	err = th.todoService.DeleteTodo(t)
+	err = th.todoService.DeleteTodo(r.Context(), t)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table") ||
-			strings.Contains(err.Error(), "database is locked") {
-			w.Header().Add(HEADER_KEY_HANDLER, asCaller())
-			message := "error 500: database temporarily out of service"
-			w.Header().Add(HEADER_KEY_ERRMSG, message)
-			clearCookie(w)
-			w.WriteHeader(http.StatusInternalServerError)
-			return apiError{
-				status:  http.StatusInternalServerError,
-				message: message,
-			}
+		if err := storeUnavailable(w, err); err != nil {
+			return err
 		}
 
 		msg := fmt.Sprintf("something went wrong:%s", err)
+		if isFragmentRequest(r) {
+			return todoFragmentError(w, r, msg)
+		}
+
 		fm := []byte(msg)
 		SetFlash(w, "error", fm)
 
-		w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 		http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 		return nil
 	}
 
+	// Nothing replaces the row: it is removed
+	if isFragmentRequest(r) {
+		return todoFragment(w, r, nil, "todoDeleted", id,
+			"Task successfully deleted!!")
+	}
+
 	fm := []byte("Task successfully deleted!!")
 	SetFlash(w, "success", fm)
 
-	w.Header().Add(HEADER_KEY_HANDLER, asCaller())
 	http.Redirect(w, r, "/todo", http.StatusSeeOther)
 
 	return nil
 }
+
+// todoRowHandle gives the row of a task, e.g. to
+// cancel the edition of its title in the list.
+func (th *TodoHandle) todoRowHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	if !isFragmentRequest(r) {
+		http.Redirect(w, r, "/todo", http.StatusSeeOther)
+		return nil
+	}
+
+	return th.renderRow(w, r, "todo-row-view")
+}
+
+// editTitleHandle gives the row of a task with its title in a form,
+// to edit it in place in the list. Without htmx, the whole task
+// is edited in its page.
+func (th *TodoHandle) editTitleHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	if !isFragmentRequest(r) {
+		path := fmt.Sprintf("/edit?id=%s", r.PathValue("id"))
+		http.Redirect(w, r, path, http.StatusSeeOther)
+		return nil
+	}
+
+	return th.renderRow(w, r, "todo-row-title")
+}
+
+func (th *TodoHandle) renderRow(
+	w http.ResponseWriter, r *http.Request, name string,
+) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return badRequest(w, "invalid task id")
+	}
+
+	t := services.Todo{
+		ID:        id,
+		CreatedBy: requestUserData(r.Context()).ID,
+	}
+
+	todo, err := th.todoService.GetTodoById(r.Context(), t)
+	if err != nil {
+		if err := storeUnavailable(w, err); err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("something went wrong:%s", err)
+		return todoFragmentError(w, r, msg)
+	}
+
+	return render(w, r, name, map[string]any{"todo": todo})
+}
+
+// editTitlePostHandle changes only the title of a task, leaving the
+// rest of its fields as they are (see services.TodoPatch).
+func (th *TodoHandle) editTitlePostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	title := strings.Trim(r.FormValue("title"), " ")
+	if title == "" {
+		return th.patchFailed(w, r, "Task title empty!!")
+	}
+
+	return th.patchTodo(w, r, services.TodoPatch{Title: &title},
+		"Task successfully updated!!")
+}
+
+// toggleTodoPostHandle sets the status of a task to the one sent
+// (`status`, the opposite of the one the row shows), rather than
+// inverting the stored one, so that repeating the request (e.g. a
+// double click) does not undo it.
+func (th *TodoHandle) toggleTodoPostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	status, err := strconv.ParseBool(r.FormValue("status"))
+	if err != nil {
+		return badRequest(w, "invalid task status")
+	}
+
+	// The row itself shows the change: no message
+	return th.patchTodo(w, r, services.TodoPatch{Status: &status}, "")
+}
+
+func (th *TodoHandle) patchTodo(
+	w http.ResponseWriter, r *http.Request, p services.TodoPatch, message string,
+) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return badRequest(w, "invalid task id")
+	}
+
+	t := services.Todo{
+		ID:        id,
+		CreatedBy: requestUserData(r.Context()).ID,
+	}
+
+	todo, err := th.todoService.PatchTodo(r.Context(), t, p)
+	if err != nil {
+		if err := storeUnavailable(w, err); err != nil {
+			return err
+		}
+
+		return th.patchFailed(w, r, fmt.Sprintf("something went wrong:%s", err))
+	}
+
+	if isFragmentRequest(r) {
+		return todoFragment(w, r, &todo, "todoUpdated", todo.ID, message)
+	}
+
+	if message != "" {
+		SetFlash(w, "success", []byte(message))
+	}
+	http.Redirect(w, r, "/todo", http.StatusSeeOther)
+
+	return nil
+}
+
+func (th *TodoHandle) patchFailed(
+	w http.ResponseWriter, r *http.Request, message string,
+) error {
+	if isFragmentRequest(r) {
+		return todoFragmentError(w, r, message)
+	}
+
+	SetFlash(w, "error", []byte(message))
+	http.Redirect(w, r, "/todo", http.StatusSeeOther)
+
+	return nil
+}
+
+// storeUnavailable answers the errors of the database that make the
+// tasks unusable with a 500. The rest of the errors are left to the
+// caller (nil). "no such table" is the error that SQLite3 produces
+// when some table does not exist, and we have only used it as an
+// example of the errors that can be caught. The user is
+// automatically logged out, since it makes no sense that, if they
+// cannot access the `todos` table, they can access the protected
+// routes. In your application you can handle this situation as
+// best suits you.
+func storeUnavailable(w http.ResponseWriter, err error) error {
+	if !strings.Contains(err.Error(), "no such table") &&
+		!strings.Contains(err.Error(), "database is locked") {
+		return nil
+	}
+
+	message := "error 500: database temporarily out of service"
+	clearCookie(w)
+	w.WriteHeader(http.StatusInternalServerError)
+	return apiError{
+		status:    http.StatusInternalServerError,
+		message:   message,
+		loggedOut: true,
+	}
+}
+
+// todoFragment answers an htmx request that changed a task with the
+// fragment to swap (see todo-fragment) instead of redirecting to the
+// whole list: the row of the task, if any (nothing removes it), and
+// the flash message, swapped out of band. The event (e.g.
+// `todoCreated`, with the ID of the task) is triggered in the
+// browser, so that other parts of the page can react to the change.
+func todoFragment(
+	w http.ResponseWriter, r *http.Request,
+	todo *services.Todo, event string, id int, message string,
+) error {
+	trigger, err := json.Marshal(map[string]any{
+		event: map[string]int{"id": id},
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Trigger", string(trigger))
+
+	data := map[string]any{
+		"succMsg": message,
+	}
+	if todo != nil {
+		data["todo"] = *todo
+	}
+	return render(w, r, "todo-fragment", data)
+}
+
+// todoFragmentError answers an htmx request that could not change a
+// task with the error message alone: nothing else is swapped.
+func todoFragmentError(
+	w http.ResponseWriter, r *http.Request, message string,
+) error {
+	w.Header().Set("HX-Reswap", "none")
+
+	data := map[string]any{
+		"errMsg": message,
+	}
+	return render(w, r, "todo-fragment", data)
+}
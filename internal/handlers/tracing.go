@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/reqctx"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware starts the span of the request, as a child of
+// that of the caller if it sends the W3C trace context (the
+// `traceparent` header), and injects it into the context of the
+// request, so that the spans of the services, the SQL statements and
+// the templates hang from it. The span is named after the pattern of
+// the route (see RouteMiddleware) once the request has been served.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(
+			r.Context(), propagation.HeaderCarrier(r.Header),
+		)
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+				semconv.ClientAddress(r.RemoteAddr),
+				attribute.String("request.id", reqctx.ID(ctx)),
+			),
+		)
+		defer span.End()
+
+		wrapped := &wrappedWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK, // default status
+		}
+
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		req := requestMeta(ctx)
+		if req.Pattern != "" {
+			span.SetName(req.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(req.Pattern))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(wrapped.statusCode))
+		if req.UserID != 0 {
+			span.SetAttributes(semconv.EnduserID(strconv.Itoa(req.UserID)))
+		}
+		if req.Handler != "" {
+			span.SetAttributes(attribute.String("handler", req.Handler))
+		}
+		// The errors of the client (4xx) are not
+		// errors of the server, as for the semantic
+		// conventions of OpenTelemetry
+		if wrapped.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, req.Err)
+		}
+	})
+}
+
+// startSpan starts a span of an internal operation
+// (e.g. a call to a service), child of that of the context.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+
+	return tracing.Tracer().Start(ctx, name)
+}
+
+// endSpan records the error, if any, and ends the span. Not
+// finding a row is a result rather than a failure.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceTaskService wraps the task service so that
+// each call to it is recorded as a span.
+func TraceTaskService(ts TaskService) TaskService {
+
+	return tracedTaskService{next: ts}
+}
+
+// TraceAuthService wraps the user service so that
+// each call to it is recorded as a span.
+func TraceAuthService(us AuthService) AuthService {
+
+	return tracedAuthService{next: us}
+}
+
+// tracedTaskService records a span for each call to the TaskService.
+// It does not embed the interface, so that a method added to it
+// does not build until it is traced too.
+type tracedTaskService struct {
+	next TaskService
+}
+
+var _ TaskService = tracedTaskService{}
+
+func (s tracedTaskService) CreateTodo(ctx context.Context, t services.Todo) (_ services.Todo, err error) {
+	ctx, span := startSpan(ctx, "TaskService.CreateTodo")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CreateTodo(ctx, t)
+}
+
+func (s tracedTaskService) GetAllTodos(ctx context.Context, createdBy int) (_ []services.Todo, err error) {
+	ctx, span := startSpan(ctx, "TaskService.GetAllTodos")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.GetAllTodos(ctx, createdBy)
+}
+
+func (s tracedTaskService) GetTodoById(ctx context.Context, t services.Todo) (_ services.Todo, err error) {
+	ctx, span := startSpan(ctx, "TaskService.GetTodoById")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.GetTodoById(ctx, t)
+}
+
+func (s tracedTaskService) UpdateTodo(ctx context.Context, t services.Todo) (_ services.Todo, err error) {
+	ctx, span := startSpan(ctx, "TaskService.UpdateTodo")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.UpdateTodo(ctx, t)
+}
+
+func (s tracedTaskService) PatchTodo(ctx context.Context, t services.Todo, p services.TodoPatch) (_ services.Todo, err error) {
+	ctx, span := startSpan(ctx, "TaskService.PatchTodo")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.PatchTodo(ctx, t, p)
+}
+
+func (s tracedTaskService) DeleteTodo(ctx context.Context, t services.Todo) (err error) {
+	ctx, span := startSpan(ctx, "TaskService.DeleteTodo")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.DeleteTodo(ctx, t)
+}
+
+func (s tracedTaskService) Batch(ctx context.Context, createdBy int, ids []int, a services.BatchAction) (_ services.BatchResult, err error) {
+	ctx, span := startSpan(ctx, "TaskService.Batch")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.Batch(ctx, createdBy, ids, a)
+}
+
+// tracedAuthService records a span for each call to the AuthService
+// (not embedded either, see tracedTaskService).
+type tracedAuthService struct {
+	next AuthService
+}
+
+var _ AuthService = tracedAuthService{}
+
+func (s tracedAuthService) CreateUser(ctx context.Context, u services.User) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.CreateUser")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CreateUser(ctx, u)
+}
+
+func (s tracedAuthService) CheckEmail(ctx context.Context, email string) (_ services.User, err error) {
+	ctx, span := startSpan(ctx, "AuthService.CheckEmail")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CheckEmail(ctx, email)
+}
+
+func (s tracedAuthService) VerifyPassword(ctx context.Context, u services.User, password string) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "AuthService.VerifyPassword")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.VerifyPassword(ctx, u, password)
+}
+
+func (s tracedAuthService) GetUserById(ctx context.Context, id int) (_ services.User, err error) {
+	ctx, span := startSpan(ctx, "AuthService.GetUserById")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.GetUserById(ctx, id)
+}
+
+func (s tracedAuthService) GetUserByIdentity(ctx context.Context, issuer, subject string) (_ services.User, err error) {
+	ctx, span := startSpan(ctx, "AuthService.GetUserByIdentity")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.GetUserByIdentity(ctx, issuer, subject)
+}
+
+func (s tracedAuthService) LinkIdentity(ctx context.Context, id int, i services.Identity) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.LinkIdentity")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.LinkIdentity(ctx, id, i)
+}
+
+func (s tracedAuthService) CreateSSOUser(ctx context.Context, u services.User, i services.Identity) (_ services.User, err error) {
+	ctx, span := startSpan(ctx, "AuthService.CreateSSOUser")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CreateSSOUser(ctx, u, i)
+}
+
+func (s tracedAuthService) SetTOTPSecret(ctx context.Context, id int, secret string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.SetTOTPSecret")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.SetTOTPSecret(ctx, id, secret)
+}
+
+func (s tracedAuthService) EnableTOTP(ctx context.Context, id int, step int64, codeHashes []string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.EnableTOTP")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.EnableTOTP(ctx, id, step, codeHashes)
+}
+
+func (s tracedAuthService) DisableTOTP(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.DisableTOTP")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.DisableTOTP(ctx, id)
+}
+
+func (s tracedAuthService) SetTOTPLastStep(ctx context.Context, id int, step int64) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.SetTOTPLastStep")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.SetTOTPLastStep(ctx, id, step)
+}
+
+func (s tracedAuthService) ReplaceRecoveryCodes(ctx context.Context, id int, codeHashes []string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.ReplaceRecoveryCodes")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.ReplaceRecoveryCodes(ctx, id, codeHashes)
+}
+
+func (s tracedAuthService) UseRecoveryCode(ctx context.Context, id int, codeHash string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.UseRecoveryCode")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.UseRecoveryCode(ctx, id, codeHash)
+}
+
+func (s tracedAuthService) CountRecoveryCodes(ctx context.Context, id int) (_ int, err error) {
+	ctx, span := startSpan(ctx, "AuthService.CountRecoveryCodes")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CountRecoveryCodes(ctx, id)
+}
+
+func (s tracedAuthService) UpdateUsername(ctx context.Context, id int, username string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.UpdateUsername")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.UpdateUsername(ctx, id, username)
+}
+
+func (s tracedAuthService) UpdatePassword(ctx context.Context, id int, password string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.UpdatePassword")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.UpdatePassword(ctx, id, password)
+}
+
+func (s tracedAuthService) SetTimezone(ctx context.Context, id int, tz string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.SetTimezone")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.SetTimezone(ctx, id, tz)
+}
+
+func (s tracedAuthService) CreateEmailChange(ctx context.Context, id int, newEmail, tokenHash string, expiresAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.CreateEmailChange")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CreateEmailChange(ctx, id, newEmail, tokenHash, expiresAt)
+}
+
+func (s tracedAuthService) ConfirmEmailChange(ctx context.Context, tokenHash string) (_ services.User, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ConfirmEmailChange")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.ConfirmEmailChange(ctx, tokenHash)
+}
+
+func (s tracedAuthService) AddLoginEvent(ctx context.Context, e services.LoginEvent) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.AddLoginEvent")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.AddLoginEvent(ctx, e)
+}
+
+func (s tracedAuthService) ExportUserData(ctx context.Context, id int) (_ services.UserExport, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ExportUserData")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.ExportUserData(ctx, id)
+}
+
+func (s tracedAuthService) ScheduleDeletion(ctx context.Context, id int, deleteAfter time.Time) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.ScheduleDeletion")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.ScheduleDeletion(ctx, id, deleteAfter)
+}
+
+func (s tracedAuthService) CancelDeletion(ctx context.Context, id int) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "AuthService.CancelDeletion")
+	defer func() { endSpan(span, err) }()
+
+	return s.next.CancelDeletion(ctx, id)
+}
@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/services"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/encrypt"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/jwt"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/totp"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/upper"
+)
+
+// Number of one-time recovery codes generated for each user.
+const recoveryCodesCount = 10
+
+func (ah *AuthHandle) loginTwoFactorHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	if _, err := mfaClaims(r); err != nil {
+		fm := []byte("Your session has expired, please log in again")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	errMsg, succMsg := GetMessages(w, r)
+
+	data := map[string]any{
+		"title":         "| Two-Factor Authentication",
+		"fromProtected": requestFromProtected(r.Context()),
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "login_2fa.tmpl", data)
+}
+
+func (ah *AuthHandle) loginTwoFactorPostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	claims, err := mfaClaims(r)
+	if err != nil {
+		fm := []byte("Your session has expired, please log in again")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := ah.userService.GetUserById(r.Context(), claims.Id)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	// The codes are guessed as easily as the passwords,
+	// so the same throttling applies to them
+	wait, err := ah.loginRetryAfter(r, user.Email)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if wait > 0 {
+		fm := []byte(fmt.Sprintf(
+			"Too many failed attempts, please try again in %s",
+			humanizeDuration(wait),
+		))
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	if !ah.verifySecondFactor(r, user.ID, user.TOTPSecret, user.TOTPLastStep,
+		r.FormValue("code")) {
+		if _, err := ah.loginFailed(r, user.Email, &user, "2fa"); err != nil {
+			message := "error 500: database temporarily out of service"
+			return serverError(w, message)
+		}
+
+		fm := []byte("Invalid authentication code")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := ah.loginSucceeded(r, user.Email); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	clearMFACookie(w)
+
+	restored, err := startSession(w, r, ah.userService, ah.cfg.TrustProxy,
+		user, claims.Tzone, "2fa")
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not start the session: %s", err)
+		return serverError(w, message)
+	}
+
+	SetFlash(w, "success", loginMessage(restored))
+
+	http.Redirect(w, r, "/todo", http.StatusSeeOther)
+
+	return nil
+}
+
+// verifySecondFactor accepts either a TOTP code (6 digits)
+// or one of the unused recovery codes of the user.
+func (ah *AuthHandle) verifySecondFactor(
+	r *http.Request, id int, encSecret string, lastStep int64, code string,
+) bool {
+	code = strings.TrimSpace(code)
+
+	if len(strings.ReplaceAll(code, " ", "")) == totp.Digits {
+		secret, err := encrypt.Open(ah.cfg.EncryptionKey, encSecret)
+		if err != nil {
+			return false
+		}
+
+		step, ok := totp.Validate(secret, code, time.Now(), lastStep)
+		if !ok {
+			return false
+		}
+
+		return ah.userService.SetTOTPLastStep(r.Context(), id, step) == nil
+	}
+
+	return ah.userService.UseRecoveryCode(r.Context(), id, hashRecoveryCode(code)) == nil
+}
+
+func (ah *AuthHandle) securityHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	errMsg, succMsg := GetMessages(w, r)
+
+	user, err := ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	codesLeft, err := ah.userService.CountRecoveryCodes(r.Context(), user.ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Security Settings",
+		"fromProtected": true,
+		"tab":           "security",
+		"username":      upper.Cap(user.Username),
+		"totpEnabled":   user.TOTPEnabled,
+		"codesLeft":     codesLeft,
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "settings_security.tmpl", data)
+}
+
+func (ah *AuthHandle) totpSetupHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	errMsg, succMsg := GetMessages(w, r)
+
+	user, err := ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	if user.TOTPEnabled {
+		fm := []byte("Two-factor authentication is already enabled")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+		return nil
+	}
+
+	// The pending secret is reused so that reloading the page
+	// does not invalidate a QR code that has already been scanned.
+	var secret string
+	if user.TOTPSecret != "" {
+		secret, err = encrypt.Open(ah.cfg.EncryptionKey, user.TOTPSecret)
+	}
+	if user.TOTPSecret == "" || err != nil {
+		secret, err = totp.GenerateSecret()
+		if err != nil {
+			message := fmt.Sprintf("error 500: could not generate secret: %s", err)
+			return serverError(w, message)
+		}
+
+		encSecret, err := encrypt.Seal(ah.cfg.EncryptionKey, secret)
+		if err != nil {
+			message := fmt.Sprintf("error 500: could not encrypt secret: %s", err)
+			return serverError(w, message)
+		}
+
+		if err := ah.userService.SetTOTPSecret(r.Context(), user.ID, encSecret); err != nil {
+			message := "error 500: database temporarily out of service"
+			return serverError(w, message)
+		}
+	}
+
+	qrCode, err := totp.QRCodeSVG(totp.KeyURI(ah.cfg.AppName, user.Email, secret))
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not render QR code: %s", err)
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Enable Two-Factor Authentication",
+		"fromProtected": true,
+		"username":      upper.Cap(user.Username),
+		"qrCode":        qrCode,
+		"secret":        groupChars(secret, 4),
+		"errMsg":        errMsg,
+		"succMsg":       succMsg,
+	}
+	return render(w, r, "totp_setup.tmpl", data)
+}
+
+func (ah *AuthHandle) totpSetupPostHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	user, err := ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+		return nil
+	}
+
+	secret, err := encrypt.Open(ah.cfg.EncryptionKey, user.TOTPSecret)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not decrypt secret: %s", err)
+		return serverError(w, message)
+	}
+
+	step, ok := totp.Validate(secret, r.FormValue("code"), time.Now(), 0)
+	if !ok {
+		fm := []byte("Invalid authentication code, please try again")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/2fa/setup", http.StatusSeeOther)
+		return nil
+	}
+
+	codes, hashes, err := generateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not generate codes: %s", err)
+		return serverError(w, message)
+	}
+
+	if err := ah.userService.EnableTOTP(r.Context(), user.ID, step, hashes); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Recovery Codes",
+		"fromProtected": true,
+		"username":      upper.Cap(user.Username),
+		"codes":         codes,
+		"succMsg":       "Two-factor authentication successfully enabled!!",
+	}
+	return render(w, r, "recovery_codes.tmpl", data)
+}
+
+func (ah *AuthHandle) totpDisableHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	user, ok, err := ah.confirmPassword(r)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if !ok {
+		fm := []byte("Incorrect password")
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := ah.userService.DisableTOTP(r.Context(), user.ID); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	fm := []byte("Two-factor authentication successfully disabled!!")
+	SetFlash(w, "success", fm)
+
+	http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+
+	return nil
+}
+
+func (ah *AuthHandle) recoveryCodesHandle(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	user, ok, err := ah.confirmPassword(r)
+	if err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+	if !ok || !user.TOTPEnabled {
+		fm := []byte("Incorrect password")
+		if ok {
+			fm = []byte("Two-factor authentication is not enabled")
+		}
+		SetFlash(w, "error", fm)
+
+		http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+		return nil
+	}
+
+	codes, hashes, err := generateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		message := fmt.Sprintf("error 500: could not generate codes: %s", err)
+		return serverError(w, message)
+	}
+
+	if err := ah.userService.ReplaceRecoveryCodes(r.Context(), user.ID, hashes); err != nil {
+		message := "error 500: database temporarily out of service"
+		return serverError(w, message)
+	}
+
+	data := map[string]any{
+		"title":         "| Recovery Codes",
+		"fromProtected": true,
+		"username":      upper.Cap(user.Username),
+		"codes":         codes,
+		"succMsg":       "New recovery codes successfully generated!!",
+	}
+	return render(w, r, "recovery_codes.tmpl", data)
+}
+
+// confirmPassword checks the `password` field of the form
+// against the password of the authenticated user.
+func (ah *AuthHandle) confirmPassword(
+	r *http.Request,
+) (user services.User, ok bool, err error) {
+	user, err = ah.userService.GetUserById(r.Context(), requestUserData(r.Context()).ID)
+	if err != nil {
+		return user, false, err
+	}
+
+	ok, err = ah.userService.VerifyPassword(r.Context(), user, r.FormValue("password"))
+
+	return user, ok, err
+}
+
+// mfaClaims retrieves the claims of the pending
+// second step of the login from its cookie.
+func mfaClaims(r *http.Request) (*jwt.MFAClaims, error) {
+	cookie, err := r.Cookie("mfa")
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.ParseMFAToken(cookie.Value)
+}
+
+// clearMFACookie deletes the cookie of the second step of the login.
+func clearMFACookie(w http.ResponseWriter) {
+	dc := &http.Cookie{
+		Name:    "mfa",
+		Path:    "/login",
+		MaxAge:  -1,
+		Expires: time.Unix(1, 0),
+	}
+	http.SetCookie(w, dc)
+}
+
+// generateRecoveryCodes returns n random codes (in the format
+// `xxxxx-xxxxx`) to show to the user and the hashes to store.
+func generateRecoveryCodes(n int) ([]string, []string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, 0, n)
+	hashes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		c := strings.ToLower(enc.EncodeToString(b))[:10]
+		code := c[:5] + "-" + c[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes the code as typed by the user
+// and returns its SHA-256 hash. Since the codes are random,
+// a fast hash is enough to protect them at rest.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// groupChars separates the string into groups
+// of n characters to make it easier to read.
+func groupChars(s string, n int) string {
+	var sb strings.Builder
+	for i, r := range s {
+		if i > 0 && i%n == 0 {
+			sb.WriteRune(' ')
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
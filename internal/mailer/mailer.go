@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text emails to the users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends the emails through an SMTP server
+// (STARTTLS is used automatically if the server supports it).
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		from: from,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	// Header injection is not possible through the recipient
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + m.from + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg.String()))
+}
+
+// LogMailer writes the emails to the log instead of sending
+// them. It is used in development, when SMTP is not configured.
+type LogMailer struct {
+	l *slog.Logger
+}
+
+func NewLogMailer(l *slog.Logger) *LogMailer {
+	return &LogMailer{l}
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.l.Info("📧 Mailer Info: email not sent (SMTP not configured)",
+		"to", to,
+		"subject", subject,
+		"body", body,
+	)
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit trail.
+const (
+	ActionDisable       = "disable"
+	ActionEnable        = "enable"
+	ActionResetPassword = "reset_password"
+	ActionSetRole       = "set_role"
+)
+
+// AuditEntry is an action of an administrator on a user account.
+// The emails are copied so that the entry remains
+// meaningful after the accounts are deleted.
+type AuditEntry struct {
+	ID          int       `json:"id"`
+	AdminID     int       `json:"admin_id"`
+	AdminEmail  string    `json:"admin_email"`
+	Action      string    `json:"action"`
+	TargetID    int       `json:"target_id"`
+	TargetEmail string    `json:"target_email"`
+	Details     string    `json:"details"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Stats are the aggregate usage figures shown to the administrators.
+type Stats struct {
+	Users            int
+	Admins           int
+	DisabledUsers    int
+	PendingDeletions int
+	TOTPUsers        int
+	PasskeyUsers     int
+	SSOUsers         int
+	ActiveUsers      int // logged in during the last 30 days
+	Todos            int
+	CompletedTodos   int
+	Logins           int // during the last 24 hours
+	FailedLogins     int // during the last 24 hours
+}
+
+type AdminService struct {
+	AuditEntry AuditEntry
+	AdminStore *sql.DB
+}
+
+func NewAdminService(a AuditEntry, aStore *sql.DB) *AdminService {
+
+	return &AdminService{
+		AuditEntry: a,
+		AdminStore: aStore,
+	}
+}
+
+// SearchUsers returns a page of the users whose email or username
+// contains the query (all of them if it is empty), and the total
+// number of matching users.
+func (as *AdminService) SearchUsers(
+	ctx context.Context, query string, limit, offset int,
+) ([]User, int, error) {
+	// The wildcards typed by the admin are taken literally
+	pattern := "%" + strings.NewReplacer(
+		`\`, `\\`, `%`, `\%`, `_`, `\_`,
+	).Replace(query) + "%"
+
+	var total int
+	err := as.AdminStore.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM users
+		WHERE email LIKE ? ESCAPE '\' OR username LIKE ? ESCAPE '\'`,
+		pattern, pattern,
+	).Scan(&total)
+	if err != nil {
+		return []User{}, 0, err
+	}
+
+	rows, err := as.AdminStore.QueryContext(ctx,
+		`SELECT id, email, username, totp_enabled, role, disabled,
+		must_reset_password FROM users
+		WHERE email LIKE ? ESCAPE '\' OR username LIKE ? ESCAPE '\'
+		ORDER BY id LIMIT ? OFFSET ?`,
+		pattern, pattern, limit, offset,
+	)
+	if err != nil {
+		return []User{}, 0, err
+	}
+	// We close the resource
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		err := rows.Scan(
+			&u.ID,
+			&u.Email,
+			&u.Username,
+			&u.TOTPEnabled,
+			&u.Role,
+			&u.Disabled,
+			&u.MustResetPassword,
+		)
+		if err != nil {
+			return []User{}, 0, err
+		}
+
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return []User{}, 0, err
+	}
+
+	return users, total, nil
+}
+
+// SetDisabled disables (or enables again) the account of the target.
+func (as *AdminService) SetDisabled(ctx context.Context, e AuditEntry, disabled bool) error {
+	e.Action = ActionEnable
+	if disabled {
+		e.Action = ActionDisable
+	}
+
+	return as.applyAction(
+		ctx, e, `UPDATE users SET disabled = ? WHERE id = ?`, disabled, e.TargetID,
+	)
+}
+
+// ForcePasswordReset requires the target to change
+// their password the next time they log in.
+func (as *AdminService) ForcePasswordReset(ctx context.Context, e AuditEntry) error {
+	e.Action = ActionResetPassword
+
+	return as.applyAction(
+		ctx, e, `UPDATE users SET must_reset_password = TRUE WHERE id = ?`, e.TargetID,
+	)
+}
+
+func (as *AdminService) SetRole(ctx context.Context, e AuditEntry, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return errors.New("unknown role")
+	}
+
+	e.Action = ActionSetRole
+	e.Details = role
+
+	return as.applyAction(
+		ctx, e, `UPDATE users SET role = ? WHERE id = ?`, role, e.TargetID,
+	)
+}
+
+// applyAction executes the statement on the target user and
+// records it in the audit trail, in a single transaction.
+func (as *AdminService) applyAction(
+	ctx context.Context, e AuditEntry, stmt string, args ...any,
+) error {
+	tx, err := as.AdminStore.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	if i, err := result.RowsAffected(); err != nil || i != 1 {
+		return errors.New("an affected row was expected")
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO admin_audit(admin_id, admin_email, action, target_id,
+		target_email, details, ip) VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		e.AdminID,
+		e.AdminEmail,
+		e.Action,
+		e.TargetID,
+		e.TargetEmail,
+		e.Details,
+		e.IP,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (as *AdminService) GetAuditLog(ctx context.Context, limit, offset int) ([]AuditEntry, error) {
+	rows, err := as.AdminStore.QueryContext(ctx,
+		`SELECT id, admin_id, admin_email, action, target_id, target_email,
+		details, ip, created_at FROM admin_audit
+		ORDER BY id DESC LIMIT ? OFFSET ?`,
+		limit, offset,
+	)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	// We close the resource
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		err := rows.Scan(
+			&e.ID,
+			&e.AdminID,
+			&e.AdminEmail,
+			&e.Action,
+			&e.TargetID,
+			&e.TargetEmail,
+			&e.Details,
+			&e.IP,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return []AuditEntry{}, err
+		}
+
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return []AuditEntry{}, err
+	}
+
+	return entries, nil
+}
+
+func (as *AdminService) GetStats(ctx context.Context) (Stats, error) {
+	query := `SELECT
+		(SELECT COUNT(*) FROM users),
+		(SELECT COUNT(*) FROM users WHERE role = 'admin'),
+		(SELECT COUNT(*) FROM users WHERE disabled),
+		(SELECT COUNT(*) FROM users WHERE delete_after > 0),
+		(SELECT COUNT(*) FROM users WHERE totp_enabled),
+		(SELECT COUNT(DISTINCT user_id) FROM passkeys),
+		(SELECT COUNT(DISTINCT user_id) FROM user_identities),
+		(SELECT COUNT(DISTINCT user_id) FROM login_events
+			WHERE success AND created_at >= datetime('now', '-30 days')),
+		(SELECT COUNT(*) FROM todos),
+		(SELECT COUNT(*) FROM todos WHERE status),
+		(SELECT COUNT(*) FROM login_events
+			WHERE success AND created_at >= datetime('now', '-1 day')),
+		(SELECT COUNT(*) FROM login_events
+			WHERE NOT success AND created_at >= datetime('now', '-1 day'))`
+
+	var s Stats
+	err := as.AdminStore.QueryRowContext(ctx, query).Scan(
+		&s.Users,
+		&s.Admins,
+		&s.DisabledUsers,
+		&s.PendingDeletions,
+		&s.TOTPUsers,
+		&s.PasskeyUsers,
+		&s.SSOUsers,
+		&s.ActiveUsers,
+		&s.Todos,
+		&s.CompletedTodos,
+		&s.Logins,
+		&s.FailedLogins,
+	)
+
+	return s, err
+}
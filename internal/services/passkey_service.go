@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type Passkey struct {
+	ID           int          `json:"id"`
+	UserID       int          `json:"user_id"`
+	CredentialID string       `json:"credential_id"`
+	PublicKey    []byte       `json:"-"`
+	SignCount    uint32       `json:"sign_count"`
+	Name         string       `json:"name"`
+	CreatedAt    time.Time    `json:"created_at"`
+	LastUsedAt   sql.NullTime `json:"-"`
+}
+
+// Challenge is a pending WebAuthn ceremony (registration
+// or authentication) identified by a random ID.
+type Challenge struct {
+	ID        string
+	UserID    int
+	Ceremony  string
+	Challenge string
+	ExpiresAt time.Time
+}
+
+type PasskeyService struct {
+	Passkey      Passkey
+	PasskeyStore *sql.DB
+}
+
+func NewPasskeyService(p Passkey, pStore *sql.DB) *PasskeyService {
+
+	return &PasskeyService{
+		Passkey:      p,
+		PasskeyStore: pStore,
+	}
+}
+
+func (ps *PasskeyService) CreateChallenge(ctx context.Context, c Challenge) error {
+	// Expired challenges are removed on the fly
+	_, err := ps.PasskeyStore.ExecContext(ctx,
+		`DELETE FROM webauthn_challenges WHERE expires_at < ?`,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO webauthn_challenges(id, user_id, ceremony,
+		challenge, expires_at) VALUES(?, ?, ?, ?, ?)`
+
+	_, err = ps.PasskeyStore.ExecContext(ctx,
+		stmt,
+		c.ID,
+		c.UserID,
+		c.Ceremony,
+		c.Challenge,
+		c.ExpiresAt.Unix(),
+	)
+
+	return err
+}
+
+// ConsumeChallenge retrieves and deletes the challenge so
+// that it cannot be used twice. Expired challenges are rejected.
+func (ps *PasskeyService) ConsumeChallenge(
+	ctx context.Context, id, ceremony string,
+) (Challenge, error) {
+	query := `DELETE FROM webauthn_challenges WHERE id = ? AND ceremony = ?
+		RETURNING id, user_id, ceremony, challenge, expires_at`
+
+	var c Challenge
+	var expiresAt int64
+	err := ps.PasskeyStore.QueryRowContext(ctx, query, id, ceremony).Scan(
+		&c.ID,
+		&c.UserID,
+		&c.Ceremony,
+		&c.Challenge,
+		&expiresAt,
+	)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	c.ExpiresAt = time.Unix(expiresAt, 0)
+	if time.Now().After(c.ExpiresAt) {
+		return Challenge{}, errors.New("challenge expired")
+	}
+
+	return c, nil
+}
+
+func (ps *PasskeyService) CreatePasskey(ctx context.Context, p Passkey) error {
+	stmt := `INSERT INTO passkeys(user_id, credential_id, public_key,
+		sign_count, name) VALUES(?, ?, ?, ?, ?)`
+
+	_, err := ps.PasskeyStore.ExecContext(ctx,
+		stmt,
+		p.UserID,
+		p.CredentialID,
+		p.PublicKey,
+		p.SignCount,
+		p.Name,
+	)
+
+	return err
+}
+
+func (ps *PasskeyService) GetPasskeyByCredentialId(
+	ctx context.Context, credentialID string,
+) (Passkey, error) {
+	query := `SELECT id, user_id, credential_id, public_key, sign_count,
+		name, created_at, last_used_at FROM passkeys WHERE credential_id = ?`
+
+	stmt, err := ps.PasskeyStore.PrepareContext(ctx, query)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	defer stmt.Close()
+
+	var p Passkey
+	err = stmt.QueryRowContext(ctx, credentialID).Scan(
+		&p.ID,
+		&p.UserID,
+		&p.CredentialID,
+		&p.PublicKey,
+		&p.SignCount,
+		&p.Name,
+		&p.CreatedAt,
+		&p.LastUsedAt,
+	)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	return p, nil
+}
+
+func (ps *PasskeyService) GetAllPasskeys(ctx context.Context, userID int) ([]Passkey, error) {
+	query := `SELECT id, user_id, credential_id, public_key, sign_count,
+		name, created_at, last_used_at FROM passkeys
+		WHERE user_id = ? ORDER BY created_at DESC`
+
+	rows, err := ps.PasskeyStore.QueryContext(ctx, query, userID)
+	if err != nil {
+		return []Passkey{}, err
+	}
+	// We close the resource
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var p Passkey
+		err := rows.Scan(
+			&p.ID,
+			&p.UserID,
+			&p.CredentialID,
+			&p.PublicKey,
+			&p.SignCount,
+			&p.Name,
+			&p.CreatedAt,
+			&p.LastUsedAt,
+		)
+		if err != nil {
+			continue
+		}
+
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, nil
+}
+
+// UpdateSignCount stores the new signature counter
+// after a successful authentication.
+func (ps *PasskeyService) UpdateSignCount(ctx context.Context, id int, signCount uint32) error {
+	stmt := `UPDATE passkeys SET sign_count = ?,
+		last_used_at = CURRENT_TIMESTAMP WHERE id = ?`
+
+	_, err := ps.PasskeyStore.ExecContext(ctx, stmt, signCount, id)
+
+	return err
+}
+
+func (ps *PasskeyService) DeletePasskey(ctx context.Context, p Passkey) error {
+	stmt := `DELETE FROM passkeys WHERE user_id = ? AND id = ?`
+
+	result, err := ps.PasskeyStore.ExecContext(ctx, stmt, p.UserID, p.ID)
+	if err != nil {
+		return err
+	}
+
+	if i, err := result.RowsAffected(); err != nil || i != 1 {
+		return errors.New("an affected row was expected")
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/ratelimit"
+)
+
+// RateBucket is the state of a rate-limited key: its theoretical
+// arrival time (see ratelimit.Limit), stored in nanoseconds.
+type RateBucket struct {
+	Key string
+	TAT time.Time
+}
+
+// RateLimitService is the store of the rate limiter shared by
+// several processes (ratelimit.Store), backed by the database.
+type RateLimitService struct {
+	RateBucket     RateBucket
+	RateLimitStore *sql.DB
+}
+
+func NewRateLimitService(b RateBucket, rlStore *sql.DB) *RateLimitService {
+
+	return &RateLimitService{
+		RateBucket:     b,
+		RateLimitStore: rlStore,
+	}
+}
+
+// Allow applies the algorithm of ratelimit.Limit.Next in a single
+// statement, so that concurrent requests cannot both take
+// the last token: the row is only updated (and returned) if
+// the request is allowed.
+func (rls *RateLimitService) Allow(
+	ctx context.Context, key string, l ratelimit.Limit, now time.Time,
+) (time.Duration, error) {
+	stmt := `INSERT INTO rate_limits(key, tat) VALUES(?1, ?2 + ?3)
+		ON CONFLICT(key) DO UPDATE SET tat = MAX(tat, ?2) + ?3
+			WHERE MAX(tat, ?2) + ?3 - ?4 <= ?2
+		RETURNING tat`
+
+	interval, tolerance := l.Interval(), l.Tolerance()
+
+	var tat int64
+	err := rls.RateLimitStore.QueryRowContext(ctx,
+		stmt, key, now.UnixNano(), interval.Nanoseconds(), tolerance.Nanoseconds(),
+	).Scan(&tat)
+	if err == nil {
+		return 0, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// Denied: the wait is computed from the current state
+	err = rls.RateLimitStore.QueryRowContext(ctx,
+		`SELECT tat FROM rate_limits WHERE key = ?`, key,
+	).Scan(&tat)
+	if err != nil {
+		return 0, err
+	}
+
+	_, retryAfter := l.Next(time.Unix(0, tat), now)
+	if retryAfter <= 0 {
+		// The bucket has been refilled in the meantime
+		retryAfter = time.Millisecond
+	}
+
+	return retryAfter, nil
+}
+
+// PurgeRateLimits deletes the keys whose bucket is full again,
+// which are equivalent to the absent ones.
+func (rls *RateLimitService) PurgeRateLimits(ctx context.Context, now time.Time) error {
+	stmt := `DELETE FROM rate_limits WHERE tat < ?`
+
+	_, err := rls.RateLimitStore.ExecContext(ctx, stmt, now.UnixNano())
+
+	return err
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrUnlockTokenExpired = errors.New("unlock token expired")
+
+// Throttle counts the consecutive failed logins for a key
+// (an account or an IP address).
+type Throttle struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type ThrottleService struct {
+	Throttle      Throttle
+	ThrottleStore *sql.DB
+}
+
+func NewThrottleService(t Throttle, tStore *sql.DB) *ThrottleService {
+
+	return &ThrottleService{
+		Throttle:      t,
+		ThrottleStore: tStore,
+	}
+}
+
+// GetThrottle returns the failures registered for the key
+// (none if there is no row for it).
+func (ts *ThrottleService) GetThrottle(ctx context.Context, key string) (Throttle, error) {
+	query := `SELECT key, failures, last_failure, locked_until
+		FROM login_throttle WHERE key = ?`
+
+	var lastFailure, lockedUntil int64
+	t := Throttle{Key: key}
+	err := ts.ThrottleStore.QueryRowContext(ctx, query, key).Scan(
+		&t.Key,
+		&t.Failures,
+		&lastFailure,
+		&lockedUntil,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, nil
+	}
+	if err != nil {
+		return Throttle{}, err
+	}
+
+	t.LastFailure = time.Unix(lastFailure, 0)
+	t.LockedUntil = time.Unix(lockedUntil, 0)
+
+	return t, nil
+}
+
+// AddFailure registers a failed login for the key. The count
+// starts again if the previous failure is older than `window`.
+func (ts *ThrottleService) AddFailure(
+	ctx context.Context, key string, window time.Duration,
+) (Throttle, error) {
+	stmt := `INSERT INTO login_throttle(key, failures, last_failure)
+		VALUES(?, 1, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END,
+			last_failure = excluded.last_failure
+		RETURNING failures, last_failure, locked_until`
+
+	now := time.Now()
+	var lastFailure, lockedUntil int64
+	t := Throttle{Key: key}
+	err := ts.ThrottleStore.QueryRowContext(ctx,
+		stmt, key, now.Unix(), now.Add(-window).Unix(),
+	).Scan(&t.Failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		return Throttle{}, err
+	}
+
+	t.LastFailure = time.Unix(lastFailure, 0)
+	t.LockedUntil = time.Unix(lockedUntil, 0)
+
+	return t, nil
+}
+
+func (ts *ThrottleService) LockThrottle(ctx context.Context, key string, until time.Time) error {
+	stmt := `UPDATE login_throttle SET locked_until = ? WHERE key = ?`
+
+	_, err := ts.ThrottleStore.ExecContext(ctx, stmt, until.Unix(), key)
+
+	return err
+}
+
+// ResetThrottle forgets the failures of the key
+// (after a successful login or an unlock).
+func (ts *ThrottleService) ResetThrottle(ctx context.Context, key string) error {
+	stmt := `DELETE FROM login_throttle WHERE key = ?`
+
+	_, err := ts.ThrottleStore.ExecContext(ctx, stmt, key)
+
+	return err
+}
+
+func (ts *ThrottleService) CreateUnlockToken(
+	ctx context.Context, userID int, tokenHash string, expiresAt time.Time,
+) error {
+	// Expired tokens are removed on the fly
+	_, err := ts.ThrottleStore.ExecContext(ctx,
+		`DELETE FROM unlock_tokens WHERE expires_at < ?`,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO unlock_tokens(token_hash, user_id, expires_at)
+		VALUES(?, ?, ?)`
+
+	_, err = ts.ThrottleStore.ExecContext(ctx, stmt, tokenHash, userID, expiresAt.Unix())
+
+	return err
+}
+
+// ConsumeUnlockToken deletes the token so that it cannot be used
+// twice and returns the ID of its user. Expired tokens are rejected.
+func (ts *ThrottleService) ConsumeUnlockToken(ctx context.Context, tokenHash string) (int, error) {
+	query := `DELETE FROM unlock_tokens WHERE token_hash = ?
+		RETURNING user_id, expires_at`
+
+	var userID int
+	var expiresAt int64
+	err := ts.ThrottleStore.QueryRowContext(ctx, query, tokenHash).Scan(&userID, &expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	if time.Now().After(time.Unix(expiresAt, 0)) {
+		return 0, ErrUnlockTokenExpired
+	}
+
+	return userID, nil
+}
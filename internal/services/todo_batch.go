@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Actions of TodoService.Batch.
+const (
+	BatchComplete = "complete"
+	BatchReopen   = "reopen"
+	BatchDelete   = "delete"
+	BatchMove     = "move"
+	BatchTag      = "tag"
+	BatchUntag    = "untag"
+)
+
+// BatchAction is an action on several tasks at once. Every action
+// sets a state (e.g. completed, in a list, with a tag) rather than
+// inverting it, so that it can be repeated and, except for the
+// deletion, undone with the opposite one on the changed tasks.
+type BatchAction struct {
+	Kind string
+	// List is the list to move the tasks to (BatchMove), created
+	// if it does not exist yet; empty takes them out of any list.
+	List string
+	// Tag is the tag to add or remove (BatchTag and BatchUntag).
+	Tag string
+}
+
+// BatchResult tells which of the tasks were changed by the batch.
+// The rest were already as asked, or are not of the user.
+type BatchResult struct {
+	Changed []int
+}
+
+// Batch applies the action to the tasks of the user with the
+// given IDs in a single transaction: either all of them are
+// changed, or none (if an error is returned).
+func (ts *TodoService) Batch(
+	ctx context.Context, createdBy int, ids []int, a BatchAction,
+) (BatchResult, error) {
+	tx, err := ts.TodoStore.BeginTx(ctx, nil)
+	if err != nil {
+		return BatchResult{}, err
+	}
+
+	defer tx.Rollback()
+
+	// Each statement only matches the tasks that are not as asked,
+	// so that the affected rows are the changed tasks. The first
+	// two parameters are always the user and the task.
+	var (
+		query string
+		arg   any
+	)
+	switch a.Kind {
+	case BatchComplete:
+		query = `UPDATE todos SET status = TRUE
+			WHERE created_by = ? AND id = ? AND NOT status`
+	case BatchReopen:
+		query = `UPDATE todos SET status = FALSE
+			WHERE created_by = ? AND id = ? AND status`
+	case BatchDelete:
+		query = `DELETE FROM todos WHERE created_by = ? AND id = ?`
+	case BatchMove:
+		var listID sql.NullInt64
+		if a.List != "" {
+			if listID.Int64, err = ensureList(ctx, tx, createdBy, a.List); err != nil {
+				return BatchResult{}, err
+			}
+			listID.Valid = true
+		}
+		query = `UPDATE todos SET list_id = ?3
+			WHERE created_by = ?1 AND id = ?2 AND list_id IS NOT ?3`
+		arg = listID
+	case BatchTag:
+		query = `INSERT OR IGNORE INTO todo_tags (todo_id, tag)
+			SELECT id, ?3 FROM todos WHERE created_by = ?1 AND id = ?2`
+		arg = a.Tag
+	case BatchUntag:
+		query = `DELETE FROM todo_tags WHERE tag = ?3 AND todo_id IN
+			(SELECT id FROM todos WHERE created_by = ?1 AND id = ?2)`
+		arg = a.Tag
+	default:
+		return BatchResult{}, fmt.Errorf("unknown batch action %q", a.Kind)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return BatchResult{}, err
+	}
+
+	defer stmt.Close()
+
+	result := BatchResult{Changed: []int{}}
+	for _, id := range ids {
+		args := []any{createdBy, id}
+		if arg != nil {
+			args = append(args, arg)
+		}
+
+		res, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return BatchResult{}, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return BatchResult{}, err
+		}
+		if n > 0 {
+			result.Changed = append(result.Changed, id)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BatchResult{}, err
+	}
+
+	return result, nil
+}
+
+// ensureList returns the ID of the list of the user with
+// the given name, creating it if it does not exist.
+func ensureList(
+	ctx context.Context, tx *sql.Tx, createdBy int, name string,
+) (int64, error) {
+	_, err := tx.ExecContext(ctx,
+		`INSERT OR IGNORE INTO lists (created_by, name) VALUES(?, ?)`,
+		createdBy, name,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT id FROM lists WHERE created_by = ? AND name = ?`,
+		createdBy, name,
+	).Scan(&id)
+
+	return id, err
+}
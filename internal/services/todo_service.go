@@ -1,9 +1,12 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -14,6 +17,33 @@ type Todo struct {
 	Description string    `json:"description,omitempty"`
 	Status      bool      `json:"status,omitempty"`
 	CreatedAt   time.Time `json:"created_at,omitempty"`
+	List        string    `json:"list,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+// todoLabels selects the name of the list of a task (`t`, joined
+// with its list as `l`) and its tags, separated by commas.
+const todoLabels = `COALESCE(l.name, ''),
+	COALESCE((SELECT group_concat(tag, ',') FROM todo_tags WHERE todo_id = t.id), '')`
+
+// splitTags splits the tags selected by todoLabels, in order.
+func splitTags(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	tags := strings.Split(s, ",")
+	sort.Strings(tags)
+
+	return tags
+}
+
+// TodoPatch is a partial update of a task: only
+// the fields that are not nil are changed.
+type TodoPatch struct {
+	Title       *string
+	Description *string
+	Status      *bool
 }
 
 type TodoService struct {
@@ -28,29 +58,31 @@ func NewTodoService(t Todo, tStore *sql.DB) *TodoService {
 		TodoStore: tStore,
 	}
 }
-func (ts *TodoService) CreateTodo(t Todo) (Todo, error) {
+func (ts *TodoService) CreateTodo(ctx context.Context, t Todo) (Todo, error) {
 
 	query := `INSERT INTO todos (created_by, title, description)
-		VALUES(?, ?, ?) RETURNING *`
+		VALUES(?, ?, ?)
+		RETURNING id, created_by, title, description, status, created_at`
 
-	stmt, err := ts.TodoStore.Prepare(query)
+	stmt, err := ts.TodoStore.PrepareContext(ctx, query)
 	if err != nil {
 		return Todo{}, err
 	}
 
 	defer stmt.Close()
 
-	err = stmt.QueryRow(
+	var todo Todo
+	err = stmt.QueryRowContext(ctx,
 		t.CreatedBy,
 		t.Title,
 		t.Description,
 	).Scan(
-		&ts.Todo.ID,
-		&ts.Todo.CreatedBy,
-		&ts.Todo.Title,
-		&ts.Todo.Description,
-		&ts.Todo.Status,
-		&ts.Todo.CreatedAt,
+		&todo.ID,
+		&todo.CreatedBy,
+		&todo.Title,
+		&todo.Description,
+		&todo.Status,
+		&todo.CreatedAt,
 	)
 	if err != nil {
 		return Todo{}, err
@@ -60,13 +92,15 @@ func (ts *TodoService) CreateTodo(t Todo) (Todo, error) {
 		return errors.New("error: an affected row was expected")
 	} */
 
-	return ts.Todo, nil
+	return todo, nil
 }
 
-func (ts *TodoService) GetAllTodos(createdBy int) ([]Todo, error) {
-	query := fmt.Sprintf("SELECT id, title, status FROM todos WHERE created_by = %d ORDER BY created_at DESC", createdBy)
+func (ts *TodoService) GetAllTodos(ctx context.Context, createdBy int) ([]Todo, error) {
+	query := fmt.Sprintf(`SELECT t.id, t.title, t.status, %s
+		FROM todos t LEFT JOIN lists l ON l.id = t.list_id
+		WHERE t.created_by = %d ORDER BY t.created_at DESC`, todoLabels, createdBy)
 
-	rows, err := ts.TodoStore.Query(query)
+	rows, err := ts.TodoStore.QueryContext(ctx, query)
 	if err != nil {
 		return []Todo{}, err
 	}
@@ -75,90 +109,141 @@ func (ts *TodoService) GetAllTodos(createdBy int) ([]Todo, error) {
 
 	todos := []Todo{}
 	for rows.Next() {
-		err := rows.Scan(&ts.Todo.ID, &ts.Todo.Title, &ts.Todo.Status)
+		var (
+			todo Todo
+			tags string
+		)
+		err := rows.Scan(&todo.ID, &todo.Title, &todo.Status, &todo.List, &tags)
 		if err != nil {
 			continue
 		}
+		todo.Tags = splitTags(tags)
 
-		todos = append(todos, ts.Todo)
+		todos = append(todos, todo)
 	}
 
 	return todos, nil
 }
 
-func (ts *TodoService) GetTodoById(t Todo) (Todo, error) {
+func (ts *TodoService) GetTodoById(ctx context.Context, t Todo) (Todo, error) {
 
-	query := `SELECT id, title, description, status, created_at FROM todos
-		WHERE created_by = ? AND id=?`
+	query := `SELECT t.id, t.title, t.description, t.status, t.created_at, ` + todoLabels + `
+		FROM todos t LEFT JOIN lists l ON l.id = t.list_id
+		WHERE t.created_by = ? AND t.id=?`
 
-	stmt, err := ts.TodoStore.Prepare(query)
+	stmt, err := ts.TodoStore.PrepareContext(ctx, query)
 	if err != nil {
 		return Todo{}, err
 	}
 
 	defer stmt.Close()
 
-	err = stmt.QueryRow(
+	var (
+		todo Todo
+		tags string
+	)
+	err = stmt.QueryRowContext(ctx,
 		t.CreatedBy,
 		t.ID,
 	).Scan(
-		&ts.Todo.ID,
-		&ts.Todo.Title,
-		&ts.Todo.Description,
-		&ts.Todo.Status,
-		&ts.Todo.CreatedAt,
+		&todo.ID,
+		&todo.Title,
+		&todo.Description,
+		&todo.Status,
+		&todo.CreatedAt,
+		&todo.List,
+		&tags,
 	)
 	if err != nil {
 		return Todo{}, err
 	}
+	todo.Tags = splitTags(tags)
 
-	return ts.Todo, nil
+	return todo, nil
 }
 
-func (ts *TodoService) UpdateTodo(t Todo) (Todo, error) {
+func (ts *TodoService) UpdateTodo(ctx context.Context, t Todo) (Todo, error) {
 
 	query := `UPDATE todos SET title = ?,  description = ?, status = ?
 		WHERE created_by = ? AND id=? RETURNING id, title, description, status`
 
-	stmt, err := ts.TodoStore.Prepare(query)
+	stmt, err := ts.TodoStore.PrepareContext(ctx, query)
 	if err != nil {
 		return Todo{}, err
 	}
 
 	defer stmt.Close()
 
-	err = stmt.QueryRow(
+	var todo Todo
+	err = stmt.QueryRowContext(ctx,
 		t.Title,
 		t.Description,
 		t.Status,
 		t.CreatedBy,
 		t.ID,
 	).Scan(
-		&ts.Todo.ID,
-		&ts.Todo.Title,
-		&ts.Todo.Description,
-		&ts.Todo.Status,
+		&todo.ID,
+		&todo.Title,
+		&todo.Description,
+		&todo.Status,
+	)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	return ts.withLabels(ctx, todo)
+}
+
+// PatchTodo changes only the fields of the task set in the patch,
+// leaving the rest as they are in the database (rather than as the
+// client last saw them), and returns the task updated.
+func (ts *TodoService) PatchTodo(ctx context.Context, t Todo, p TodoPatch) (Todo, error) {
+
+	// A NULL parameter (nil field) keeps the column
+	query := `UPDATE todos SET title = COALESCE(?, title),
+		description = COALESCE(?, description), status = COALESCE(?, status)
+		WHERE created_by = ? AND id=? RETURNING id, title, description, status`
+
+	stmt, err := ts.TodoStore.PrepareContext(ctx, query)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	defer stmt.Close()
+
+	var todo Todo
+	err = stmt.QueryRowContext(ctx,
+		p.Title,
+		p.Description,
+		p.Status,
+		t.CreatedBy,
+		t.ID,
+	).Scan(
+		&todo.ID,
+		&todo.Title,
+		&todo.Description,
+		&todo.Status,
 	)
 	if err != nil {
 		return Todo{}, err
 	}
 
-	return ts.Todo, nil
+	return ts.withLabels(ctx, todo)
 }
 
-func (ts *TodoService) DeleteTodo(t Todo) error {
+func (ts *TodoService) DeleteTodo(ctx context.Context, t Todo) error {
 
 	query := `DELETE FROM todos
 		WHERE created_by = ? AND id=?`
 
-	stmt, err := ts.TodoStore.Prepare(query)
+	stmt, err := ts.TodoStore.PrepareContext(ctx, query)
 	if err != nil {
 		return err
 	}
 
 	defer stmt.Close()
 
-	result, err := stmt.Exec(t.CreatedBy, t.ID)
+	result, err := stmt.ExecContext(ctx, t.CreatedBy, t.ID)
 	if err != nil {
 		return err
 	}
@@ -170,8 +255,28 @@ func (ts *TodoService) DeleteTodo(t Todo) error {
 	return nil
 }
 
+// withLabels adds to the task (changed by a statement that
+// returns its own columns) the name of its list and its tags.
+func (ts *TodoService) withLabels(ctx context.Context, t Todo) (Todo, error) {
+	query := `SELECT ` + todoLabels + `
+		FROM todos t LEFT JOIN lists l ON l.id = t.list_id
+		WHERE t.id = ?`
+
+	var tags string
+	err := ts.TodoStore.QueryRowContext(ctx, query, t.ID).Scan(&t.List, &tags)
+	if err != nil {
+		return Todo{}, err
+	}
+	t.Tags = splitTags(tags)
+
+	return t, nil
+}
+
 func ConvertDateTime(tz string, dt time.Time) string {
-	loc, _ := time.LoadLocation(tz)
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		loc = time.UTC
+	}
 
 	return dt.In(loc).Format(time.RFC822Z)
 }
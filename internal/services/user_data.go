@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// LoginEvent is an entry of the login history of a user.
+type LoginEvent struct {
+	UserID    int       `json:"-"`
+	Method    string    `json:"method"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Success   bool      `json:"success"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Profile is the part of the user exported
+// (the secrets, even hashed, are left out).
+type Profile struct {
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Username    string `json:"username"`
+	Timezone    string `json:"timezone"`
+	HasPassword bool   `json:"has_password"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+}
+
+// UserExport is the personal data of a user, as
+// downloaded by them ("download my data").
+type UserExport struct {
+	ExportedAt   time.Time    `json:"exported_at"`
+	Profile      Profile      `json:"profile"`
+	Todos        []Todo       `json:"todos"`
+	Passkeys     []Passkey    `json:"passkeys"`
+	Identities   []Identity   `json:"identities"`
+	LoginHistory []LoginEvent `json:"login_history"`
+}
+
+func (us *UserService) AddLoginEvent(ctx context.Context, e LoginEvent) error {
+	stmt := `INSERT INTO login_events(user_id, method, ip, user_agent, success)
+		VALUES(?, ?, ?, ?, ?)`
+
+	_, err := us.UserStore.ExecContext(ctx, stmt, e.UserID, e.Method, e.IP, e.UserAgent, e.Success)
+
+	return err
+}
+
+// ExportUserData gathers everything stored about the user.
+func (us *UserService) ExportUserData(ctx context.Context, id int) (UserExport, error) {
+	user, err := us.GetUserById(ctx, id)
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	export := UserExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: Profile{
+			ID:          user.ID,
+			Email:       user.Email,
+			Username:    user.Username,
+			Timezone:    user.Timezone,
+			HasPassword: user.Password != "",
+			TOTPEnabled: user.TOTPEnabled,
+		},
+		Todos:        []Todo{},
+		Passkeys:     []Passkey{},
+		Identities:   []Identity{},
+		LoginHistory: []LoginEvent{},
+	}
+
+	rows, err := us.UserStore.QueryContext(ctx,
+		`SELECT t.id, t.created_by, t.title, t.description, t.status, t.created_at,
+			`+todoLabels+`
+		FROM todos t LEFT JOIN lists l ON l.id = t.list_id
+		WHERE t.created_by = ? ORDER BY t.created_at`,
+		id,
+	)
+	if err != nil {
+		return UserExport{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			t    Todo
+			tags string
+		)
+		err := rows.Scan(
+			&t.ID, &t.CreatedBy, &t.Title, &t.Description, &t.Status, &t.CreatedAt,
+			&t.List, &tags,
+		)
+		if err != nil {
+			return UserExport{}, err
+		}
+		t.Tags = splitTags(tags)
+		export.Todos = append(export.Todos, t)
+	}
+	if err := rows.Err(); err != nil {
+		return UserExport{}, err
+	}
+
+	rows, err = us.UserStore.QueryContext(ctx,
+		`SELECT id, user_id, credential_id, sign_count, name, created_at
+		FROM passkeys WHERE user_id = ? ORDER BY created_at`,
+		id,
+	)
+	if err != nil {
+		return UserExport{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Passkey
+		err := rows.Scan(
+			&p.ID, &p.UserID, &p.CredentialID, &p.SignCount, &p.Name, &p.CreatedAt,
+		)
+		if err != nil {
+			return UserExport{}, err
+		}
+		export.Passkeys = append(export.Passkeys, p)
+	}
+	if err := rows.Err(); err != nil {
+		return UserExport{}, err
+	}
+
+	rows, err = us.UserStore.QueryContext(ctx,
+		`SELECT issuer, subject, email FROM user_identities
+		WHERE user_id = ? ORDER BY created_at`,
+		id,
+	)
+	if err != nil {
+		return UserExport{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.Issuer, &i.Subject, &i.Email); err != nil {
+			return UserExport{}, err
+		}
+		export.Identities = append(export.Identities, i)
+	}
+	if err := rows.Err(); err != nil {
+		return UserExport{}, err
+	}
+
+	rows, err = us.UserStore.QueryContext(ctx,
+		`SELECT user_id, method, ip, user_agent, success, created_at
+		FROM login_events WHERE user_id = ? ORDER BY created_at`,
+		id,
+	)
+	if err != nil {
+		return UserExport{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e LoginEvent
+		err := rows.Scan(
+			&e.UserID, &e.Method, &e.IP, &e.UserAgent, &e.Success, &e.CreatedAt,
+		)
+		if err != nil {
+			return UserExport{}, err
+		}
+		export.LoginHistory = append(export.LoginHistory, e)
+	}
+	if err := rows.Err(); err != nil {
+		return UserExport{}, err
+	}
+
+	return export, nil
+}
+
+// ScheduleDeletion marks the account to be deleted
+// (PurgeDeletedUsers) once the grace period is over.
+func (us *UserService) ScheduleDeletion(ctx context.Context, id int, deleteAfter time.Time) error {
+	stmt := `UPDATE users SET delete_after = ? WHERE id = ?`
+
+	_, err := us.UserStore.ExecContext(ctx, stmt, deleteAfter.Unix(), id)
+
+	return err
+}
+
+// CancelDeletion cancels the scheduled deletion of the account,
+// if any. It returns true if there was one.
+func (us *UserService) CancelDeletion(ctx context.Context, id int) (bool, error) {
+	stmt := `UPDATE users SET delete_after = 0
+		WHERE id = ? AND delete_after > 0`
+
+	result, err := us.UserStore.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return false, err
+	}
+
+	i, err := result.RowsAffected()
+
+	return i == 1, err
+}
+
+// PurgeDeletedUsers deletes the accounts whose grace period is over,
+// together with all the rows tied to them. It returns the
+// number of accounts deleted.
+func (us *UserService) PurgeDeletedUsers(ctx context.Context, now time.Time) (int, error) {
+	rows, err := us.UserStore.QueryContext(ctx,
+		`SELECT id, email FROM users WHERE delete_after > 0 AND delete_after <= ?`,
+		now.Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type account struct {
+		id    int
+		email string
+	}
+	accounts := []account{}
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.id, &a.email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, a := range accounts {
+		if err := us.deleteUser(ctx, a.id, a.email); err != nil {
+			return i, err
+		}
+	}
+
+	return len(accounts), nil
+}
+
+// deleteUser removes the user and everything tied to their ID
+// in a single transaction (the tables are listed explicitly since
+// SQLite does not enforce the foreign keys by default).
+func (us *UserService) deleteUser(ctx context.Context, id int, email string) error {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, table := range []string{
+		"todos WHERE created_by = ?",
+		"lists WHERE created_by = ?",
+		"recovery_codes WHERE user_id = ?",
+		"passkeys WHERE user_id = ?",
+		"webauthn_challenges WHERE user_id = ?",
+		"user_identities WHERE user_id = ?",
+		"unlock_tokens WHERE user_id = ?",
+		"email_changes WHERE user_id = ?",
+		"login_events WHERE user_id = ?",
+		"users WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table, id); err != nil {
+			return err
+		}
+	}
+
+	// The failed logins are tracked by email (see the handlers)
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM login_throttle WHERE key = ?`,
+		"account:"+strings.ToLower(email),
+	)
+	if err != nil {
+		return err
+	}
+
+	// The audit trail keeps the actions on and by the user, but
+	// not their email nor, as an administrator, their IP
+	for _, stmt := range []string{
+		`UPDATE admin_audit SET target_email = '' WHERE target_id = ?`,
+		`UPDATE admin_audit SET admin_email = '', ip = '' WHERE admin_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -1,73 +1,552 @@
 package services
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/emarifer/go-frameworkless-htmx/internal/utils/passwd"
 )
 
+var ErrEmailChangeExpired = errors.New("email change expired")
+
 type User struct {
 	ID       int    `json:"id"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
 	Username string `json:"username"`
+	// TOTPSecret is stored encrypted, it is
+	// the responsibility of the caller to decrypt it.
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"`
+	// Timezone is the IANA name of the preferred timezone,
+	// empty to use the one detected by the browser.
+	Timezone string `json:"timezone"`
+	// Role is RoleUser or RoleAdmin.
+	Role string `json:"role"`
+	// Disabled users cannot log in.
+	Disabled bool `json:"disabled"`
+	// MustResetPassword forces the user to change
+	// their password before using the application.
+	MustResetPassword bool `json:"must_reset_password"`
+	// DeletionPending accounts will be deleted once the grace
+	// period is over (see ScheduleDeletion), unless the user
+	// logs in again.
+	DeletionPending bool `json:"-"`
 }
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type UserService struct {
 	User      User
 	UserStore *sql.DB
+	Hasher    *passwd.Hasher
+	// dummyHash is verified instead of the password when the user has
+	// none, so that the response takes the same time (VerifyPassword).
+	dummyHash string
 }
 
-func NewUserService(u User, uStore *sql.DB) *UserService {
+func NewUserService(u User, uStore *sql.DB, h *passwd.Hasher) *UserService {
+	dummyHash, err := h.Hash("dummy password")
+	if err != nil {
+		panic(fmt.Sprintf("something went wrong: %s\n", err))
+	}
 
 	return &UserService{
 		User:      u,
 		UserStore: uStore,
+		Hasher:    h,
+		dummyHash: dummyHash,
 	}
 }
 
-func (us *UserService) CreateUser(u User) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), 8)
+func (us *UserService) CreateUser(ctx context.Context, u User) error {
+	hashedPassword, err := us.Hasher.Hash(u.Password)
 	if err != nil {
 		return err
 	}
 
 	stmt := `INSERT INTO users(email, password, username) VALUES($1, $2, $3)`
 
-	_, err = us.UserStore.Exec(
+	_, err = us.UserStore.ExecContext(ctx,
 		stmt,
 		u.Email,
-		string(hashedPassword),
+		hashedPassword,
 		u.Username,
 	)
 
 	return err
 }
 
-func (us *UserService) CheckEmail(email string) (User, error) {
+// CheckEmail returns the user with the given email. Emails are
+// compared case-insensitively, since they are stored as given
+// by the older accounts and in lowercase by the newer ones.
+func (us *UserService) CheckEmail(ctx context.Context, email string) (User, error) {
 
-	query := `SELECT id, email, password, username FROM users
-		WHERE email = ?`
+	query := `SELECT id, email, password, username,
+		COALESCE(totp_secret, ''), totp_enabled, totp_last_step, timezone,
+		role, disabled, must_reset_password, delete_after > 0 FROM users
+		WHERE email = ? COLLATE NOCASE ORDER BY id LIMIT 1`
 
-	stmt, err := us.UserStore.Prepare(query)
+	stmt, err := us.UserStore.PrepareContext(ctx, query)
 	if err != nil {
 		return User{}, err
 	}
 
 	defer stmt.Close()
 
-	us.User.Email = email
-	err = stmt.QueryRow(
-		us.User.Email,
-	).Scan(
-		&us.User.ID,
-		&us.User.Email,
-		&us.User.Password,
-		&us.User.Username,
+	var u User
+	err = stmt.QueryRowContext(ctx, email).Scan(
+		&u.ID,
+		&u.Email,
+		&u.Password,
+		&u.Username,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&u.Timezone,
+		&u.Role,
+		&u.Disabled,
+		&u.MustResetPassword,
+		&u.DeletionPending,
 	)
 	if err != nil {
 		return User{}, err
 	}
 
-	return us.User, nil
+	return u, nil
+}
+
+func (us *UserService) GetUserById(ctx context.Context, id int) (User, error) {
+
+	query := `SELECT id, email, password, username,
+		COALESCE(totp_secret, ''), totp_enabled, totp_last_step, timezone,
+		role, disabled, must_reset_password, delete_after > 0 FROM users
+		WHERE id = ?`
+
+	stmt, err := us.UserStore.PrepareContext(ctx, query)
+	if err != nil {
+		return User{}, err
+	}
+
+	defer stmt.Close()
+
+	var u User
+	err = stmt.QueryRowContext(ctx, id).Scan(
+		&u.ID,
+		&u.Email,
+		&u.Password,
+		&u.Username,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&u.Timezone,
+		&u.Role,
+		&u.Disabled,
+		&u.MustResetPassword,
+		&u.DeletionPending,
+	)
+	if err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+// SetTOTPSecret stores the (encrypted) secret of a pending
+// enrollment. Two-factor authentication remains disabled
+// until the user confirms it with a valid code.
+func (us *UserService) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	stmt := `UPDATE users SET totp_secret = ?, totp_enabled = FALSE,
+		totp_last_step = 0 WHERE id = ?`
+
+	result, err := us.UserStore.ExecContext(ctx, stmt, secret, id)
+	if err != nil {
+		return err
+	}
+
+	if i, err := result.RowsAffected(); err != nil || i != 1 {
+		return errors.New("an affected row was expected")
+	}
+
+	return nil
+}
+
+// EnableTOTP activates two-factor authentication
+// for the user, replacing their recovery codes.
+func (us *UserService) EnableTOTP(ctx context.Context, id int, step int64, codeHashes []string) error {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE id = ?`,
+		step, id,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, id, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP deactivates two-factor authentication, removing
+// both the secret and the recovery codes of the user.
+func (us *UserService) DisableTOTP(ctx context.Context, id int) error {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET totp_secret = NULL, totp_enabled = FALSE,
+		totp_last_step = 0 WHERE id = ?`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, id, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetTOTPLastStep records the last time step used so that a TOTP
+// code cannot be used twice. The step is only recorded if it is
+// later than the last one, so that of two concurrent logins with
+// the same code, only one succeeds (the other gets an error).
+func (us *UserService) SetTOTPLastStep(ctx context.Context, id int, step int64) error {
+	stmt := `UPDATE users SET totp_last_step = ?
+		WHERE id = ? AND totp_last_step < ?`
+
+	result, err := us.UserStore.ExecContext(ctx, stmt, step, id, step)
+	if err != nil {
+		return err
+	}
+
+	if i, err := result.RowsAffected(); err != nil || i != 1 {
+		return errors.New("TOTP code already used")
+	}
+
+	return nil
+}
+
+func (us *UserService) ReplaceRecoveryCodes(ctx context.Context, id int, codeHashes []string) error {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err = replaceRecoveryCodes(ctx, tx, id, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks the recovery code as used. It returns
+// an error if the code does not exist or has already been used.
+func (us *UserService) UseRecoveryCode(ctx context.Context, id int, codeHash string) error {
+	stmt := `UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`
+
+	result, err := us.UserStore.ExecContext(ctx, stmt, id, codeHash)
+	if err != nil {
+		return err
+	}
+
+	if i, err := result.RowsAffected(); err != nil || i != 1 {
+		return errors.New("invalid recovery code")
+	}
+
+	return nil
+}
+
+func (us *UserService) CountRecoveryCodes(ctx context.Context, id int) (int, error) {
+	query := `SELECT COUNT(*) FROM recovery_codes
+		WHERE user_id = ? AND used_at IS NULL`
+
+	var count int
+	err := us.UserStore.QueryRowContext(ctx, query, id).Scan(&count)
+
+	return count, err
+}
+
+func (us *UserService) UpdateUsername(ctx context.Context, id int, username string) error {
+	stmt := `UPDATE users SET username = ? WHERE id = ?`
+
+	_, err := us.UserStore.ExecContext(ctx, stmt, username, id)
+
+	return err
+}
+
+func (us *UserService) UpdatePassword(ctx context.Context, id int, password string) error {
+	hashedPassword, err := us.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET password = ?, must_reset_password = FALSE
+		WHERE id = ?`
+
+	_, err = us.UserStore.ExecContext(ctx, stmt, hashedPassword, id)
+
+	return err
+}
+
+// VerifyPassword reports whether the password is the one of the
+// user. Users without a password (single sign-on) never match, but
+// a hash is verified anyway so that it takes the same time. If the
+// hash is outdated (algorithm or cost), it is replaced transparently.
+func (us *UserService) VerifyPassword(ctx context.Context, u User, password string) (bool, error) {
+	if u.Password == "" {
+		us.Hasher.Verify(us.dummyHash, password)
+		return false, nil
+	}
+
+	if !us.Hasher.Verify(u.Password, password) {
+		return false, nil
+	}
+
+	if us.Hasher.NeedsRehash(u.Password) {
+		hashedPassword, err := us.Hasher.Hash(password)
+		if err != nil {
+			return true, err
+		}
+
+		// Unless the password has changed in the meantime
+		stmt := `UPDATE users SET password = ? WHERE id = ? AND password = ?`
+
+		_, err = us.UserStore.ExecContext(ctx, stmt, hashedPassword, u.ID, u.Password)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// PromoteAdmins gives the admin role to the users with these emails
+// (the first administrators are set in the configuration).
+func (us *UserService) PromoteAdmins(ctx context.Context, emails []string) error {
+	stmt := `UPDATE users SET role = ? WHERE email = ? COLLATE NOCASE`
+
+	for _, email := range emails {
+		if _, err := us.UserStore.ExecContext(ctx, stmt, RoleAdmin, email); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetTimezone stores the preferred timezone
+// (empty to use the one of the browser).
+func (us *UserService) SetTimezone(ctx context.Context, id int, tz string) error {
+	stmt := `UPDATE users SET timezone = ? WHERE id = ?`
+
+	_, err := us.UserStore.ExecContext(ctx, stmt, tz, id)
+
+	return err
+}
+
+// CreateEmailChange stores a pending change of email, which is
+// applied once the new address is verified (ConfirmEmailChange).
+// Any previous pending change of the user is discarded.
+func (us *UserService) CreateEmailChange(
+	ctx context.Context, id int, newEmail, tokenHash string, expiresAt time.Time,
+) error {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM email_changes WHERE user_id = ? OR expires_at < ?`,
+		id, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO email_changes(token_hash, user_id, new_email, expires_at)
+		VALUES(?, ?, ?, ?)`,
+		tokenHash, id, newEmail, expiresAt.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConfirmEmailChange applies the pending change identified by the
+// token (which can only be used once) and returns the updated user.
+func (us *UserService) ConfirmEmailChange(ctx context.Context, tokenHash string) (User, error) {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+
+	defer tx.Rollback()
+
+	var id int
+	var newEmail string
+	var expiresAt int64
+	err = tx.QueryRowContext(ctx,
+		`DELETE FROM email_changes WHERE token_hash = ?
+		RETURNING user_id, new_email, expires_at`,
+		tokenHash,
+	).Scan(&id, &newEmail, &expiresAt)
+	if err != nil {
+		return User{}, err
+	}
+
+	if time.Now().After(time.Unix(expiresAt, 0)) {
+		return User{}, ErrEmailChangeExpired
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET email = ? WHERE id = ?`, newEmail, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return User{}, err
+	}
+
+	return us.GetUserById(ctx, id)
+}
+
+// Identity is an account of an external identity
+// provider (OpenID Connect) linked to a local user.
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Email   string `json:"email"`
+}
+
+func (us *UserService) GetUserByIdentity(ctx context.Context, issuer, subject string) (User, error) {
+
+	query := `SELECT u.id, u.email, u.password, u.username,
+		COALESCE(u.totp_secret, ''), u.totp_enabled, u.totp_last_step,
+		u.timezone, u.role, u.disabled, u.must_reset_password, u.delete_after > 0
+		FROM users u JOIN user_identities i ON i.user_id = u.id
+		WHERE i.issuer = ? AND i.subject = ?`
+
+	stmt, err := us.UserStore.PrepareContext(ctx, query)
+	if err != nil {
+		return User{}, err
+	}
+
+	defer stmt.Close()
+
+	var u User
+	err = stmt.QueryRowContext(ctx, issuer, subject).Scan(
+		&u.ID,
+		&u.Email,
+		&u.Password,
+		&u.Username,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+		&u.Timezone,
+		&u.Role,
+		&u.Disabled,
+		&u.MustResetPassword,
+		&u.DeletionPending,
+	)
+	if err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+// LinkIdentity links the external identity to an existing user.
+func (us *UserService) LinkIdentity(ctx context.Context, id int, i Identity) error {
+	stmt := `INSERT INTO user_identities(user_id, issuer, subject, email)
+		VALUES(?, ?, ?, ?)`
+
+	_, err := us.UserStore.ExecContext(ctx, stmt, id, i.Issuer, i.Subject, i.Email)
+
+	return err
+}
+
+// CreateSSOUser provisions a new user (just-in-time) for the external
+// identity. These users have no password: the empty hash never
+// matches, so they can only log in through the identity provider.
+func (us *UserService) CreateSSOUser(ctx context.Context, u User, i Identity) (User, error) {
+	tx, err := us.UserStore.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO users(email, password, username) VALUES(?, '', ?)
+		RETURNING id`,
+		u.Email, u.Username,
+	).Scan(&u.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_identities(user_id, issuer, subject, email)
+		VALUES(?, ?, ?, ?)`,
+		u.ID, i.Issuer, i.Subject, i.Email,
+	)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, id int, codeHashes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range codeHashes {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO recovery_codes(user_id, code_hash) VALUES(?, ?)`,
+			id, h,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -1,42 +1,117 @@
 package jwt
 
 import (
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// openssl rand -base64 32 (command)
-// https://www.tecmint.com/generate-pre-shared-key-in-linux/
-const SecretKey = "R51f5xI/WBGF3yiR78mXKwgnINQLAco1A65qLdMxNOI="
+// Types (`typ` header) of the tokens, so that a token
+// of one kind is never accepted as one of the other.
+const (
+	typAuth = "JWT"
+	typMFA  = "mfa+jwt"
+)
+
+// ring signs and verifies the tokens (see Init).
+var ring *KeyRing
+
+// Init sets the key ring used by the functions of this package.
+// It must be called before serving any request.
+func Init(kr *KeyRing) {
+	ring = kr
+}
 
 type AuthClaims struct {
-	Id                   int    `json:"id"`
-	Username             string `json:"username"`
-	Tzone                string `json:"tzone"`
-	jwt.RegisteredClaims `json:"claims"`
+	Id        int    `json:"id"`
+	Username  string `json:"username"`
+	Tzone     string `json:"tzone"`
+	Role      string `json:"role"`
+	MustReset bool   `json:"must_reset,omitempty"`
+	jwt.RegisteredClaims
 }
 
-func CreateNewAuthToken(id int, username, tz string) (string, error) {
+// CreateNewAuthToken signs the token of an authenticated user.
+// mustReset marks a user who has to change their password
+// before using the application (forced by an administrator).
+func CreateNewAuthToken(
+	id int, username, tz, role string, mustReset bool,
+) (string, error) {
+	if ring == nil {
+		return "", errors.New("the key ring is not initialized")
+	}
+
 	claims := AuthClaims{
-		Id:       id,
-		Username: username,
-		Tzone:    tz,
+		Id:        id,
+		Username:  username,
+		Tzone:     tz,
+		Role:      role,
+		MustReset: mustReset,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
-			Issuer:    "https://github.com/emarifer",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    ring.issuer,
+			Audience:  jwt.ClaimStrings{ring.audience},
 		},
 	}
 
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return ring.sign(typAuth, claims)
+}
+
+// ParseAuthToken verifies the token of an
+// authenticated user and returns its claims.
+func ParseAuthToken(tokenString string) (*AuthClaims, error) {
+	if ring == nil {
+		return nil, errors.New("the key ring is not initialized")
+	}
+
+	claims := &AuthClaims{}
+	if err := ring.parse(typAuth, tokenString, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// MFAClaims identify a user who has already provided
+// their password but still has to pass the second factor.
+type MFAClaims struct {
+	Id    int    `json:"id"`
+	Tzone string `json:"tzone"`
+	jwt.RegisteredClaims
+}
+
+func CreateNewMFAToken(id int, tz string) (string, error) {
+	if ring == nil {
+		return "", errors.New("the key ring is not initialized")
+	}
+
+	claims := MFAClaims{
+		Id:    id,
+		Tzone: tz,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    ring.issuer,
+			Audience:  jwt.ClaimStrings{ring.audience},
+		},
+	}
+
+	return ring.sign(typMFA, claims)
+}
+
+// ParseMFAToken verifies the token of a pending
+// second step of the login and returns its claims.
+func ParseMFAToken(tokenString string) (*MFAClaims, error) {
+	if ring == nil {
+		return nil, errors.New("the key ring is not initialized")
+	}
 
-	// Sign and get the complete encoded token as a string using the secret
-	signedToken, err := token.SignedString([]byte(SecretKey))
-	if err != nil {
-		return "", fmt.Errorf("error signing the token: %s", err)
+	claims := &MFAClaims{}
+	if err := ring.parse(typMFA, tokenString, claims); err != nil {
+		return nil, err
 	}
 
-	return signedToken, nil
+	return claims, nil
 }
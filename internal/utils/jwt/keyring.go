@@ -0,0 +1,235 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a key of the ring, identified in the tokens by
+// the `kid` header. The retired keys have no private part.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeyRing holds the keys that verify the tokens, of which only the
+// active one signs the new tokens. A key is rotated by making a new
+// one active and keeping the previous one (its public part is
+// enough) until the tokens it signed have expired.
+type KeyRing struct {
+	active   *Key
+	keys     map[string]*Key
+	methods  []string // the algorithms accepted
+	issuer   string
+	audience string
+}
+
+// NewKeyRing creates the ring with the active key and the
+// retired ones. The tokens are issued by the issuer for the
+// audience, and only those are accepted.
+func NewKeyRing(active *Key, retired []*Key, issuer, audience string) (*KeyRing, error) {
+	if active == nil || active.private == nil {
+		return nil, errors.New("the active key must have a private key")
+	}
+
+	kr := &KeyRing{
+		active:   active,
+		keys:     map[string]*Key{},
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	for _, k := range append([]*Key{active}, retired...) {
+		if _, ok := kr.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		kr.keys[k.ID] = k
+
+		if !slices.Contains(kr.methods, k.Method.Alg()) {
+			kr.methods = append(kr.methods, k.Method.Alg())
+		}
+	}
+
+	return kr, nil
+}
+
+// LoadKeyRing creates the ring with the keys of the PEM files
+// (see LoadKey). If signingKey is empty, a random key is generated.
+func LoadKeyRing(
+	signingKey string, verifyKeys []string, issuer, audience string,
+) (*KeyRing, error) {
+	var active *Key
+	var err error
+	if signingKey == "" {
+		active, err = GenerateKey()
+	} else {
+		active, err = LoadKey(signingKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	retired := []*Key{}
+	for _, path := range verifyKeys {
+		k, err := LoadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		retired = append(retired, k)
+	}
+
+	return NewKeyRing(active, retired, issuer, audience)
+}
+
+// sign signs the claims with the active key. The type
+// header distinguishes the kinds of tokens of the application.
+func (kr *KeyRing) sign(typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(kr.active.Method, claims)
+	token.Header["kid"] = kr.active.ID
+	token.Header["typ"] = typ
+
+	signedToken, err := token.SignedString(kr.active.private)
+	if err != nil {
+		return "", fmt.Errorf("error signing the token: %s", err)
+	}
+
+	return signedToken, nil
+}
+
+// parse verifies the token (type, key, algorithm, issuer,
+// audience and expiration) and fills the claims.
+func (kr *KeyRing) parse(typ, tokenString string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		claims,
+		func(t *jwt.Token) (interface{}, error) {
+			if t.Header["typ"] != typ {
+				return nil, errors.New("unexpected token type")
+			}
+
+			kid, _ := t.Header["kid"].(string)
+			k, ok := kr.keys[kid]
+			if !ok {
+				return nil, fmt.Errorf("unknown key id %q", kid)
+			}
+			if t.Method.Alg() != k.Method.Alg() {
+				return nil, errors.New("unexpected signing method")
+			}
+
+			return k.public, nil
+		},
+		jwt.WithValidMethods(kr.methods),
+		jwt.WithIssuer(kr.issuer),
+		jwt.WithAudience(kr.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if !token.Valid {
+		return errors.New("invalid token")
+	}
+
+	return nil
+}
+
+// LoadKey reads a key from a PEM file: a private key (PKCS #8, or
+// SEC 1 for ECDSA) or, for the retired keys, a public key (PKIX).
+// Ed25519 keys sign with EdDSA and P-256 keys with ES256.
+// The key id is derived from the public key.
+func LoadKey(path string) (*Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	k, err := newKey(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return k, nil
+}
+
+// GenerateKey creates a random Ed25519 key, only meant for
+// development: the sessions do not survive a restart.
+func GenerateKey() (*Key, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey(private)
+}
+
+func newKey(parsed any) (*Key, error) {
+	k := &Key{}
+
+	switch key := parsed.(type) {
+	case ed25519.PrivateKey:
+		k.private, k.public = key, key.Public()
+	case ed25519.PublicKey:
+		k.public = key
+	case *ecdsa.PrivateKey:
+		k.private, k.public = key, key.Public()
+	case *ecdsa.PublicKey:
+		k.public = key
+	default:
+		return nil, errors.New("unsupported key type (Ed25519 or P-256 expected)")
+	}
+
+	switch public := k.public.(type) {
+	case ed25519.PublicKey:
+		k.Method = jwt.SigningMethodEdDSA
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported curve (P-256 expected)")
+		}
+		k.Method = jwt.SigningMethodES256
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(k.public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	k.ID = base64.RawURLEncoding.EncodeToString(sum[:12])
+
+	return k, nil
+}
@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is that of the text exposition format of Prometheus
+// (https://prometheus.io/docs/instrumenting/exposition_formats/).
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default upper bounds of the histograms, in
+// seconds, suited to the latencies of a web application.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry keeps the metrics of the application and writes them
+// when scraped. The counters and histograms are updated as the
+// events happen; the rest (e.g. the state of the runtime) are
+// read at scrape time by the collectors added with OnScrape.
+type Registry struct {
+	mu         sync.Mutex
+	vecs       []*vec
+	collectors []Collector
+}
+
+// Collector writes the metrics that are read at scrape time,
+// with the context of the scrape request (e.g. to query
+// the database).
+type Collector func(ctx context.Context, w *Writer)
+
+func NewRegistry() *Registry {
+
+	return &Registry{}
+}
+
+// OnScrape adds a collector, called on every scrape.
+func (r *Registry) OnScrape(collect Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, collect)
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// NewHistogram registers a histogram with the given upper bounds
+// of its buckets (in increasing order) and label names.
+func (r *Registry) NewHistogram(
+	name, help string, buckets []float64, labels ...string,
+) *Histogram {
+
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (r *Registry) register(
+	name, help, typ string, buckets []float64, labels []string,
+) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		buckets: buckets,
+		labels:  labels,
+		series:  map[string]*series{},
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.vecs = append(r.vecs, v)
+
+	return v
+}
+
+// ServeHTTP writes all the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mw := &Writer{}
+
+	r.mu.Lock()
+	vecs, collectors := r.vecs, r.collectors
+	r.mu.Unlock()
+
+	for _, v := range vecs {
+		v.write(mw)
+	}
+	for _, collect := range collectors {
+		collect(req.Context(), mw)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(mw.b.Bytes())
+}
+
+// Counter is a value that only goes up (e.g. the requests served),
+// with a series for each combination of the values of its labels.
+type Counter struct {
+	*vec
+}
+
+// Inc adds one to the series of the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v (not negative) to the series of the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	s := c.get(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.sum += v
+}
+
+// Histogram counts the observations (e.g. latencies) in buckets,
+// with a series for each combination of the values of its labels.
+type Histogram struct {
+	*vec
+}
+
+// Observe adds the value to the series of the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	s := h.get(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The buckets are cumulative when written
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// vec is the state of a counter or a histogram.
+type vec struct {
+	name, help, typ string
+	buckets         []float64
+	labels          []string
+
+	mu     sync.Mutex
+	series map[string]*series
+	order  []string // keys of the series, in order of creation
+}
+
+type series struct {
+	labelValues []string
+	sum         float64  // value of the counters
+	count       uint64   // observations of the histograms
+	counts      []uint64 // observations by bucket (not cumulative)
+}
+
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf(
+			"metrics: %s has %d labels, %d values given",
+			v.name, len(v.labels), len(labelValues),
+		))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(v.buckets)),
+		}
+		v.series[key] = s
+		v.order = append(v.order, key)
+	}
+
+	return s
+}
+
+func (v *vec) write(w *Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	w.header(v.name, v.help, v.typ)
+	for _, key := range v.order {
+		s := v.series[key]
+		labels := make([]string, 0, 2*len(v.labels)+2)
+		for i, l := range v.labels {
+			labels = append(labels, l, s.labelValues[i])
+		}
+
+		if v.typ == "counter" {
+			w.sample(v.name, s.sum, labels)
+			continue
+		}
+
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += s.counts[i]
+			w.sample(v.name+"_bucket", float64(cumulative),
+				append(labels, "le", formatFloat(le)))
+		}
+		w.sample(v.name+"_bucket", float64(s.count), append(labels, "le", "+Inf"))
+		w.sample(v.name+"_sum", s.sum, labels)
+		w.sample(v.name+"_count", float64(s.count), labels)
+	}
+}
+
+// Writer writes the metrics in the text exposition format.
+// The samples of a metric must be written one after another.
+type Writer struct {
+	b    bytes.Buffer
+	last string // name of the last metric written
+}
+
+// Gauge writes a sample of a gauge, a value that can go up and down
+// (e.g. the open connections). The labels are given in pairs of
+// name and value, e.g. `w.Gauge("db_connections", "…", 3, "state", "idle")`.
+func (w *Writer) Gauge(name, help string, v float64, labels ...string) {
+	w.header(name, help, "gauge")
+	w.sample(name, v, labels)
+}
+
+// Counter writes a sample of a counter kept elsewhere
+// (e.g. by the runtime), in the same way as Gauge.
+func (w *Writer) Counter(name, help string, v float64, labels ...string) {
+	w.header(name, help, "counter")
+	w.sample(name, v, labels)
+}
+
+func (w *Writer) header(name, help, typ string) {
+	if name == w.last {
+		return
+	}
+	w.last = name
+
+	fmt.Fprintf(&w.b, "# HELP %s %s\n", name, escape(help, false))
+	fmt.Fprintf(&w.b, "# TYPE %s %s\n", name, typ)
+}
+
+func (w *Writer) sample(name string, v float64, labels []string) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			w.b.WriteString(labels[i])
+			w.b.WriteString(`="`)
+			w.b.WriteString(escape(labels[i+1], true))
+			w.b.WriteByte('"')
+		}
+		w.b.WriteByte('}')
+	}
+	w.b.WriteByte(' ')
+	w.b.WriteString(formatFloat(v))
+	w.b.WriteByte('\n')
+}
+
+// escape escapes the backslashes and new lines
+// (and the double quotes in the label values).
+func escape(s string, quotes bool) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if quotes {
+		r = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+
+	return r.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
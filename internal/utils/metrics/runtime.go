@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"runtime"
+	"time"
+)
+
+// startTime is (approximately) the start time of the process.
+var startTime = time.Now()
+
+// CollectRuntime is a collector of the state of the
+// Go runtime: goroutines, memory and garbage collector.
+func CollectRuntime(_ context.Context, w *Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	w.Gauge("go_info", "Version of Go of the binary.", 1, "version", runtime.Version())
+	w.Gauge("go_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine()))
+	w.Gauge("go_memstats_alloc_bytes", "Bytes of the allocated heap objects.",
+		float64(ms.Alloc))
+	w.Gauge("go_memstats_heap_inuse_bytes", "Bytes in in-use spans of the heap.",
+		float64(ms.HeapInuse))
+	w.Gauge("go_memstats_heap_objects", "Number of allocated heap objects.",
+		float64(ms.HeapObjects))
+	w.Gauge("go_memstats_sys_bytes", "Bytes of memory obtained from the system.",
+		float64(ms.Sys))
+	w.Counter("go_memstats_mallocs_total", "Heap objects allocated.",
+		float64(ms.Mallocs))
+	w.Counter("go_memstats_frees_total", "Heap objects freed.",
+		float64(ms.Frees))
+	w.Counter("go_gc_cycles_total", "Completed garbage collection cycles.",
+		float64(ms.NumGC))
+	w.Counter("go_gc_pause_seconds_total", "Time stopped by the garbage collector.",
+		time.Duration(ms.PauseTotalNs).Seconds())
+	w.Gauge("process_start_time_seconds", "Start time of the process since the Unix epoch.",
+		float64(startTime.Unix()))
+}
+
+// SQLStats returns a collector of the statistics
+// of the connection pool of the database.
+func SQLStats(db *sql.DB) Collector {
+	return func(_ context.Context, w *Writer) {
+		s := db.Stats()
+
+		w.Gauge("db_max_open_connections", "Maximum number of open connections.",
+			float64(s.MaxOpenConnections))
+		w.Gauge("db_connections", "Open connections by state.",
+			float64(s.InUse), "state", "in_use")
+		w.Gauge("db_connections", "Open connections by state.",
+			float64(s.Idle), "state", "idle")
+		w.Counter("db_wait_total", "Connections waited for.",
+			float64(s.WaitCount))
+		w.Counter("db_wait_seconds_total", "Time waited for connections.",
+			s.WaitDuration.Seconds())
+		w.Counter("db_closed_connections_total", "Connections closed by the pool, by reason.",
+			float64(s.MaxIdleClosed), "reason", "max_idle")
+		w.Counter("db_closed_connections_total", "Connections closed by the pool, by reason.",
+			float64(s.MaxIdleTimeClosed), "reason", "max_idle_time")
+		w.Counter("db_closed_connections_total", "Connections closed by the pool, by reason.",
+			float64(s.MaxLifetimeClosed), "reason", "max_lifetime")
+	}
+}
@@ -0,0 +1,293 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms accepted for the ID tokens.
+var supportedAlgs = []string{"RS256", "ES256"}
+
+// Client is an OpenID Connect relying party using the authorization
+// code flow with PKCE. The provider metadata is discovered on first
+// use, so that the application can start while the provider is down.
+type Client struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     *keySet
+}
+
+// metadata is the subset of the provider
+// configuration (discovery document) that we use.
+type metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	IDTokenAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Claims are the claims of the ID token used to identify the user.
+type Claims struct {
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Nonce             string   `json:"nonce"`
+	AuthorizedParty   string   `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// flexBool accepts booleans encoded as strings,
+// which some providers send for `email_verified`.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = flexBool(s == "true")
+
+	return nil
+}
+
+func NewClient(issuer, clientID, clientSecret, redirectURL string) *Client {
+	return &Client{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewRandom returns a random string (base64url) used
+// for the `state`, the `nonce` and the PKCE verifier.
+func NewRandom() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the URL of the authorization endpoint
+// to which the user is redirected to log in.
+func (c *Client) AuthCodeURL(
+	ctx context.Context, state, nonce, verifier string,
+) (string, error) {
+	md, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", c.ClientID)
+	v.Set("redirect_uri", c.RedirectURL)
+	v.Set("scope", "openid email profile")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return md.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the authorization code for the tokens
+// and returns the verified claims of the ID token.
+func (c *Client) Exchange(
+	ctx context.Context, code, verifier, nonce string,
+) (*Claims, error) {
+	md, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if c.ClientSecret == "" {
+		// Public client
+		form.Set("client_id", c.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return nil, fmt.Errorf(
+			"token request failed: %s %s", body.Error, body.ErrorDescription,
+		)
+	}
+
+	if body.IDToken == "" {
+		return nil, errors.New("the token response has no id_token")
+	}
+
+	return c.verifyIDToken(ctx, md, body.IDToken, nonce)
+}
+
+// verifyIDToken validates the signature (with the keys published
+// by the provider), the issuer, the audience, the expiration
+// and the nonce of the ID token.
+func (c *Client) verifyIDToken(
+	ctx context.Context, md *metadata, raw, nonce string,
+) (*Claims, error) {
+	algs := supportedAlgs
+	if len(md.IDTokenAlgs) > 0 {
+		algs = intersect(supportedAlgs, md.IDTokenAlgs)
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(
+		raw,
+		claims,
+		func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return c.key(ctx, md, kid)
+		},
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuer(md.Issuer),
+		jwt.WithAudience(c.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != c.ClientID {
+		return nil, errors.New("invalid ID token: unexpected authorized party")
+	}
+
+	if claims.Nonce != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("invalid ID token: missing subject")
+	}
+
+	return claims, nil
+}
+
+// discover fetches (once) the provider configuration.
+func (c *Client) discover(ctx context.Context) (*metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	md := &metadata{}
+	err := c.getJSON(ctx, c.Issuer+"/.well-known/openid-configuration", md)
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+
+	if strings.TrimSuffix(md.Issuer, "/") != c.Issuer {
+		return nil, fmt.Errorf("discovery failed: unexpected issuer %q", md.Issuer)
+	}
+
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("discovery failed: incomplete provider metadata")
+	}
+
+	c.metadata = md
+
+	return md, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+func intersect(a, b []string) []string {
+	out := []string{}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				out = append(out, x)
+			}
+		}
+	}
+
+	return out
+}
+
+/* REFERENCES:
+https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
+https://openid.net/specs/openid-connect-discovery-1_0.html
+https://datatracker.ietf.org/doc/html/rfc7636 (PKCE)
+*/
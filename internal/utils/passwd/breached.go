@@ -0,0 +1,100 @@
+package passwd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// bundled contains the SHA-1 hashes (one per line)
+// of the most common breached passwords.
+//
+//go:embed breached.txt
+var bundled string
+
+// BreachedList finds passwords among the hashes of breached passwords
+// with the k-anonymity model of Have I Been Pwned: the SHA-1 of the
+// password is split into a prefix of 5 characters and a suffix, and
+// only the range of the prefix (the suffixes sharing it) is read.
+//
+// The list is either the small bundled one or a directory of range
+// files named after their prefix (`21BD1.txt`…) with a suffix per line,
+// optionally followed by `:count`, such as those of the Pwned Passwords
+// downloader (https://github.com/HaveIBeenPwned/PwnedPasswordsDownloader).
+type BreachedList struct {
+	dir string
+
+	once   sync.Once
+	ranges map[string][]string // bundled list by prefix
+}
+
+// NewBreachedList returns the list of the directory,
+// or the bundled one if dir is empty.
+func NewBreachedList(dir string) *BreachedList {
+	return &BreachedList{dir: dir}
+}
+
+// Contains reports whether the password is in the list.
+func (b *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	suffixes, err := b.rangeOf(prefix)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range suffixes {
+		if s == suffix {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// rangeOf returns the suffixes of the hashes with the prefix.
+func (b *BreachedList) rangeOf(prefix string) ([]string, error) {
+	if b.dir == "" {
+		b.once.Do(b.loadBundled)
+		return b.ranges[prefix], nil
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	suffixes := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		suffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		suffixes = append(suffixes, strings.ToUpper(suffix))
+	}
+
+	return suffixes, scanner.Err()
+}
+
+func (b *BreachedList) loadBundled() {
+	b.ranges = map[string][]string{}
+
+	for _, line := range strings.Split(bundled, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) != 40 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b.ranges[line[:5]] = append(b.ranges[line[:5]], line[5:])
+	}
+}
@@ -0,0 +1,153 @@
+package passwd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms used to hash the passwords.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// Parameters of argon2id (second recommended option of RFC 9106).
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+var b64 = base64.RawStdEncoding
+
+// Hasher hashes the passwords with the configured algorithm. It
+// verifies the hashes of both algorithms, so that the stored ones
+// can be upgraded on the next login (NeedsRehash).
+type Hasher struct {
+	algorithm  string
+	bcryptCost int
+}
+
+func NewHasher(algorithm string, bcryptCost int) (*Hasher, error) {
+	switch algorithm {
+	case Bcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf(
+				"the bcrypt cost must be between %d and %d",
+				bcrypt.MinCost, bcrypt.MaxCost,
+			)
+		}
+	case Argon2id:
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", algorithm)
+	}
+
+	return &Hasher{algorithm: algorithm, bcryptCost: bcryptCost}, nil
+}
+
+// Hash returns the encoded hash of the password: the format
+// of bcrypt or the PHC string format for argon2id
+// (`$argon2id$v=19$m=…,t=…,p=…$salt$hash`).
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(
+		[]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen,
+	)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		b64.EncodeToString(salt), b64.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether the password matches the hash.
+func (h *Hasher) Verify(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, err := parseArgon2id(hash)
+		if err != nil {
+			return false
+		}
+
+		key := argon2.IDKey(
+			[]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)),
+		)
+
+		return subtle.ConstantTimeCompare(key, p.key) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NeedsRehash reports whether the hash was produced with another
+// algorithm or weaker parameters than the configured ones.
+func (h *Hasher) NeedsRehash(hash string) bool {
+	if h.algorithm == Bcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.bcryptCost
+	}
+
+	p, err := parseArgon2id(hash)
+
+	return err != nil || p.time < argonTime || p.memory < argonMemory ||
+		p.threads < argonThreads || len(p.key) < argonKeyLen
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(hash string) (argon2Params, error) {
+	var p argon2Params
+
+	// "", "argon2id", "v=19", "m=…,t=…,p=…", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil ||
+		version != argon2.Version {
+		return p, errors.New("unsupported argon2id version")
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return p, fmt.Errorf("invalid argon2id parameters: %s", err)
+	}
+
+	if p.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return p, err
+	}
+	if p.key, err = b64.DecodeString(parts[5]); err != nil {
+		return p, err
+	}
+	if len(p.key) == 0 || p.time == 0 || p.threads == 0 {
+		return p, errors.New("invalid argon2id parameters")
+	}
+
+	return p, nil
+}
@@ -0,0 +1,117 @@
+package passwd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Violation is a reason why a password is rejected by
+// the policy, meant to be shown to the user.
+type Violation string
+
+func (v Violation) Error() string {
+	return string(v)
+}
+
+// Policy is the set of rules that new passwords must follow.
+type Policy struct {
+	// MinLength is counted in characters (not bytes).
+	MinLength int
+	// MinEntropy is the minimum estimated strength, in bits (see Entropy).
+	MinEntropy float64
+	// Breached, if not nil, rejects the known breached passwords.
+	Breached *BreachedList
+}
+
+// Check returns a Violation if the password does not follow the
+// policy. Any other error comes from the breached password list.
+// The email and username of the user cannot be part of it.
+func (p *Policy) Check(password, email, username string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return Violation(fmt.Sprintf(
+			"The password must be at least %d characters", p.MinLength,
+		))
+	}
+
+	lower := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	for _, s := range []string{localPart, strings.ToLower(username)} {
+		// Very short names would reject too many passwords
+		if utf8.RuneCountInString(s) >= 3 && strings.Contains(lower, s) {
+			return Violation("The password cannot contain your email or username")
+		}
+	}
+
+	if Entropy(password) < p.MinEntropy {
+		return Violation(
+			"The password is too easy to guess: make it longer or " +
+				"mix lowercase and uppercase letters, digits and symbols",
+		)
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return Violation(
+				"This password has appeared in a data breach, please choose another one",
+			)
+		}
+	}
+
+	return nil
+}
+
+// Entropy estimates the strength of the password in bits, as the
+// number of characters times the bits of the pool they are drawn
+// from (lowercase, uppercase, digits, symbols, other). Repeated
+// characters and sequences ("aaa", "abc", "321") only count once,
+// since they add almost nothing to the cost of guessing it.
+func Entropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	effective := 0
+	prev, delta := rune(-1), rune(0)
+
+	for _, c := range password {
+		switch {
+		case c < unicode.MaxASCII && unicode.IsLower(c):
+			lower = true
+		case c < unicode.MaxASCII && unicode.IsUpper(c):
+			upper = true
+		case c < unicode.MaxASCII && unicode.IsDigit(c):
+			digit = true
+		case c < unicode.MaxASCII && unicode.IsPrint(c):
+			symbol = true
+		default:
+			other = true
+		}
+
+		d := c - prev
+		repeated := d == 0
+		sequence := (d == 1 || d == -1) && d == delta
+		if prev < 0 || (!repeated && !sequence) {
+			effective++
+		}
+		prev, delta = c, d
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(effective) * math.Log2(float64(pool))
+}
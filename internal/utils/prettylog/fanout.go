@@ -0,0 +1,63 @@
+package prettylog
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// Fanout sends the records to several handlers (sinks), each with
+// its own level, e.g. the console, a log file and a syslog server.
+type Fanout struct {
+	handlers []slog.Handler
+}
+
+func NewFanout(handlers ...slog.Handler) *Fanout {
+
+	return &Fanout{handlers: handlers}
+}
+
+// Enabled reports whether any of the handlers handles the level.
+func (f *Fanout) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f.handlers {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handle sends the record to the handlers that handle its level.
+// A failing sink does not keep the record from reaching the others.
+func (f *Fanout) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f.handlers {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (f *Fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(f.handlers))
+	for i, h := range f.handlers {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+
+	return &Fanout{handlers: handlers}
+}
+
+func (f *Fanout) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(f.handlers))
+	for i, h := range f.handlers {
+		handlers[i] = h.WithGroup(name)
+	}
+
+	return &Fanout{handlers: handlers}
+}
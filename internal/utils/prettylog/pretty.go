@@ -0,0 +1,259 @@
+package prettylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field is an attribute of the pretty output, or a group of them.
+type field struct {
+	key      string
+	value    slog.Value
+	group    bool
+	children []*field
+}
+
+// empty reports whether the field is a group without
+// attributes (at any depth), which is not written.
+func (f *field) empty() bool {
+	if !f.group {
+		return false
+	}
+
+	for _, c := range f.children {
+		if !c.empty() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatPretty formats the record as the time, the level and the
+// message followed by its attributes (and those of the handler,
+// nested in their groups) as indented JSON.
+func (h *Handler) formatPretty(r slog.Record) []byte {
+	colorize := func(code int, value string) string {
+		return value
+	}
+	if h.colorize {
+		colorize = colorizer
+	}
+
+	out := &bytes.Buffer{}
+
+	timeAttr := slog.Attr{
+		Key:   slog.TimeKey,
+		Value: slog.StringValue(r.Time.Format(timeFormat)),
+	}
+	if h.opts.ReplaceAttr != nil {
+		timeAttr = h.opts.ReplaceAttr([]string{}, timeAttr)
+	}
+	if !timeAttr.Equal(slog.Attr{}) {
+		out.WriteString(colorize(lightGray, timeAttr.Value.String()))
+		out.WriteString(" ")
+	}
+
+	levelAttr := slog.Attr{
+		Key:   slog.LevelKey,
+		Value: slog.AnyValue(r.Level),
+	}
+	if h.opts.ReplaceAttr != nil {
+		levelAttr = h.opts.ReplaceAttr([]string{}, levelAttr)
+	}
+	if !levelAttr.Equal(slog.Attr{}) {
+		out.WriteString(colorize(levelColor(r.Level), levelAttr.Value.String()+":"))
+		out.WriteString(" ")
+	}
+
+	msgAttr := slog.Attr{
+		Key:   slog.MessageKey,
+		Value: slog.StringValue(r.Message),
+	}
+	if h.opts.ReplaceAttr != nil {
+		msgAttr = h.opts.ReplaceAttr([]string{}, msgAttr)
+	}
+	if !msgAttr.Equal(slog.Attr{}) {
+		out.WriteString(colorize(white, msgAttr.Value.String()))
+		out.WriteString(" ")
+	}
+
+	root := &field{group: true}
+	if h.opts.AddSource && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		h.addAttr(root, nil, slog.Any(slog.SourceKey, &slog.Source{
+			Function: frame.Function,
+			File:     frame.File,
+			Line:     frame.Line,
+		}))
+	}
+
+	current, groups := root, []string{}
+	for _, goa := range h.goas {
+		if goa.group != "" {
+			g := &field{key: goa.group, group: true}
+			current.children = append(current.children, g)
+			current, groups = g, append(groups[:len(groups):len(groups)], goa.group)
+			continue
+		}
+		for _, a := range goa.attrs {
+			h.addAttr(current, groups, a)
+		}
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		h.addAttr(current, groups, a)
+		return true
+	})
+
+	attrs := &bytes.Buffer{}
+	writeObject(attrs, root.children, 0)
+	out.WriteString(colorize(darkGray, attrs.String()))
+	out.WriteString("\n")
+
+	return out.Bytes()
+}
+
+func levelColor(level slog.Level) int {
+	switch {
+	case level <= slog.LevelDebug:
+		return lightGray
+	case level <= slog.LevelInfo:
+		return cyan
+	case level < slog.LevelWarn:
+		return lightBlue
+	case level < slog.LevelError:
+		return lightYellow
+	case level <= slog.LevelError+1:
+		return lightRed
+	}
+
+	return lightMagenta
+}
+
+// addAttr adds the attribute to the group, following the rules of
+// the standard handlers: the values are resolved, ReplaceAttr is
+// applied, empty attributes are ignored and the groups without
+// a key are inlined.
+func (h *Handler) addAttr(parent *field, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if h.opts.ReplaceAttr != nil && a.Value.Kind() != slog.KindGroup {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() != slog.KindGroup {
+		parent.children = append(parent.children, &field{key: a.Key, value: a.Value})
+		return
+	}
+
+	if a.Key == "" {
+		for _, ga := range a.Value.Group() {
+			h.addAttr(parent, groups, ga)
+		}
+		return
+	}
+
+	g := &field{key: a.Key, group: true}
+	groups = append(groups[:len(groups):len(groups)], a.Key)
+	for _, ga := range a.Value.Group() {
+		h.addAttr(g, groups, ga)
+	}
+	parent.children = append(parent.children, g)
+}
+
+// writeObject writes the fields as a JSON object indented with
+// two spaces per level, in the order in which they were added.
+func writeObject(b *bytes.Buffer, fields []*field, depth int) {
+	written := []*field{}
+	for _, f := range fields {
+		if !f.empty() {
+			written = append(written, f)
+		}
+	}
+
+	if len(written) == 0 {
+		b.WriteString("{}")
+		return
+	}
+
+	indent := strings.Repeat("  ", depth+1)
+	b.WriteString("{\n")
+	for i, f := range written {
+		b.WriteString(indent)
+		b.WriteString(quote(f.key))
+		b.WriteString(": ")
+		if f.group {
+			writeObject(b, f.children, depth+1)
+		} else {
+			writeValue(b, f.value, indent)
+		}
+		if i < len(written)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(strings.Repeat("  ", depth))
+	b.WriteString("}")
+}
+
+// writeValue writes a (resolved) value as JSON. The durations and
+// the errors are written as text, which is more readable.
+func writeValue(b *bytes.Buffer, v slog.Value, indent string) {
+	switch v.Kind() {
+	case slog.KindString:
+		b.WriteString(quote(v.String()))
+	case slog.KindInt64:
+		b.WriteString(strconv.FormatInt(v.Int64(), 10))
+	case slog.KindUint64:
+		b.WriteString(strconv.FormatUint(v.Uint64(), 10))
+	case slog.KindFloat64:
+		f := v.Float64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			b.WriteString(quote(strconv.FormatFloat(f, 'g', -1, 64)))
+		} else {
+			b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	case slog.KindBool:
+		b.WriteString(strconv.FormatBool(v.Bool()))
+	case slog.KindDuration:
+		b.WriteString(quote(v.Duration().String()))
+	case slog.KindTime:
+		b.WriteString(quote(v.Time().Format(time.RFC3339Nano)))
+	default:
+		a := v.Any()
+		if err, ok := a.(error); ok {
+			b.WriteString(quote(err.Error()))
+			return
+		}
+
+		j, err := json.MarshalIndent(a, indent, "  ")
+		if err != nil {
+			b.WriteString(quote(fmt.Sprintf("%+v", a)))
+			return
+		}
+		b.Write(j)
+	}
+}
+
+// quote returns the string as JSON, without
+// escaping the HTML characters (e.g. in the URLs).
+func quote(s string) string {
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return strconv.Quote(s)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -1,15 +1,12 @@
 package prettylog
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 )
 
@@ -40,183 +37,181 @@ func colorizer(colorCode int, v string) string {
 	return fmt.Sprintf("\033[%sm%s%s", strconv.Itoa(colorCode), v, reset)
 }
 
-type Handler struct {
-	h        slog.Handler
-	r        func([]string, slog.Attr) slog.Attr
-	b        *bytes.Buffer
-	m        *sync.Mutex
-	writer   io.Writer
-	colorize bool
+// Mode is the output format of the handler.
+type Mode int
+
+const (
+	// ModePretty writes the time, level and message followed by the
+	// attributes as indented JSON, optionally colorized (development).
+	ModePretty Mode = iota
+	// ModeJSON writes each record as a single-line JSON object.
+	ModeJSON
+	// ModeLogfmt writes each record as a line of key=value pairs.
+	ModeLogfmt
+)
+
+// ParseMode parses the name of a mode: "pretty"
+// (also the empty string), "json" or "logfmt".
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "pretty":
+		return ModePretty, nil
+	case "json":
+		return ModeJSON, nil
+	case "logfmt":
+		return ModeLogfmt, nil
+	}
+
+	return 0, fmt.Errorf("unknown log format %q (pretty, json or logfmt expected)", s)
 }
 
-func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
-	return h.h.Enabled(ctx, level)
+func (m Mode) String() string {
+	switch m {
+	case ModeJSON:
+		return "json"
+	case ModeLogfmt:
+		return "logfmt"
+	}
+
+	return "pretty"
 }
 
-func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &Handler{h: h.h.WithAttrs(attrs), b: h.b, r: h.r, m: h.m, writer: h.writer, colorize: h.colorize}
+// Handler writes the records in the chosen mode. The JSON and
+// logfmt modes are those of the standard library (JSONHandler
+// and TextHandler); the pretty mode formats the attributes itself.
+type Handler struct {
+	opts     slog.HandlerOptions
+	mode     Mode
+	writer   io.Writer
+	colorize bool
+	m        *sync.Mutex // shared by the handlers derived from this one
+
+	inner slog.Handler // JSON and logfmt modes
+	goas  []groupOrAttrs
 }
 
-func (h *Handler) WithGroup(name string) slog.Handler {
-	return &Handler{h: h.h.WithGroup(name), b: h.b, r: h.r, m: h.m, writer: h.writer, colorize: h.colorize}
+// groupOrAttrs is a call to WithGroup (name) or WithAttrs (attrs),
+// kept in order to nest the attributes of the records.
+type groupOrAttrs struct {
+	group string
+	attrs []slog.Attr
 }
 
-func (h *Handler) computeAttrs(
-	ctx context.Context,
-	r slog.Record,
-) (map[string]any, error) {
-	h.m.Lock()
-	defer func() {
-		h.b.Reset()
-		h.m.Unlock()
-	}()
-	if err := h.h.Handle(ctx, r); err != nil {
-		return nil, fmt.Errorf("error when calling inner handler's Handle: %w", err)
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.inner != nil {
+		return h.inner.Enabled(ctx, level)
 	}
 
-	var attrs map[string]any
-	err := json.Unmarshal(h.b.Bytes(), &attrs)
-	if err != nil {
-		return nil, fmt.Errorf("error when unmarshaling inner handler's Handle result: %w", err)
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
 	}
-	return attrs, nil
+
+	return level >= minLevel
 }
 
-func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
-	colorize := func(code int, value string) string {
-		return value
-	}
-	if h.colorize {
-		colorize = colorizer
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
 	}
 
-	var level string
-	levelAttr := slog.Attr{
-		Key:   slog.LevelKey,
-		Value: slog.AnyValue(r.Level),
-	}
-	if h.r != nil {
-		levelAttr = h.r([]string{}, levelAttr)
+	return h.with(groupOrAttrs{attrs: attrs})
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
 	}
 
-	if !levelAttr.Equal(slog.Attr{}) {
-		level = levelAttr.Value.String() + ":"
+	return h.with(groupOrAttrs{group: name})
+}
 
-		if r.Level <= slog.LevelDebug {
-			level = colorize(lightGray, level)
-		} else if r.Level <= slog.LevelInfo {
-			level = colorize(cyan, level)
-		} else if r.Level < slog.LevelWarn {
-			level = colorize(lightBlue, level)
-		} else if r.Level < slog.LevelError {
-			level = colorize(lightYellow, level)
-		} else if r.Level <= slog.LevelError+1 {
-			level = colorize(lightRed, level)
-		} else if r.Level > slog.LevelError+1 {
-			level = colorize(lightMagenta, level)
+func (h *Handler) with(goa groupOrAttrs) *Handler {
+	h2 := *h
+	if h.inner != nil {
+		if goa.group != "" {
+			h2.inner = h.inner.WithGroup(goa.group)
+		} else {
+			h2.inner = h.inner.WithAttrs(goa.attrs)
 		}
+		return &h2
 	}
 
-	var timestamp string
-	timeAttr := slog.Attr{
-		Key:   slog.TimeKey,
-		Value: slog.StringValue(r.Time.Format(timeFormat)),
-	}
-	if h.r != nil {
-		timeAttr = h.r([]string{}, timeAttr)
-	}
-	if !timeAttr.Equal(slog.Attr{}) {
-		timestamp = colorize(lightGray, timeAttr.Value.String())
-	}
+	h2.goas = make([]groupOrAttrs, len(h.goas)+1)
+	copy(h2.goas, h.goas)
+	h2.goas[len(h.goas)] = goa
 
-	var msg string
-	msgAttr := slog.Attr{
-		Key:   slog.MessageKey,
-		Value: slog.StringValue(r.Message),
-	}
-	if h.r != nil {
-		msgAttr = h.r([]string{}, msgAttr)
-	}
-	if !msgAttr.Equal(slog.Attr{}) {
-		msg = colorize(white, msgAttr.Value.String())
-	}
+	return &h2
+}
 
-	attrs, err := h.computeAttrs(ctx, r)
-	if err != nil {
-		return err
-	}
-	bytes, err := json.MarshalIndent(attrs, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error when marshaling attrs: %w", err)
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if h.inner != nil {
+		return h.inner.Handle(ctx, r)
 	}
 
-	out := strings.Builder{}
-	if len(timestamp) > 0 {
-		out.WriteString(timestamp)
-		out.WriteString(" ")
-	}
-	if len(level) > 0 {
-		out.WriteString(level)
-		out.WriteString(" ")
-	}
-	if len(msg) > 0 {
-		out.WriteString(msg)
-		out.WriteString(" ")
-	}
-	if len(bytes) > 0 {
-		out.WriteString(colorize(darkGray, string(bytes)))
-	}
+	out := h.formatPretty(r)
 
-	_, err = io.WriteString(h.writer, out.String()+"\n")
-	if err != nil {
-		return err
-	}
+	h.m.Lock()
+	defer h.m.Unlock()
 
-	return nil
-}
+	_, err := h.writer.Write(out)
 
-func suppressDefaults(
-	next func([]string, slog.Attr) slog.Attr,
-) func([]string, slog.Attr) slog.Attr {
-	return func(groups []string, a slog.Attr) slog.Attr {
-		if a.Key == slog.TimeKey ||
-			a.Key == slog.LevelKey ||
-			a.Key == slog.MessageKey {
-			return slog.Attr{}
-		}
-		if next == nil {
-			return a
-		}
-		return next(groups, a)
-	}
+	return err
 }
 
+// New creates a handler with the options of the standard handlers
+// (level, source and attribute replacement), writing to stdout in
+// pretty mode without colors unless other options are given.
 func New(handlerOptions *slog.HandlerOptions, options ...Option) *Handler {
 	if handlerOptions == nil {
 		handlerOptions = &slog.HandlerOptions{}
 	}
 
-	buf := &bytes.Buffer{}
 	handler := &Handler{
-		b: buf,
-		h: slog.NewJSONHandler(buf, &slog.HandlerOptions{
-			Level:       handlerOptions.Level,
-			AddSource:   handlerOptions.AddSource,
-			ReplaceAttr: suppressDefaults(handlerOptions.ReplaceAttr),
-		}),
-		r: handlerOptions.ReplaceAttr,
-		m: &sync.Mutex{},
+		opts:   *handlerOptions,
+		writer: os.Stdout,
+		m:      &sync.Mutex{},
 	}
 
 	for _, opt := range options {
 		opt(handler)
 	}
 
+	switch handler.mode {
+	case ModeJSON:
+		handler.inner = slog.NewJSONHandler(handler.writer, &handler.opts)
+	case ModeLogfmt:
+		handler.inner = slog.NewTextHandler(handler.writer, &handler.opts)
+	}
+
 	return handler
 }
 
-func NewHandler(opts *slog.HandlerOptions) *Handler {
-	return New(opts, WithDestinationWriter(os.Stdout), WithColor())
+// NewHandler creates a handler writing to stdout in the given
+// mode. The pretty mode is colorized when stdout is a terminal.
+func NewHandler(opts *slog.HandlerOptions, mode Mode) *Handler {
+	options := []Option{WithDestinationWriter(os.Stdout), WithMode(mode)}
+	if IsTerminal(os.Stdout) {
+		options = append(options, WithColor())
+	}
+
+	return New(opts, options...)
+}
+
+// IsTerminal reports whether the file is a terminal (a character
+// device), which can show colors unless NO_COLOR is set
+// (https://no-color.org).
+func IsTerminal(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
 type Option func(h *Handler)
@@ -227,13 +222,21 @@ func WithDestinationWriter(writer io.Writer) Option {
 	}
 }
 
+// WithColor colorizes the output of the pretty mode.
 func WithColor() Option {
 	return func(h *Handler) {
 		h.colorize = true
 	}
 }
 
+func WithMode(mode Mode) Option {
+	return func(h *Handler) {
+		h.mode = mode
+	}
+}
+
 /* REFERENCES:
 https://dusted.codes/creating-a-pretty-console-logger-using-gos-slog-package
 
+https://github.com/golang/example/blob/master/slog-handler-guide/README.md
 */
@@ -0,0 +1,233 @@
+package prettylog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the time of the rotation in the backup names.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is a log file (io.Writer) that is rotated when it
+// reaches its maximum size: it is renamed with the time of the
+// rotation (app.log -> app-2006-01-02T15-04-05.000.log) and,
+// in the background, optionally compressed with gzip. The backups
+// older than the maximum age (if any) are deleted.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+
+	mu     sync.Mutex
+	file   *os.File // nil if it could not be reopened (see rotate)
+	size   int64
+	closed bool
+	bg     sync.WaitGroup // compression and cleanup of the backups
+}
+
+// OpenRotatingFile opens (or creates) the log file, appending to it.
+// A maxAge of zero keeps the backups forever.
+func OpenRotatingFile(
+	path string, maxSize int64, maxAge time.Duration, compress bool,
+) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("the maximum size of %s must be positive", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	rf := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		compress: compress,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file, rf.size = f, info.Size()
+
+	return nil
+}
+
+// Write writes a record, rotating the file first if the record
+// does not fit in it (unless the file is empty: a record
+// larger than the maximum size is written anyway).
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		// If the file could not be renamed, the record is
+		// written to it and the rotation retried with the next one
+		if err := rf.rotate(); err != nil && rf.file == nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// rotate renames the file and opens a new one. If the file cannot be
+// renamed (e.g. a transient EACCES), it is reopened; if no file can be
+// opened (e.g. ENOSPC), rf.file is left nil and Write tries again.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	rf.file = nil
+	if err != nil {
+		return err
+	}
+
+	backup := rf.backupName(time.Now())
+	if err := os.Rename(rf.path, backup); err != nil {
+		if openErr := rf.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.bg.Add(1)
+	go func() {
+		defer rf.bg.Done()
+
+		if rf.compress {
+			// If it fails, the backup is kept uncompressed
+			_ = compressFile(backup)
+		}
+		rf.removeOld()
+	}()
+
+	return nil
+}
+
+// backupName returns a name for the backup that does not exist
+// yet (compressed or not), in case of several rotations in the
+// same millisecond.
+func (rf *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(rf.path)
+	base := strings.TrimSuffix(rf.path, ext) + "-" + t.Format(backupTimeFormat)
+
+	name := base + ext
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+
+	return name
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+
+	return err == nil
+}
+
+// removeOld deletes the backups older than the maximum age.
+func (rf *RotatingFile) removeOld() {
+	if rf.maxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(rf.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(rf.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+
+	limit := time.Now().Add(-rf.maxAge)
+	for _, backup := range backups {
+		if info, err := os.Stat(backup); err == nil && info.ModTime().Before(limit) {
+			os.Remove(backup)
+		}
+	}
+}
+
+// compressFile replaces the file with its gzip version (file.gz).
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Close closes the file, once the backups are compressed.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.bg.Wait()
+
+	rf.closed = true
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+
+	return err
+}
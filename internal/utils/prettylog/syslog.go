@@ -0,0 +1,134 @@
+package prettylog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// facilityUser is the syslog facility of the messages (user-level).
+const facilityUser = 1
+
+// SyslogHandler sends the records to a syslog server over UDP, in
+// the format of RFC 5424 with the attributes as logfmt. Locally,
+// the messages can be seen with e.g. `nc -klu 5514`.
+type SyslogHandler struct {
+	conn     net.Conn
+	tag      string
+	hostname string
+
+	inner slog.Handler // formats the message into b
+	b     *bytes.Buffer
+	m     *sync.Mutex
+}
+
+// DialSyslog creates the handler sending to the server (host:port)
+// with the tag (application name). Since UDP has no connection, an
+// absent server is not an error: the messages are just lost.
+func DialSyslog(addr, tag string, opts *slog.HandlerOptions) (*SyslogHandler, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	if opts == nil {
+		opts = &slog.HandlerOptions{}
+	}
+	replace := opts.ReplaceAttr
+	b := &bytes.Buffer{}
+
+	return &SyslogHandler{
+		conn:     conn,
+		tag:      tag,
+		hostname: hostname,
+		inner: slog.NewTextHandler(b, &slog.HandlerOptions{
+			Level:     opts.Level,
+			AddSource: opts.AddSource,
+			// The time goes in the header of the message
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				if replace == nil {
+					return a
+				}
+				return replace(groups, a)
+			},
+		}),
+		b: b,
+		m: &sync.Mutex{},
+	}, nil
+}
+
+func (sh *SyslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return sh.inner.Enabled(ctx, level)
+}
+
+func (sh *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	sh2 := *sh
+	sh2.inner = sh.inner.WithAttrs(attrs)
+
+	return &sh2
+}
+
+func (sh *SyslogHandler) WithGroup(name string) slog.Handler {
+	sh2 := *sh
+	sh2.inner = sh.inner.WithGroup(name)
+
+	return &sh2
+}
+
+func (sh *SyslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	sh.m.Lock()
+	defer func() {
+		sh.b.Reset()
+		sh.m.Unlock()
+	}()
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	fmt.Fprintf(sh.b, "<%d>1 %s %s %s %d - - ",
+		facilityUser*8+severity(r.Level),
+		r.Time.Format(time.RFC3339Nano),
+		sh.hostname,
+		sh.tag,
+		os.Getpid(),
+	)
+	if err := sh.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+
+	_, err := sh.conn.Write(bytes.TrimSuffix(sh.b.Bytes(), []byte("\n")))
+
+	return err
+}
+
+// Close closes the socket.
+func (sh *SyslogHandler) Close() error {
+	return sh.conn.Close()
+}
+
+// severity maps the level to the syslog severity.
+func severity(level slog.Level) int {
+	switch {
+	case level < slog.LevelInfo:
+		return 7 // debug
+	case level < slog.LevelWarn:
+		return 6 // informational
+	case level < slog.LevelError:
+		return 4 // warning
+	case level == slog.LevelError:
+		return 3 // error
+	}
+
+	return 2 // critical
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limit allows Rate requests every Per, with bursts of up to
+// Burst requests in a row. It behaves as a token bucket of
+// capacity Burst refilled at Rate/Per, implemented with the
+// generic cell rate algorithm (GCRA): the only state of a key
+// is its theoretical arrival time (TAT), the time at which
+// its bucket will be full again.
+type Limit struct {
+	Rate  int
+	Per   time.Duration
+	Burst int
+}
+
+// Interval is the time it takes to refill one token.
+func (l Limit) Interval() time.Duration {
+	return l.Per / time.Duration(l.Rate)
+}
+
+// Tolerance is how far in the future the TAT can be, that
+// is, how long it takes to refill the whole bucket.
+func (l Limit) Tolerance() time.Duration {
+	return l.Interval() * time.Duration(l.Burst)
+}
+
+// Next applies a request at `now` to the TAT of a key: it returns the
+// new TAT if the request is allowed, or how long the client must
+// wait (retryAfter > 0) otherwise, in which case the TAT is unchanged.
+func (l Limit) Next(tat, now time.Time) (newTAT time.Time, retryAfter time.Duration) {
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTAT = tat.Add(l.Interval())
+	if allowAt := newTAT.Add(-l.Tolerance()); now.Before(allowAt) {
+		return tat, allowAt.Sub(now)
+	}
+
+	return newTAT, 0
+}
+
+// Store keeps the state of the keys. Allow consumes a token
+// of the key and returns how long the client must wait
+// if there is none left (0 if the request is allowed).
+type Store interface {
+	Allow(ctx context.Context, key string, l Limit, now time.Time) (time.Duration, error)
+}
+
+// MemoryStore keeps the state in memory, for a single process.
+type MemoryStore struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: map[string]time.Time{}}
+}
+
+func (ms *MemoryStore) Allow(_ context.Context, key string, l Limit, now time.Time) (time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// The keys whose bucket is full again are the same
+	// as the absent ones, so they are removed from time to time
+	if now.Sub(ms.lastSweep) > time.Minute {
+		for k, tat := range ms.tats {
+			if tat.Before(now) {
+				delete(ms.tats, k)
+			}
+		}
+		ms.lastSweep = now
+	}
+
+	tat, retryAfter := l.Next(ms.tats[key], now)
+	if retryAfter > 0 {
+		return retryAfter, nil
+	}
+	ms.tats[key] = tat
+
+	return 0, nil
+}
@@ -0,0 +1,134 @@
+package reqctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxIDLen is the maximum length of a request ID received from
+// the client (e.g. set by a proxy or a load balancer).
+const maxIDLen = 128
+
+type ctxKey struct{}
+
+// Request is the metadata of a request, for the logs and the metrics:
+// its ID and what the application did with it (the route, the
+// handler and its error, the user). It is injected into the context
+// at the beginning of the request, so the pointer lets the inner
+// middlewares and the handlers annotate it for the outer ones.
+// Nothing of it is sent to the client but the ID.
+// It is written only by the goroutine of the request.
+type Request struct {
+	ID      string
+	UserID  int
+	Pattern string // of the route matched by the ServeMux
+	Handler string
+	Err     string
+	// Quiet requests (e.g. the health probes) are
+	// left out of the access log, unless they fail.
+	Quiet bool
+}
+
+// With creates a new context that has the request injected.
+func With(ctx context.Context, req *Request) context.Context {
+
+	return context.WithValue(ctx, ctxKey{}, req)
+}
+
+// From tries to retrieve the request of the given context.
+// If it does not exist (e.g. in a background worker), nil is returned.
+func From(ctx context.Context) *Request {
+	if req, ok := ctx.Value(ctxKey{}).(*Request); ok {
+
+		return req
+	}
+
+	return nil
+}
+
+// ID returns the request ID of the given context, or
+// an empty string if the context has no request.
+func ID(ctx context.Context) string {
+	if req := From(ctx); req != nil {
+
+		return req.ID
+	}
+
+	return ""
+}
+
+// NewID returns a random request ID (16 bytes in hexadecimal).
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// ValidID reports whether an ID received from the client can be used:
+// it is not empty, not too long and only has characters that are safe
+// in the logs and the headers (letters, digits and `-_.:`).
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// LogHandler adds the request ID and the user ID (if authenticated)
+// to the records logged with the context of a request (the
+// `...Context` methods of slog.Logger), so that all the lines of a
+// request, from the middlewares to the services, can be correlated.
+// If the context has a span, its trace and span IDs are added
+// too, to find the lines of a trace (and the other way round).
+type LogHandler struct {
+	slog.Handler
+}
+
+func NewLogHandler(h slog.Handler) *LogHandler {
+
+	return &LogHandler{h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if req := From(ctx); req != nil {
+		r.AddAttrs(slog.String("request_id", req.ID))
+		if req.UserID != 0 {
+			r.AddAttrs(slog.Int("user_id", req.UserID))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+
+	return &LogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+
+	return &LogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,116 @@
+package static
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// hashLen is the length of the fingerprint in the file names (hex).
+const hashLen = 12
+
+// Assets serves the static files with content-hashed URLs: the
+// fingerprint of `css/main.css` makes it `css/main.<hash>.css`, so
+// the browsers can cache them forever, and a new version of a file
+// gets a new URL. In development mode the files are read from disk
+// on every request, without fingerprints nor caching, so that they
+// can be edited while the application runs.
+type Assets struct {
+	fsys   fs.FS
+	prefix string
+	dev    bool
+	hashes map[string]string // file name -> fingerprint
+}
+
+// New hashes the files of fsys, which are served under the URL
+// prefix (e.g. "/assets/"). In development mode nothing is hashed.
+func New(fsys fs.FS, prefix string, dev bool) (*Assets, error) {
+	a := &Assets{
+		fsys:   fsys,
+		prefix: prefix,
+		dev:    dev,
+		hashes: map[string]string{},
+	}
+	if dev {
+		return a, nil
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		a.hashes[name] = hex.EncodeToString(sum[:])[:hashLen]
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Has reports whether the file exists.
+func (a *Assets) Has(name string) bool {
+	if a.dev {
+		_, err := fs.Stat(a.fsys, name)
+		return err == nil
+	}
+
+	_, ok := a.hashes[name]
+	return ok
+}
+
+// URL returns the (fingerprinted) URL of the file. It is meant
+// to be used in the templates, e.g. `{{ asset "css/main.css" }}`.
+func (a *Assets) URL(name string) string {
+	hash, ok := a.hashes[name]
+	if !ok {
+		return a.prefix + name
+	}
+
+	ext := path.Ext(name)
+
+	return a.prefix + strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// ServeHTTP serves the file of the URL, with the prefix already
+// stripped. The fingerprinted URLs are immutable; the rest
+// (including outdated fingerprints) have to be revalidated.
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, hash := a.unhash(r.URL.Path)
+
+	if !a.dev && hash != "" && hash == a.hashes[name] {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeFileFS(w, r, a.fsys, name)
+}
+
+// unhash removes the fingerprint of a file name, if it has one.
+func (a *Assets) unhash(name string) (string, string) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	i := strings.LastIndexByte(base, '.')
+	if i < 0 || len(base)-i-1 != hashLen {
+		return name, ""
+	}
+
+	if _, err := hex.DecodeString(base[i+1:]); err != nil {
+		return name, ""
+	}
+
+	return base[:i] + ext, base[i+1:]
+}
@@ -0,0 +1,45 @@
+package static
+
+import "slices"
+
+// VendorDir is the directory of the assets (relative to
+// their root) where the third-party libraries are vendored.
+const VendorDir = "vendor"
+
+// Vendored are the third-party libraries of the web interface (and
+// the font of main.css), pinned to exact versions, or to their major
+// version for the font. They are not committed: `go generate`
+// downloads them into assets/vendor (see cmd/vendor-assets) before
+// building, as the CI does, and the application does not start if
+// one is missing (see Missing).
+var Vendored = map[string]string{
+	"htmx.min.js":            "https://unpkg.com/htmx.org@2.0.0/dist/htmx.min.js",
+	"response-targets.js":    "https://unpkg.com/htmx.org@1.9.12/dist/ext/response-targets.js",
+	"hyperscript.min.js":     "https://unpkg.com/hyperscript.org@0.9.12/dist/_hyperscript.min.js",
+	"sweetalert2.all.min.js": "https://cdn.jsdelivr.net/npm/sweetalert2@11.12.2/dist/sweetalert2.all.min.js",
+	"tailwindcss.js":         "https://cdn.tailwindcss.com/3.4.5",
+	"daisyui.full.min.css":   "https://cdn.jsdelivr.net/npm/daisyui@4.12.10/dist/full.min.css",
+	"merriweather-sans.woff2": "https://cdn.jsdelivr.net/npm/@fontsource-variable/merriweather-sans@5" +
+		"/files/merriweather-sans-latin-wght-normal.woff2",
+	"merriweather-sans-italic.woff2": "https://cdn.jsdelivr.net/npm/@fontsource-variable/merriweather-sans@5" +
+		"/files/merriweather-sans-latin-wght-italic.woff2",
+}
+
+// VendorURL returns the (fingerprinted) URL of a vendored library.
+func (a *Assets) VendorURL(name string) string {
+	return a.URL(VendorDir + "/" + name)
+}
+
+// Missing returns the vendored libraries that have not been
+// downloaded, in order.
+func (a *Assets) Missing() []string {
+	missing := []string{}
+	for name := range Vendored {
+		if !a.Has(VendorDir + "/" + name) {
+			missing = append(missing, name)
+		}
+	}
+	slices.Sort(missing)
+
+	return missing
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name is the name of the tracer of the application.
+const Name = "github.com/emarifer/go-frameworkless-htmx"
+
+// Exporters of the spans.
+const (
+	// ExporterNone disables the tracing (the spans are not recorded).
+	ExporterNone = "none"
+	// ExporterOTLP sends the spans to an OpenTelemetry collector over
+	// HTTP, configured with the standard variables of the exporter
+	// (OTEL_EXPORTER_OTLP_ENDPOINT, by default http://localhost:4318).
+	ExporterOTLP = "otlp"
+	// ExporterConsole writes the spans as JSON to the standard output
+	// or a file, to try the tracing locally without a collector.
+	ExporterConsole = "console"
+)
+
+// Tracer returns the tracer of the application, from the global
+// provider: it does nothing until Setup installs the SDK.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Setup installs the global tracer provider with the exporter (the
+// console one writes to the file, if not empty, or to the standard
+// output) and the W3C propagation of the trace context and the
+// baggage. The returned function flushes the pending spans and
+// closes the exporter, on shutdown.
+func Setup(
+	ctx context.Context, exporter, file, serviceName, version string,
+) (func(context.Context) error, error) {
+	// The W3C headers are read even if no span is exported,
+	// so that the IDs of the callers reach the logs
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var (
+		exp    sdktrace.SpanExporter
+		closer io.Closer
+		err    error
+	)
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case ExporterConsole:
+		var w io.Writer = os.Stdout
+		if file != "" {
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, err
+			}
+			w, closer = f, f
+		}
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The variables OTEL_SERVICE_NAME and
+	// OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version),
+		),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithProcessPID(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,170 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+
+	return b
+}
+
+// Examples of the appendix A of RFC 8949 within the supported subset.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"00", int64(0)},
+		{"01", int64(1)},
+		{"0a", int64(10)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1864", int64(100)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"1b7fffffffffffffff", int64(1<<63 - 1)},
+		{"20", int64(-1)},
+		{"29", int64(-10)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"3b7fffffffffffffff", int64(-1 << 63)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6161", "a"},
+		{"6449455446", "IETF"},
+		{"62225c", "\"\\"},
+		{"62c3bc", "ü"},
+		{"63e6b0b4", "水"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{
+			int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)},
+		}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{
+			"a": int64(1), "b": []any{int64(2), int64(3)},
+		}},
+		{"826161a161626163", []any{"a", map[any]any{"b": "c"}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, rest, err := decodeCBOR(mustHex(t, tt.in))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(rest) != 0 {
+				t.Errorf("%d bytes left after the item", len(rest))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	got, rest, err := decodeCBOR(mustHex(t, "6161 a0 ff"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "a" {
+		t.Errorf("got %#v, want %q", got, "a")
+	}
+	if !bytes.Equal(rest, []byte{0xa0, 0xff}) {
+		t.Errorf("rest = %x, want a0ff", rest)
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"empty", "", "unexpected end of data"},
+		{"truncated uint8", "18", "unexpected end of data"},
+		{"truncated uint16", "1903", "unexpected end of data"},
+		{"truncated uint32", "1a000f42", "unexpected end of data"},
+		{"truncated uint64", "1b000000e8d4a510", "unexpected end of data"},
+		{"truncated bytes", "44010203", "unexpected end of data"},
+		{"truncated text", "64494554", "unexpected end of data"},
+		{"truncated array", "830102", "unexpected end of data"},
+		{"truncated map key", "a20102", "unexpected end of data"},
+		{"truncated map value", "a101", "unexpected end of data"},
+		{"truncated nested", "a1616182", "unexpected end of data"},
+		{"oversized bytes", "5bffffffffffffffff00", "unexpected end of data"},
+		{"oversized text", "7b7fffffffffffffff61", "unexpected end of data"},
+		{"oversized array", "9bffffffffffffffff00", "unexpected end of data"},
+		{"oversized map", "bb00000000ffffffff0000", "unexpected end of data"},
+		{"uint overflow", "1bffffffffffffffff", "integer overflow"},
+		{"negint overflow", "3b8000000000000000", "integer overflow"},
+		{"indefinite bytes", "5f4101ff", "unsupported additional info 31"},
+		{"indefinite array", "9f01ff", "unsupported additional info 31"},
+		{"reserved info", "1c", "unsupported additional info 28"},
+		{"break", "ff", "unsupported simple value 31"},
+		{"float", "f93c00", "unsupported simple value 25"},
+		{"tag", "c11a514b67b0", "unsupported major type 6"},
+		{"bytes map key", "a142010201", "unsupported map key type"},
+		{"array map key", "a18001", "unsupported map key type"},
+		{"null map key", "a1f601", "unsupported map key type"},
+		{"too deep", strings.Repeat("81", cborMaxDepth+1) + "00", "maximum nesting depth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeCBOR(mustHex(t, tt.in))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q does not contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORMaxDepth(t *testing.T) {
+	in := mustHex(t, strings.Repeat("81", cborMaxDepth)+"00")
+	if _, _, err := decodeCBOR(in); err != nil {
+		t.Errorf("nesting of %d levels: unexpected error: %v", cborMaxDepth, err)
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	for _, s := range []string{
+		"a26161016162820203",
+		"5bffffffffffffffff00",
+		strings.Repeat("81", 20) + "00",
+		testAttestationObject,
+		testCOSEKey,
+	} {
+		f.Add(mustHex(f, s))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, rest, err := decodeCBOR(data)
+		if err == nil && len(rest) > len(data) {
+			t.Errorf("rest longer than the input")
+		}
+		// Must never panic, whatever the input.
+		parsePublicKey(data)
+	})
+}
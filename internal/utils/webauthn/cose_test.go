@@ -0,0 +1,269 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// Minimal CBOR encoder used to build the test vectors.
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
+
+func cborInt(n int64) []byte {
+	if n < 0 {
+		return cborHead(cborNegInt, uint64(-1-n))
+	}
+
+	return cborHead(cborUint, uint64(n))
+}
+
+func cborBytesOf(b []byte) []byte {
+	return append(cborHead(cborBytes, uint64(len(b))), b...)
+}
+
+func cborTextOf(s string) []byte {
+	return append(cborHead(cborText, uint64(len(s))), s...)
+}
+
+// cborMapOf encodes a map from its already
+// encoded keys and values, in that order.
+func cborMapOf(kv ...[]byte) []byte {
+	b := cborHead(cborMap, uint64(len(kv)/2))
+	for _, item := range kv {
+		b = append(b, item...)
+	}
+
+	return b
+}
+
+func coseOKP(pub ed25519.PublicKey) []byte {
+	return cborMapOf(
+		cborInt(coseKty), cborInt(ktyOKP),
+		cborInt(coseAlg), cborInt(AlgEdDSA),
+		cborInt(coseCrv), cborInt(crvEd25519),
+		cborInt(coseX), cborBytesOf(pub),
+	)
+}
+
+func coseEC2(pub *ecdsa.PublicKey) []byte {
+	return cborMapOf(
+		cborInt(coseKty), cborInt(ktyEC2),
+		cborInt(coseAlg), cborInt(AlgES256),
+		cborInt(coseCrv), cborInt(crvP256),
+		cborInt(coseX), cborBytesOf(pub.X.FillBytes(make([]byte, 32))),
+		cborInt(coseY), cborBytesOf(pub.Y.FillBytes(make([]byte, 32))),
+	)
+}
+
+func coseRSA(pub *rsa.PublicKey) []byte {
+	e := binary.BigEndian.AppendUint32(nil, uint32(pub.E))
+	return cborMapOf(
+		cborInt(coseKty), cborInt(ktyRSA),
+		cborInt(coseAlg), cborInt(AlgRS256),
+		cborInt(coseCrv), cborBytesOf(pub.N.Bytes()),
+		cborInt(coseX), cborBytesOf(e[1:]),
+	)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub := ed25519.PublicKey(mustHex(t, testEd25519PublicKey))
+	x := ecKey.X.FillBytes(make([]byte, 32))
+	y := ecKey.Y.FillBytes(make([]byte, 32))
+	one := make([]byte, 32)
+	one[31] = 1
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		wantAlg int64
+		wantErr string
+	}{
+		{"EdDSA vector", mustHex(t, testCOSEKey), AlgEdDSA, ""},
+		{"EdDSA", coseOKP(edPub), AlgEdDSA, ""},
+		{"ES256", coseEC2(&ecKey.PublicKey), AlgES256, ""},
+		{"RS256", coseRSA(&rsaKey.PublicKey), AlgRS256, ""},
+		{"empty", nil, 0, "unexpected end of data"},
+		{"truncated", mustHex(t, testCOSEKey)[:20], 0, "unexpected end of data"},
+		{"not a map", cborBytesOf(edPub), 0, "not a map"},
+		{"no kty", cborMapOf(
+			cborInt(coseAlg), cborInt(AlgEdDSA),
+			cborInt(coseCrv), cborInt(crvEd25519),
+			cborInt(coseX), cborBytesOf(edPub),
+		), 0, "unsupported key type 0 with algorithm -8"},
+		{"unsupported alg", cborMapOf(
+			cborInt(coseKty), cborInt(ktyEC2),
+			cborInt(coseAlg), cborInt(-35), // ES384
+			cborInt(coseCrv), cborInt(2),
+			cborInt(coseX), cborBytesOf(x),
+			cborInt(coseY), cborBytesOf(y),
+		), 0, "unsupported key type 2 with algorithm -35"},
+		{"kty as text", cborMapOf(
+			cborInt(coseKty), cborTextOf("OKP"),
+			cborInt(coseAlg), cborInt(AlgEdDSA),
+			cborInt(coseCrv), cborInt(crvEd25519),
+			cborInt(coseX), cborBytesOf(edPub),
+		), 0, "unsupported key type"},
+		{"EC2 wrong curve", cborMapOf(
+			cborInt(coseKty), cborInt(ktyEC2),
+			cborInt(coseAlg), cborInt(AlgES256),
+			cborInt(coseCrv), cborInt(2),
+			cborInt(coseX), cborBytesOf(x),
+			cborInt(coseY), cborBytesOf(y),
+		), 0, "invalid EC2 key"},
+		{"EC2 short coordinate", cborMapOf(
+			cborInt(coseKty), cborInt(ktyEC2),
+			cborInt(coseAlg), cborInt(AlgES256),
+			cborInt(coseCrv), cborInt(crvP256),
+			cborInt(coseX), cborBytesOf(x[1:]),
+			cborInt(coseY), cborBytesOf(y),
+		), 0, "invalid EC2 key"},
+		{"EC2 missing y", cborMapOf(
+			cborInt(coseKty), cborInt(ktyEC2),
+			cborInt(coseAlg), cborInt(AlgES256),
+			cborInt(coseCrv), cborInt(crvP256),
+			cborInt(coseX), cborBytesOf(x),
+		), 0, "invalid EC2 key"},
+		{"EC2 not on curve", cborMapOf(
+			cborInt(coseKty), cborInt(ktyEC2),
+			cborInt(coseAlg), cborInt(AlgES256),
+			cborInt(coseCrv), cborInt(crvP256),
+			cborInt(coseX), cborBytesOf(one),
+			cborInt(coseY), cborBytesOf(one),
+		), 0, "not on the curve"},
+		{"OKP wrong curve", cborMapOf(
+			cborInt(coseKty), cborInt(ktyOKP),
+			cborInt(coseAlg), cborInt(AlgEdDSA),
+			cborInt(coseCrv), cborInt(7), // Ed448
+			cborInt(coseX), cborBytesOf(edPub),
+		), 0, "invalid OKP key"},
+		{"OKP short key", cborMapOf(
+			cborInt(coseKty), cborInt(ktyOKP),
+			cborInt(coseAlg), cborInt(AlgEdDSA),
+			cborInt(coseCrv), cborInt(crvEd25519),
+			cborInt(coseX), cborBytesOf(edPub[:31]),
+		), 0, "invalid OKP key"},
+		{"RSA short modulus", cborMapOf(
+			cborInt(coseKty), cborInt(ktyRSA),
+			cborInt(coseAlg), cborInt(AlgRS256),
+			cborInt(coseCrv), cborBytesOf(rsaKey.N.Bytes()[:255]),
+			cborInt(coseX), cborBytesOf([]byte{1, 0, 1}),
+		), 0, "invalid RSA key"},
+		{"RSA oversized exponent", cborMapOf(
+			cborInt(coseKty), cborInt(ktyRSA),
+			cborInt(coseAlg), cborInt(AlgRS256),
+			cborInt(coseCrv), cborBytesOf(rsaKey.N.Bytes()),
+			cborInt(coseX), cborBytesOf([]byte{1, 0, 0, 0, 1}),
+		), 0, "invalid RSA key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk, err := parsePublicKey(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %q does not contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pk.alg != tt.wantAlg {
+				t.Errorf("alg = %d, want %d", pk.alg, tt.wantAlg)
+			}
+		})
+	}
+}
+
+func TestPublicKeyVerify(t *testing.T) {
+	data := []byte("authenticator data and client data hash")
+	hash := sha256.Sum256(data)
+
+	edKey := ed25519.NewKeyFromSeed(mustHex(t, testEd25519Seed))
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		sig  []byte
+	}{
+		{"EdDSA", coseOKP(edKey.Public().(ed25519.PublicKey)), ed25519.Sign(edKey, data)},
+		{"ES256", coseEC2(&ecKey.PublicKey), ecSig},
+		{"RS256", coseRSA(&rsaKey.PublicKey), rsaSig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk, err := parsePublicKey(tt.key)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err := pk.verify(data, tt.sig); err != nil {
+				t.Errorf("valid signature rejected: %v", err)
+			}
+
+			tampered := append([]byte(nil), tt.sig...)
+			tampered[len(tampered)/2] ^= 0x01
+			if err := pk.verify(data, tampered); err == nil {
+				t.Error("tampered signature accepted")
+			}
+
+			if err := pk.verify(append(data, '!'), tt.sig); err == nil {
+				t.Error("signature of other data accepted")
+			}
+
+			if err := pk.verify(data, nil); err == nil {
+				t.Error("empty signature accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Timeout (in milliseconds) given to the user to complete a ceremony.
+const Timeout = 120_000
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent = 0x01
+	flagAttested    = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// RelyingParty identifies the application to the authenticators.
+type RelyingParty struct {
+	ID     string // the domain, e.g. `example.com`
+	Name   string
+	Origin string // e.g. `https://example.com`
+}
+
+// Credential is a public key credential registered by a user.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// NewChallenge returns a random challenge of 32 bytes.
+func NewChallenge() ([]byte, error) {
+	c := make([]byte, 32)
+	if _, err := rand.Read(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// EncodeID/DecodeID convert the binary identifiers
+// to/from the base64url form used in the JSON messages.
+func EncodeID(b []byte) string {
+	return b64.EncodeToString(b)
+}
+
+func DecodeID(s string) ([]byte, error) {
+	return b64.DecodeString(s)
+}
+
+// --------- Options sent to the browser ---------
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the `PublicKeyCredentialCreationOptions`
+// (with binary fields in base64url) for navigator.credentials.create.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credParam            `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	ExcludeCredentials     []credDescriptor       `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+}
+
+// RequestOptions are the `PublicKeyCredentialRequestOptions`
+// (with binary fields in base64url) for navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int    `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+// NewCreationOptions builds the options of a registration ceremony.
+// Discoverable credentials are required so that users can later
+// sign in without typing their email.
+func (rp RelyingParty) NewCreationOptions(
+	challenge, userID []byte, name, displayName string, exclude [][]byte,
+) CreationOptions {
+	excl := make([]credDescriptor, 0, len(exclude))
+	for _, id := range exclude {
+		excl = append(excl, credDescriptor{Type: "public-key", ID: EncodeID(id)})
+	}
+
+	return CreationOptions{
+		Challenge: EncodeID(challenge),
+		RP:        rpEntity{ID: rp.ID, Name: rp.Name},
+		User: userEntity{
+			ID:          EncodeID(userID),
+			Name:        name,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []credParam{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            Timeout,
+		Attestation:        "none",
+		ExcludeCredentials: excl,
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "preferred",
+		},
+	}
+}
+
+// NewRequestOptions builds the options of an authentication ceremony.
+func (rp RelyingParty) NewRequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        EncodeID(challenge),
+		RPID:             rp.ID,
+		Timeout:          Timeout,
+		UserVerification: "preferred",
+	}
+}
+
+// --------- Responses of the browser ---------
+
+// RegistrationResponse is the JSON form of the PublicKeyCredential
+// returned by navigator.credentials.create.
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON form of the PublicKeyCredential
+// returned by navigator.credentials.get.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// VerifyRegistration validates the response of a registration
+// ceremony and returns the new credential. In accordance with the
+// attestation conveyance "none", the attestation statement is not
+// verified: only the authenticator data is trusted.
+func (rp RelyingParty) VerifyRegistration(
+	res RegistrationResponse, challenge []byte,
+) (*Credential, error) {
+	if res.Type != "public-key" {
+		return nil, errors.New("invalid credential type")
+	}
+
+	_, err := rp.verifyClientData(
+		res.Response.ClientDataJSON, "webauthn.create", challenge,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	attObj, err := DecodeID(res.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+
+	v, _, err := decodeCBOR(attObj)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+
+	att, ok := v.(map[any]any)
+	if !ok {
+		return nil, errors.New("invalid attestation object")
+	}
+
+	authData, ok := att["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("missing authenticator data")
+	}
+
+	flags, signCount, rest, err := rp.parseAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&flagAttested == 0 {
+		return nil, errors.New("missing attested credential data")
+	}
+
+	// aaguid (16) | credentialIdLength (2) | credentialId | credentialPublicKey
+	if len(rest) < 18 {
+		return nil, errors.New("invalid attested credential data")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("invalid credential id length")
+	}
+	credID := rest[:idLen]
+	rest = rest[idLen:]
+
+	// The COSE key is followed by the extensions (if any),
+	// so its length is known after decoding it.
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	rawKey := rest[:len(rest)-len(after)]
+
+	if _, err := parsePublicKey(rawKey); err != nil {
+		return nil, err
+	}
+
+	if res.ID != EncodeID(credID) {
+		return nil, errors.New("credential id mismatch")
+	}
+
+	return &Credential{
+		ID:        bytes.Clone(credID),
+		PublicKey: bytes.Clone(rawKey),
+		SignCount: signCount,
+	}, nil
+}
+
+// VerifyAssertion validates the response of an authentication
+// ceremony against the stored credential and returns its new
+// signature counter.
+func (rp RelyingParty) VerifyAssertion(
+	res AssertionResponse, challenge []byte, cred Credential,
+) (uint32, error) {
+	if res.Type != "public-key" {
+		return 0, errors.New("invalid credential type")
+	}
+
+	if res.ID != EncodeID(cred.ID) {
+		return 0, errors.New("credential id mismatch")
+	}
+
+	cdJSON, err := rp.verifyClientData(
+		res.Response.ClientDataJSON, "webauthn.get", challenge,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	authData, err := DecodeID(res.Response.AuthenticatorData)
+	if err != nil {
+		return 0, fmt.Errorf("invalid authenticator data: %w", err)
+	}
+
+	_, signCount, _, err := rp.parseAuthData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	sig, err := DecodeID(res.Response.Signature)
+	if err != nil {
+		return 0, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	pub, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// The signature covers authenticatorData || SHA-256(clientDataJSON)
+	cdHash := sha256.Sum256(cdJSON)
+	signed := append(bytes.Clone(authData), cdHash[:]...)
+	if err := pub.verify(signed, sig); err != nil {
+		return 0, err
+	}
+
+	// A counter that does not increase is a signal that
+	// the authenticator may have been cloned. Authenticators
+	// that do not implement it always return zero.
+	if (signCount != 0 || cred.SignCount != 0) && signCount <= cred.SignCount {
+		return 0, errors.New("signature counter did not increase")
+	}
+
+	return signCount, nil
+}
+
+// verifyClientData checks the type, challenge and origin
+// of the client data and returns its raw JSON.
+func (rp RelyingParty) verifyClientData(
+	encoded, ceremony string, challenge []byte,
+) ([]byte, error) {
+	raw, err := DecodeID(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+
+	if cd.Type != ceremony {
+		return nil, fmt.Errorf("unexpected ceremony type %q", cd.Type)
+	}
+
+	expected := EncodeID(challenge)
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(expected)) != 1 {
+		return nil, errors.New("challenge mismatch")
+	}
+
+	if cd.Origin != rp.Origin {
+		return nil, fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+
+	return raw, nil
+}
+
+// parseAuthData checks the header of the authenticator data
+// (RP ID hash and user presence) and returns the flags,
+// the signature counter and the remaining bytes.
+func (rp RelyingParty) parseAuthData(
+	authData []byte,
+) (byte, uint32, []byte, error) {
+	// rpIdHash (32) | flags (1) | signCount (4)
+	if len(authData) < 37 {
+		return 0, 0, nil, errors.New("authenticator data too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData[:32], rpIDHash[:]) != 1 {
+		return 0, 0, nil, errors.New("RP ID hash mismatch")
+	}
+
+	flags := authData[32]
+	if flags&flagUserPresent == 0 {
+		return 0, 0, nil, errors.New("user not present")
+	}
+
+	signCount := binary.BigEndian.Uint32(authData[33:37])
+
+	return flags, signCount, authData[37:], nil
+}
+
+/* REFERENCES:
+https://www.w3.org/TR/webauthn-2/#sctn-registering-a-new-credential
+https://www.w3.org/TR/webauthn-2/#sctn-verifying-assertion
+https://www.rfc-editor.org/rfc/rfc8949.html (CBOR)
+https://www.rfc-editor.org/rfc/rfc9053.html (COSE)
+*/
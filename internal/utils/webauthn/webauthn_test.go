@@ -0,0 +1,560 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Known-good vectors of a ceremony for `localhost` with the key pair of
+// the test 1 of RFC 8032 (Ed25519 signatures are deterministic): the
+// attestation object ("none") of the registration and the authenticator
+// data, client data and signature of the first assertion.
+const (
+	testEd25519Seed      = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	testEd25519PublicKey = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+
+	testCredentialID = "credential-id-01"
+
+	testCOSEKey = "a4010103272006215820" + testEd25519PublicKey
+
+	testAttestationObject = "a363666d74646e6f6e656761747453746d74a0686175746844617461" +
+		"5871" + "49960de5880e8c687434170f6476605b8fe4aeb9a28632c7995cf3ba831d9763" +
+		"45" + "00000000" + "00000000000000000000000000000000" +
+		"0010" + "63726564656e7469616c2d69642d3031" + testCOSEKey
+
+	testAuthenticatorData = "49960de5880e8c687434170f6476605b8fe4aeb9a28632c7995cf3ba831d9763" +
+		"05" + "00000001"
+
+	testClientDataJSON = `{"type":"webauthn.get",` +
+		`"challenge":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY",` +
+		`"origin":"http://localhost:3000","crossOrigin":false}`
+
+	testSignature = "e5c9b97de6685da600dad713e3dc50805c8722210f52077323385519b2d9b5fa" +
+		"4f9db283f8be1a5bd065ae1f1998c0deaeba3a10b220669d9877f57f1cc1a903"
+)
+
+var (
+	testRP = RelyingParty{
+		ID:     "localhost",
+		Name:   "Test",
+		Origin: "http://localhost:3000",
+	}
+	testChallenge = []byte("0123456789abcdef0123456789abcdef")
+)
+
+func encodeClientData(t testing.TB, typ string, challenge []byte, origin string) string {
+	t.Helper()
+	raw, err := json.Marshal(clientData{
+		Type:      typ,
+		Challenge: EncodeID(challenge),
+		Origin:    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return EncodeID(raw)
+}
+
+// buildAuthData returns the header of the authenticator
+// data followed by the given attested credential data.
+func buildAuthData(rpID string, flags byte, signCount uint32, attested []byte) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	b := append(hash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, signCount)
+
+	return append(b, attested...)
+}
+
+func buildAttestedData(credID, coseKey []byte) []byte {
+	b := make([]byte, 16) // aaguid
+	b = binary.BigEndian.AppendUint16(b, uint16(len(credID)))
+	b = append(b, credID...)
+
+	return append(b, coseKey...)
+}
+
+func buildAttestationObject(authData []byte) []byte {
+	return cborMapOf(
+		cborTextOf("fmt"), cborTextOf("none"),
+		cborTextOf("attStmt"), cborMapOf(),
+		cborTextOf("authData"), cborBytesOf(authData),
+	)
+}
+
+func TestVerifyRegistrationVector(t *testing.T) {
+	var res RegistrationResponse
+	res.ID = EncodeID([]byte(testCredentialID))
+	res.Type = "public-key"
+	res.Response.ClientDataJSON = encodeClientData(
+		t, "webauthn.create", testChallenge, testRP.Origin,
+	)
+	res.Response.AttestationObject = EncodeID(mustHex(t, testAttestationObject))
+
+	cred, err := testRP.VerifyRegistration(res, testChallenge)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(cred.ID) != testCredentialID {
+		t.Errorf("credential id = %q, want %q", cred.ID, testCredentialID)
+	}
+	if !bytes.Equal(cred.PublicKey, mustHex(t, testCOSEKey)) {
+		t.Errorf("public key = %x, want %s", cred.PublicKey, testCOSEKey)
+	}
+	if cred.SignCount != 0 {
+		t.Errorf("sign count = %d, want 0", cred.SignCount)
+	}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCOSE := coseEC2(&ecKey.PublicKey)
+	credID := []byte(testCredentialID)
+	const flagsAT = flagUserPresent | flagAttested
+
+	// The extensions (flag ED) follow the credential public key.
+	extensions := cborMapOf(cborTextOf("credProtect"), cborInt(1))
+
+	tests := []struct {
+		name     string
+		typ      string
+		id       []byte
+		cd       string // client data (default, webauthn.create)
+		attObj   []byte // attestation object (default, from authData)
+		authData []byte
+		wantErr  string
+	}{
+		{
+			name:     "ES256",
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+		},
+		{
+			name: "ES256 with extensions",
+			authData: buildAuthData(testRP.ID, flagsAT|0x80, 7,
+				append(buildAttestedData(credID, ecCOSE), extensions...)),
+		},
+		{
+			name:     "wrong credential type",
+			typ:      "password",
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "invalid credential type",
+		},
+		{
+			name:     "wrong ceremony",
+			cd:       encodeClientData(t, "webauthn.get", testChallenge, testRP.Origin),
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "unexpected ceremony type",
+		},
+		{
+			name:     "wrong challenge",
+			cd:       encodeClientData(t, "webauthn.create", []byte("other"), testRP.Origin),
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "challenge mismatch",
+		},
+		{
+			name:     "wrong origin",
+			cd:       encodeClientData(t, "webauthn.create", testChallenge, "https://evil.example"),
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "unexpected origin",
+		},
+		{
+			name:     "client data not JSON",
+			cd:       EncodeID([]byte("{")),
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "invalid client data",
+		},
+		{
+			name:     "client data not base64url",
+			cd:       "e30=",
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "invalid client data",
+		},
+		{
+			name:    "truncated attestation object",
+			attObj:  mustHex(t, testAttestationObject)[:100],
+			wantErr: "invalid attestation object",
+		},
+		{
+			name:    "attestation object not a map",
+			attObj:  cborBytesOf(mustHex(t, testAttestationObject)),
+			wantErr: "invalid attestation object",
+		},
+		{
+			name:    "missing authData",
+			attObj:  cborMapOf(cborTextOf("fmt"), cborTextOf("none")),
+			wantErr: "missing authenticator data",
+		},
+		{
+			name:     "authData too short",
+			authData: buildAuthData(testRP.ID, flagsAT, 0, nil)[:36],
+			wantErr:  "authenticator data too short",
+		},
+		{
+			name:     "wrong rpIdHash",
+			authData: buildAuthData("evil.example", flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "RP ID hash mismatch",
+		},
+		{
+			name:     "user not present",
+			authData: buildAuthData(testRP.ID, flagAttested, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "user not present",
+		},
+		{
+			name:     "no attested credential data",
+			authData: buildAuthData(testRP.ID, flagUserPresent, 0, nil),
+			wantErr:  "missing attested credential data",
+		},
+		{
+			name:     "truncated attested credential data",
+			authData: buildAuthData(testRP.ID, flagsAT, 0, make([]byte, 17)),
+			wantErr:  "invalid attested credential data",
+		},
+		{
+			name: "credential id length beyond the data",
+			authData: buildAuthData(testRP.ID, flagsAT, 0,
+				buildAttestedData(credID, nil)[:18+len(credID)-1]),
+			wantErr: "invalid credential id length",
+		},
+		{
+			name: "truncated public key",
+			authData: buildAuthData(testRP.ID, flagsAT, 0,
+				buildAttestedData(credID, ecCOSE[:len(ecCOSE)-1])),
+			wantErr: "invalid credential public key",
+		},
+		{
+			name: "unsupported public key",
+			authData: buildAuthData(testRP.ID, flagsAT, 0,
+				buildAttestedData(credID, cborMapOf(cborInt(coseKty), cborInt(ktyEC2)))),
+			wantErr: "unsupported key type",
+		},
+		{
+			name:     "credential id mismatch",
+			id:       []byte("another-id"),
+			authData: buildAuthData(testRP.ID, flagsAT, 0, buildAttestedData(credID, ecCOSE)),
+			wantErr:  "credential id mismatch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res RegistrationResponse
+			res.Type = "public-key"
+			if tt.typ != "" {
+				res.Type = tt.typ
+			}
+			res.ID = EncodeID(credID)
+			if tt.id != nil {
+				res.ID = EncodeID(tt.id)
+			}
+			res.Response.ClientDataJSON = tt.cd
+			if tt.cd == "" {
+				res.Response.ClientDataJSON = encodeClientData(
+					t, "webauthn.create", testChallenge, testRP.Origin,
+				)
+			}
+			attObj := tt.attObj
+			if attObj == nil {
+				attObj = buildAttestationObject(tt.authData)
+			}
+			res.Response.AttestationObject = EncodeID(attObj)
+
+			cred, err := testRP.VerifyRegistration(res, testChallenge)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %q does not contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(cred.ID, credID) {
+				t.Errorf("credential id = %q, want %q", cred.ID, credID)
+			}
+			// The extensions must not be part of the stored key.
+			if !bytes.Equal(cred.PublicKey, ecCOSE) {
+				t.Errorf("public key = %x, want %x", cred.PublicKey, ecCOSE)
+			}
+			if want := binary.BigEndian.Uint32(tt.authData[33:37]); cred.SignCount != want {
+				t.Errorf("sign count = %d, want %d", cred.SignCount, want)
+			}
+		})
+	}
+}
+
+func testCredential(t testing.TB, signCount uint32) Credential {
+	return Credential{
+		ID:        []byte(testCredentialID),
+		PublicKey: mustHex(t, testCOSEKey),
+		SignCount: signCount,
+	}
+}
+
+func TestVerifyAssertionVector(t *testing.T) {
+	var res AssertionResponse
+	res.ID = EncodeID([]byte(testCredentialID))
+	res.Type = "public-key"
+	res.Response.ClientDataJSON = EncodeID([]byte(testClientDataJSON))
+	res.Response.AuthenticatorData = EncodeID(mustHex(t, testAuthenticatorData))
+	res.Response.Signature = EncodeID(mustHex(t, testSignature))
+
+	signCount, err := testRP.VerifyAssertion(res, testChallenge, testCredential(t, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if signCount != 1 {
+		t.Errorf("sign count = %d, want 1", signCount)
+	}
+}
+
+// assertion describes an assertion signed with the key of the vectors.
+type assertion struct {
+	rpID      string
+	flags     byte
+	signCount uint32
+	cd        []byte
+}
+
+func (a assertion) response(t testing.TB) AssertionResponse {
+	t.Helper()
+	authData := buildAuthData(a.rpID, a.flags, a.signCount, nil)
+	cdHash := sha256.Sum256(a.cd)
+	key := ed25519.NewKeyFromSeed(mustHex(t, testEd25519Seed))
+
+	var res AssertionResponse
+	res.ID = EncodeID([]byte(testCredentialID))
+	res.Type = "public-key"
+	res.Response.ClientDataJSON = EncodeID(a.cd)
+	res.Response.AuthenticatorData = EncodeID(authData)
+	res.Response.Signature = EncodeID(
+		ed25519.Sign(key, append(bytes.Clone(authData), cdHash[:]...)),
+	)
+
+	return res
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	cd, err := DecodeID(encodeClientData(t, "webauthn.get", testChallenge, testRP.Origin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := assertion{rpID: testRP.ID, flags: flagUserPresent, signCount: 1, cd: cd}
+
+	decode := func(s string) []byte {
+		b, err := DecodeID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		a       assertion
+		tamper  func(*AssertionResponse)
+		cred    Credential
+		wantErr string
+	}{
+		{name: "valid", a: valid, cred: testCredential(t, 0)},
+		{
+			name:    "wrong credential type",
+			a:       valid,
+			tamper:  func(r *AssertionResponse) { r.Type = "password" },
+			cred:    testCredential(t, 0),
+			wantErr: "invalid credential type",
+		},
+		{
+			name:    "credential id mismatch",
+			a:       valid,
+			tamper:  func(r *AssertionResponse) { r.ID = EncodeID([]byte("another-id")) },
+			cred:    testCredential(t, 0),
+			wantErr: "credential id mismatch",
+		},
+		{
+			name: "wrong ceremony",
+			a: assertion{rpID: testRP.ID, flags: flagUserPresent, signCount: 1,
+				cd: decode(encodeClientData(t, "webauthn.create", testChallenge, testRP.Origin))},
+			cred:    testCredential(t, 0),
+			wantErr: "unexpected ceremony type",
+		},
+		{
+			name: "wrong challenge",
+			a: assertion{rpID: testRP.ID, flags: flagUserPresent, signCount: 1,
+				cd: decode(encodeClientData(t, "webauthn.get", []byte("other"), testRP.Origin))},
+			cred:    testCredential(t, 0),
+			wantErr: "challenge mismatch",
+		},
+		{
+			name: "wrong origin",
+			a: assertion{rpID: testRP.ID, flags: flagUserPresent, signCount: 1,
+				cd: decode(encodeClientData(t, "webauthn.get", testChallenge, "http://localhost:3001"))},
+			cred:    testCredential(t, 0),
+			wantErr: "unexpected origin",
+		},
+		{
+			name:    "wrong rpIdHash",
+			a:       assertion{rpID: "evil.example", flags: flagUserPresent, signCount: 1, cd: cd},
+			cred:    testCredential(t, 0),
+			wantErr: "RP ID hash mismatch",
+		},
+		{
+			name:    "user not present",
+			a:       assertion{rpID: testRP.ID, flags: 0x04, signCount: 1, cd: cd},
+			cred:    testCredential(t, 0),
+			wantErr: "user not present",
+		},
+		{
+			name: "authData too short",
+			a:    valid,
+			tamper: func(r *AssertionResponse) {
+				r.Response.AuthenticatorData = EncodeID(decode(r.Response.AuthenticatorData)[:36])
+			},
+			cred:    testCredential(t, 0),
+			wantErr: "authenticator data too short",
+		},
+		{
+			name: "authData modified after signing",
+			a:    valid,
+			tamper: func(r *AssertionResponse) {
+				authData := decode(r.Response.AuthenticatorData)
+				authData[36]++
+				r.Response.AuthenticatorData = EncodeID(authData)
+			},
+			cred:    testCredential(t, 0),
+			wantErr: "invalid EdDSA signature",
+		},
+		{
+			name: "client data modified after signing",
+			a:    valid,
+			tamper: func(r *AssertionResponse) {
+				r.Response.ClientDataJSON = EncodeID(
+					[]byte(strings.Replace(string(cd), "}", `,"crossOrigin":true}`, 1)),
+				)
+			},
+			cred:    testCredential(t, 0),
+			wantErr: "invalid EdDSA signature",
+		},
+		{
+			name: "tampered signature",
+			a:    valid,
+			tamper: func(r *AssertionResponse) {
+				sig := decode(r.Response.Signature)
+				sig[0] ^= 0x80
+				r.Response.Signature = EncodeID(sig)
+			},
+			cred:    testCredential(t, 0),
+			wantErr: "invalid EdDSA signature",
+		},
+		{
+			name:    "signature not base64url",
+			a:       valid,
+			tamper:  func(r *AssertionResponse) { r.Response.Signature = "@@" },
+			cred:    testCredential(t, 0),
+			wantErr: "invalid signature",
+		},
+		{
+			name: "stored key of another credential",
+			a:    valid,
+			cred: Credential{
+				ID:        []byte(testCredentialID),
+				PublicKey: coseOKP(make(ed25519.PublicKey, ed25519.PublicKeySize)),
+			},
+			wantErr: "invalid EdDSA signature",
+		},
+		{
+			name: "invalid stored key",
+			a:    valid,
+			cred: Credential{
+				ID:        []byte(testCredentialID),
+				PublicKey: mustHex(t, testCOSEKey)[:10],
+			},
+			wantErr: "unexpected end of data",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.a.response(t)
+			if tt.tamper != nil {
+				tt.tamper(&res)
+			}
+
+			signCount, err := testRP.VerifyAssertion(res, testChallenge, tt.cred)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %q does not contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if signCount != tt.a.signCount {
+				t.Errorf("sign count = %d, want %d", signCount, tt.a.signCount)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionSignCount(t *testing.T) {
+	cd, err := DecodeID(encodeClientData(t, "webauthn.get", testChallenge, testRP.Origin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		stored, given uint32
+		wantErr       bool
+	}{
+		{"not implemented", 0, 0, false},
+		{"first use", 0, 1, false},
+		{"increased", 41, 42, false},
+		{"jump", 41, 1000, false},
+		{"same", 42, 42, true},
+		{"decreased", 42, 41, true},
+		{"reset to zero", 42, 0, true},
+		{"wrapped", 1<<32 - 1, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assertion{
+				rpID: testRP.ID, flags: flagUserPresent, signCount: tt.given, cd: cd,
+			}
+			signCount, err := testRP.VerifyAssertion(
+				a.response(t), testChallenge, testCredential(t, tt.stored),
+			)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "counter did not increase") {
+					t.Errorf("expected a counter error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if signCount != tt.given {
+				t.Errorf("sign count = %d, want %d", signCount, tt.given)
+			}
+		})
+	}
+}